@@ -0,0 +1,800 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/freundallein/loadbalancer/bucket"
+	"github.com/freundallein/loadbalancer/config"
+	"github.com/freundallein/loadbalancer/discovery"
+	"github.com/freundallein/loadbalancer/httpserv"
+	"github.com/freundallein/loadbalancer/proxyproto"
+	"github.com/freundallein/loadbalancer/tcpserv"
+	"github.com/freundallein/loadbalancer/udpserv"
+	"github.com/freundallein/loadbalancer/upgrade"
+)
+
+const (
+	reloadPath          = "/-/reload"
+	serversPath         = "/-/servers"
+	healthzPath         = "/healthz"
+	drainCheckPeriod    = 1 * time.Second
+	shutdownCheckPeriod = 100 * time.Millisecond
+	upgradeReadyTimeout = 1 * time.Minute
+)
+
+var (
+	ErrListenersChanged = errors.New("listener addresses, modes, TLS, h2c, PROXY protocol and UDP settings can't be changed on reload, restart required")
+)
+
+// pool - running servers bucket along with its settings
+type pool struct {
+	config config.Pool
+	bucket bucket.ServerBucket
+	cancel context.CancelFunc // stops discovery provider
+}
+
+// state - immutable snapshot of configuration and pools, swapped on reload
+type state struct {
+	config *config.Config
+	pools  map[string]*pool
+}
+
+// App - loadbalancer runtime, owning pools and listeners
+type App struct {
+	lock      sync.Mutex                       // serializes reloads
+	state     atomic.Value                     // current *state
+	load      func() (*config.Config, error)   // configuration source for reloads
+	handlers  map[string]*httpserv.SwapHandler // http listeners handlers by address
+	servers   map[string]*http.Server          // http listeners by address
+	proxies   map[string]*tcpserv.Server       // tcp listeners by address
+	relays    map[string]*udpserv.Server       // udp listeners by address
+	listeners []config.Listener                // listeners settings
+	certs     map[string]*httpserv.CertStore   // TLS listeners certificates by address
+	inherited map[string]*os.File              // sockets passed by previous process or systemd, by name
+	sockets   map[string]upgrade.Filer         // listening sockets by listener key, for upgrade
+	ctx       context.Context                  // background watchers context, done on shutdown
+	cancel    context.CancelFunc
+	stopping  int32 // healthz fails, when set
+	upgraded  bool  // listening sockets are handed over to a new process
+}
+
+// New - build pools and listeners from configuration
+// load is used to read configuration again on reload
+func New(cfg *config.Config, load func() (*config.Config, error)) (*App, error) {
+	initial, err := build(cfg, &state{pools: map[string]*pool{}})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	app := &App{
+		load:     load,
+		ctx:      ctx,
+		cancel:   cancel,
+		handlers: map[string]*httpserv.SwapHandler{},
+		servers:  map[string]*http.Server{},
+		proxies:  map[string]*tcpserv.Server{},
+		relays:   map[string]*udpserv.Server{},
+		certs:    map[string]*httpserv.CertStore{},
+
+		inherited: map[string]*os.File{},
+		sockets:   map[string]upgrade.Filer{},
+	}
+	app.state.Store(initial)
+	for _, listener := range cfg.Listeners {
+		app.listeners = append(app.listeners, listener)
+		switch listener.Mode {
+		case config.ModeTCP:
+			app.proxies[listener.Address] = tcpserv.New(listener.Address, initial.pools[listener.Pool].bucket)
+			continue
+		case config.ModeUDP:
+			relay := udpserv.New(listener.Address, initial.pools[listener.Pool].bucket)
+			relay.IdleTimeout = listener.UDP.IdleTimeout.Duration()
+			relay.PerPacket = listener.UDP.Balance == "packet"
+			relay.MaxSessions = listener.UDP.MaxSessions
+			app.relays[listener.Address] = relay
+			continue
+		}
+		swap := httpserv.NewSwapHandler(initial.handler(listener))
+		app.handlers[listener.Address] = swap
+		mux := http.NewServeMux()
+		mux.HandleFunc(reloadPath, app.serveReload)
+		mux.HandleFunc(serversPath, app.serveServers)
+		mux.Handle(healthzPath, app.healthz(swap))
+		mux.Handle("/", swap)
+		server := httpserv.New(listener.Address, mux)
+		if listener.H2C {
+			server.Handler = httpserv.H2C(server.Handler)
+		}
+		if listener.TLS != nil {
+			certs, err := tlsConfig(listener, server)
+			if err != nil {
+				initial.stopCreated(&state{})
+				cancel()
+				return nil, fmt.Errorf("%s: %s", listener.Address, err.Error())
+			}
+			app.certs[listener.Address] = certs
+		}
+		app.servers[listener.Address] = server
+	}
+	return app, nil
+}
+
+// tlsConfig - load listener's certificates and set up server's TLS
+func tlsConfig(listener config.Listener, server *http.Server) (*httpserv.CertStore, error) {
+	files := []httpserv.CertFiles{}
+	for _, cert := range listener.TLS.Certificates {
+		files = append(files, httpserv.CertFiles{CertFile: cert.CertFile, KeyFile: cert.KeyFile})
+	}
+	certs, err := httpserv.NewCertStore(listener.Address, files)
+	if err != nil {
+		return nil, err
+	}
+	version, err := httpserv.ParseTLSVersion(listener.TLS.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	suites, err := httpserv.ParseCipherSuites(listener.TLS.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	server.TLSConfig = certs.TLSConfig(version, suites)
+	if auth := listener.TLS.ClientAuth; auth != nil {
+		cas, err := httpserv.ClientCAs(auth.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig.ClientCAs = cas
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if auth.Required {
+			server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return certs, nil
+}
+
+// Inherit - use sockets of previous process or systemd instead of opening listeners' ones
+// Sockets are matched by listener mode and address, like "tcp :5432", or by listener name.
+func (a *App) Inherit(files map[string]*os.File) {
+	for name, file := range files {
+		a.inherited[name] = file
+	}
+}
+
+// ListenAndServe - start all listeners, returns the first listener error
+// Parent process and systemd are notified, once all listeners are open.
+func (a *App) ListenAndServe() error {
+	go httpserv.CollectMetrics(a.buckets)
+	for _, listener := range a.listeners {
+		if certs, ok := a.certs[listener.Address]; ok {
+			go certs.Watch(a.ctx, listener.TLS.ReloadPeriod.Duration())
+		}
+	}
+	errs, err := a.serve()
+	if err != nil {
+		return err
+	}
+	if err := upgrade.Ready(fmt.Sprintf("serving %d listeners", len(a.listeners))); err != nil {
+		log.Printf("[upgrade] readiness notification failed: %s\n", err.Error())
+	}
+	return <-errs
+}
+
+// serve - open listeners' sockets and serve them in background, returning channel of their errors
+func (a *App) serve() (chan error, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	errs := make(chan error, len(a.listeners))
+	for _, listener := range a.listeners {
+		if listener.Mode == config.ModeUDP {
+			conn, err := openPacket(listener, a.inheritedFile(listener))
+			if err != nil {
+				return nil, err
+			}
+			a.sockets[listenerKey(listener)] = conn.(upgrade.Filer)
+			relay := a.relays[listener.Address]
+			log.Printf("[config] udpserv started at %s\n", relay.Addr)
+			go func(relay *udpserv.Server) {
+				errs <- relay.Serve(conn)
+			}(relay)
+			continue
+		}
+		socket, err := open(listener, a.inheritedFile(listener))
+		if err != nil {
+			return nil, err
+		}
+		a.sockets[listenerKey(listener)] = socket.(upgrade.Filer)
+		ln, err := withProxyProtocol(socket, listener.ProxyProtocol)
+		if err != nil {
+			return nil, err
+		}
+		if listener.Mode == config.ModeTCP {
+			proxy := a.proxies[listener.Address]
+			log.Printf("[config] tcpserv started at %s\n", proxy.Addr)
+			go func(proxy *tcpserv.Server) {
+				errs <- proxy.Serve(ln)
+			}(proxy)
+			continue
+		}
+		server := a.servers[listener.Address]
+		log.Printf("[config] httpserv started at %s\n", server.Addr)
+		go func(server *http.Server) {
+			if server.TLSConfig != nil {
+				errs <- server.ServeTLS(ln, "", "")
+				return
+			}
+			errs <- server.Serve(ln)
+		}(server)
+	}
+	for name, file := range a.inherited {
+		log.Printf("[upgrade] inherited socket %s doesn't match any listener, closing\n", name)
+		file.Close()
+		delete(a.inherited, name)
+	}
+	return errs, nil
+}
+
+// inheritedFile - take listener's inherited socket, by key or name, nil if there is none
+func (a *App) inheritedFile(listener config.Listener) *os.File {
+	for _, name := range []string{listenerKey(listener), listener.Name} {
+		if file, ok := a.inherited[name]; ok && name != "" {
+			delete(a.inherited, name)
+			log.Printf("[upgrade] %s uses inherited socket %s\n", listener.Address, name)
+			return file
+		}
+	}
+	return nil
+}
+
+// open - listener's socket, inherited one if present
+func open(listener config.Listener, inherited *os.File) (net.Listener, error) {
+	if inherited != nil {
+		defer inherited.Close()
+		return net.FileListener(inherited)
+	}
+	if path, ok := listener.UnixSocket(); ok {
+		return listenUnix(path, listener.Socket)
+	}
+	return net.Listen("tcp", listener.Address)
+}
+
+// openPacket - udp listener's socket, inherited one if present
+func openPacket(listener config.Listener, inherited *os.File) (net.PacketConn, error) {
+	if inherited != nil {
+		defer inherited.Close()
+		return net.FilePacketConn(inherited)
+	}
+	return net.ListenPacket("udp", listener.Address)
+}
+
+// withProxyProtocol - parse PROXY protocol headers of listener's connections, if enabled
+func withProxyProtocol(ln net.Listener, pp *config.ProxyProtocol) (net.Listener, error) {
+	if pp == nil {
+		return ln, nil
+	}
+	wrapped, err := proxyproto.NewListener(ln, pp.TrustedSources, pp.Timeout.Duration())
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+// listenUnix - listen on unix socket, replacing stale socket file of previous run
+// Socket file is removed when listener is closed.
+func listenUnix(path string, socket *config.Socket) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if socket != nil {
+		mode, err := socket.FileMode()
+		if err == nil {
+			err = os.Chmod(path, mode)
+		}
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// Reload - read configuration again, build new pools and atomically swap routing
+// Unchanged pools are kept as is, unchanged servers of changed pools are carried over
+// with their health state and in-flight counters. Old pools finish their requests.
+// Failed reload leaves running configuration untouched.
+func (a *App) Reload() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	err := a.reload()
+	if err != nil {
+		log.Printf("[reload] failed: %s\n", strings.Replace(err.Error(), "\n", "; ", -1))
+		return err
+	}
+	log.Println("[reload] configuration reloaded")
+	upgrade.Notify("STATUS=configuration reloaded at " + time.Now().Format(time.RFC3339))
+	return nil
+}
+
+func (a *App) reload() error {
+	cfg, err := a.load()
+	if err != nil {
+		return err
+	}
+	current := a.current()
+	if !sameListeners(current.config, cfg) {
+		return ErrListenersChanged
+	}
+	next, err := build(cfg, current)
+	if err != nil {
+		return err
+	}
+	a.state.Store(next)
+	for _, listener := range cfg.Listeners {
+		switch listener.Mode {
+		case config.ModeTCP:
+			a.proxies[listener.Address].Swap(next.pools[listener.Pool].bucket)
+		case config.ModeUDP:
+			a.relays[listener.Address].Swap(next.pools[listener.Pool].bucket)
+		default:
+			a.handlers[listener.Address].Swap(next.handler(listener))
+		}
+	}
+	for name, old := range current.pools {
+		if next.pools[name] != old {
+			go drain(name, old, next.pools[name])
+		}
+	}
+	return nil
+}
+
+// Shutdown - stop accepting connections and wait for in-flight requests up to configured timeout
+// Healthz fails for the drain delay first, while listeners still accept, so upstream balancers stop
+// sending requests. The delay is skipped after upgrade: the new process accepts on the same sockets.
+// Upgraded connections are closed at once, unless configured to wait for them.
+// Connections left after the deadline are closed, pools are stopped in the end.
+func (a *App) Shutdown(ctx context.Context) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	settings := a.current().config.Shutdown
+	if settings.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, settings.Timeout.Duration())
+		defer cancel()
+	}
+	atomic.StoreInt32(&a.stopping, 1)
+	if delay := settings.DrainDelay.Duration(); delay > 0 && !a.upgraded {
+		log.Printf("[shutdown] failing healthchecks for %s before closing listeners\n", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+	a.cancel()
+	errs := make(chan error, len(a.servers)+len(a.proxies))
+	for _, server := range a.servers {
+		go func(server *http.Server) {
+			errs <- server.Shutdown(ctx)
+		}(server)
+	}
+	for _, proxy := range a.proxies {
+		go func(proxy *tcpserv.Server) {
+			errs <- proxy.Shutdown(ctx)
+		}(proxy)
+	}
+	var err error
+	for _, relay := range a.relays {
+		if cerr := relay.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	pools := a.current().pools
+	if !settings.WaitWebSockets {
+		for _, p := range pools {
+			p.bucket.CloseUpgraded()
+		}
+	}
+	for i := 0; i < cap(errs); i++ {
+		if serr := <-errs; serr != nil && err == nil {
+			err = serr
+		}
+	}
+	if werr := waitInFlight(ctx, pools); werr != nil && err == nil {
+		err = werr
+	}
+	if ctx.Err() != nil {
+		log.Println("[shutdown] deadline exceeded, closing remaining connections")
+		for _, server := range a.servers {
+			server.Close()
+		}
+		for _, p := range pools {
+			p.bucket.CloseUpgraded()
+		}
+	}
+	for _, p := range pools {
+		p.stop()
+	}
+	return err
+}
+
+// Upgrade - start a new process of the binary, passing it listening sockets, and wait until it is ready
+// Afterwards this process is expected to shut down, while the new one accepts connections.
+func (a *App) Upgrade() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeReadyTimeout)
+	defer cancel()
+	process, err := upgrade.Start(ctx, a.sockets)
+	if err != nil {
+		return err
+	}
+	for _, socket := range a.sockets {
+		if ln, ok := socket.(*net.UnixListener); ok {
+			ln.SetUnlinkOnClose(false) // socket file is used by the new process
+		}
+	}
+	a.upgraded = true
+	log.Printf("[upgrade] new process %d is ready\n", process.Pid)
+	return upgrade.Notify(fmt.Sprintf("MAINPID=%d", process.Pid))
+}
+
+// waitInFlight - wait until pools have no in-flight requests or ctx is done
+func waitInFlight(ctx context.Context, pools map[string]*pool) error {
+	ticker := time.NewTicker(shutdownCheckPeriod)
+	defer ticker.Stop()
+	for {
+		var inFlight int64
+		for _, p := range pools {
+			inFlight += p.bucket.InFlight()
+		}
+		if inFlight == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthz - fail healthchecks while shutting down, pass them to listener's handler otherwise
+func (a *App) healthz(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&a.stopping) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("error: shutting down"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveReload - reload endpoint, enabled by admin reload token
+func (a *App) serveReload(w http.ResponseWriter, r *http.Request) {
+	token := a.current().config.Admin.ReloadToken
+	httpserv.Reload(token, a.Reload)(w, r)
+}
+
+// serveServers - servers state endpoint, enabled by admin reload token
+func (a *App) serveServers(w http.ResponseWriter, r *http.Request) {
+	token := a.current().config.Admin.ReloadToken
+	httpserv.Servers(token, a.buckets)(w, r)
+}
+
+func (a *App) current() *state {
+	return a.state.Load().(*state)
+}
+
+// buckets - current pools by name
+func (a *App) buckets() map[string]bucket.ServerBucket {
+	buckets := map[string]bucket.ServerBucket{}
+	for name, p := range a.current().pools {
+		buckets[name] = p.bucket
+	}
+	return buckets
+}
+
+// handler - listener's requests handler: routing or redirect to HTTPS
+func (s *state) handler(listener config.Listener) http.Handler {
+	if redirect := listener.HTTPSRedirect; redirect != nil {
+		return httpserv.RedirectHTTPS(redirect.Port, redirect.Status)
+	}
+	return httpserv.Handler(s.router(listener))
+}
+
+// router - build listener's routes over state pools
+// Expects configuration to be validated, so regular expressions compile
+func (s *state) router(listener config.Listener) *httpserv.Router {
+	routes := make([]*httpserv.Route, 0, len(listener.Routes))
+	for _, rc := range listener.Routes {
+		route := &httpserv.Route{
+			Name:       rc.Name,
+			Host:       rc.Host,
+			PathPrefix: rc.PathPrefix,
+			Methods:    rc.Methods,
+			Headers:    rc.Headers,
+			Bucket:     s.pools[rc.Pool].bucket,
+			Policies:   headerPolicies(s.pools[rc.Pool].config.HeaderRules, rc.HeaderRules),
+
+			RequireClientCert: rc.RequireClientCert,
+		}
+		if rc.PathRegex != "" {
+			route.PathRegex = regexp.MustCompile(rc.PathRegex)
+		}
+		if rw := rc.Rewrite; rw != nil {
+			route.Rewrite = &httpserv.Rewrite{
+				StripPrefix: rw.StripPrefix,
+				AddPrefix:   rw.AddPrefix,
+				Replacement: rw.Replacement,
+				QueryAdd:    rw.QueryAdd,
+				QueryRemove: rw.QueryRemove,
+			}
+			if rw.Regex != "" {
+				route.Rewrite.Regex = regexp.MustCompile(rw.Regex)
+			}
+		}
+		routes = append(routes, route)
+	}
+	var fallback *httpserv.Route
+	if p, ok := s.pools[listener.Pool]; ok {
+		fallback = &httpserv.Route{Name: "default", Bucket: p.bucket, Policies: headerPolicies(p.config.HeaderRules)}
+	}
+	notFound := httpserv.Response{}
+	if listener.NotFound != nil {
+		notFound = httpserv.Response{Status: listener.NotFound.Status, Body: listener.NotFound.Body}
+	}
+	router := httpserv.NewRouter(routes, fallback, listener.RouteMatching, notFound)
+	if fw := listener.Forwarding; fw != nil {
+		forwarding, err := httpserv.NewForwarding(fw.TrustedProxies, fw.StripUntrusted)
+		if err == nil {
+			router.SetForwarding(forwarding)
+		}
+	}
+	if listener.TLS != nil && listener.TLS.ClientAuth != nil {
+		auth := listener.TLS.ClientAuth
+		router.SetClientAuth(&httpserv.ClientAuth{
+			Required:          auth.Required,
+			SubjectHeader:     auth.Headers.Subject,
+			SANHeader:         auth.Headers.SAN,
+			FingerprintHeader: auth.Headers.Fingerprint,
+		})
+	}
+	return router
+}
+
+// headerPolicies - convert pool's and route's header rules, skipping absent ones
+func headerPolicies(rules ...*config.HeaderRules) []*httpserv.HeaderPolicy {
+	policies := []*httpserv.HeaderPolicy{}
+	convert := func(hr config.Headers) httpserv.HeaderRules {
+		return httpserv.HeaderRules{Rename: hr.Rename, Remove: hr.Remove, Set: hr.Set, Add: hr.Add}
+	}
+	for _, rule := range rules {
+		if rule == nil {
+			continue
+		}
+		policies = append(policies, &httpserv.HeaderPolicy{
+			Request:  convert(rule.Request),
+			Response: convert(rule.Response),
+		})
+	}
+	return policies
+}
+
+// stopCreated - stop pools, which are not shared with previous state
+func (s *state) stopCreated(previous *state) {
+	for name, p := range s.pools {
+		if previous.pools[name] != p {
+			p.stop()
+		}
+	}
+}
+
+// build - create pools for configuration, reusing previous ones when possible
+// Newly created pools are stopped if any of them fails
+func build(cfg *config.Config, previous *state) (*state, error) {
+	next := &state{config: cfg, pools: map[string]*pool{}}
+	for _, pc := range cfg.Pools {
+		old := previous.pools[pc.Name]
+		if old != nil && reflect.DeepEqual(old.config, pc) {
+			next.pools[pc.Name] = old
+			continue
+		}
+		p, err := buildPool(pc, old)
+		if err != nil {
+			next.stopCreated(previous)
+			return nil, fmt.Errorf("%s: %s", pc.Name, err.Error())
+		}
+		next.pools[pc.Name] = p
+		log.Printf("[config] servers bucket %s started\n", pc.Name)
+	}
+	return next, nil
+}
+
+// buildPool - create servers bucket from pool settings and start its services
+// Servers of the previous pool with the same address and server settings are reused
+func buildPool(pc config.Pool, old *pool) (*pool, error) {
+	buckt, err := bucket.New(
+		pc.Algorithm,
+		bucket.WithName(pc.Name),
+		bucket.WithHealthCheckPeriod(pc.HealthCheck.Period.Duration()),
+		bucket.WithHealthCheckJitter(pc.HealthCheck.Jitter.Duration()),
+		bucket.WithHealthCheckWorkers(pc.HealthCheck.Workers),
+		bucket.WithRemoveStalePeriod(pc.StaleCheckPeriod.Duration()),
+		bucket.WithMaxRetries(*pc.Retry.MaxRetries),
+		bucket.WithMaxAttempts(pc.Retry.MaxAttempts),
+		bucket.WithRetryDelay(pc.Retry.Delay.Duration()),
+		bucket.WithUpgradedIdleTimeout(pc.WebSocket.IdleTimeout.Duration()),
+		bucket.WithCloseUpgraded(pc.WebSocket.CloseOnRemoval),
+		bucket.WithConnectTimeout(pc.TCP.ConnectTimeout.Duration()),
+		bucket.WithTCPIdleTimeout(pc.TCP.IdleTimeout.Duration()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	options, err := serverOptions(pc)
+	if err != nil {
+		return nil, err
+	}
+	reusable := map[string]bucket.Server{}
+	if old != nil && sameServerSettings(old.config, pc) {
+		for _, srv := range old.bucket.Servers() {
+			reusable[srv.Address().String()] = srv
+		}
+	}
+	for _, addr := range pc.Servers {
+		parsed, err := url.Parse(addr)
+		if err != nil {
+			return nil, err
+		}
+		srv, ok := reusable[parsed.String()]
+		if !ok {
+			srv, err = bucket.NewServer(addr, options...)
+			if err != nil {
+				return nil, err
+			}
+		}
+		buckt.AddServer(srv)
+		log.Printf("[config] server %s added to %s\n", addr, pc.Name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if pc.Kubernetes != nil {
+		namespace, service := "", pc.Kubernetes.Service
+		if parts := strings.SplitN(service, "/", 2); len(parts) == 2 {
+			namespace, service = parts[0], parts[1]
+		}
+		k8sConfig, err := discovery.InClusterConfig(namespace, service, pc.Kubernetes.PortName)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		k8sConfig.ServerOptions = options
+		provider, err := discovery.NewKubernetes(*k8sConfig)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		go provider.Run(ctx, buckt)
+		log.Printf("[config] %s watching kubernetes service %s\n", pc.Name, pc.Kubernetes.Service)
+	}
+	buckt.RunServices(ctx, pc.StaleTimeout.Duration())
+	return &pool{config: pc, bucket: buckt, cancel: cancel}, nil
+}
+
+// serverOptions - settings of pool's servers
+func serverOptions(pc config.Pool) ([]bucket.ServerOption, error) {
+	options := []bucket.ServerOption{
+		bucket.WithPingTimeout(pc.HealthCheck.Timeout.Duration()),
+		bucket.WithAvailable(pc.HealthCheck.AssumeAvailable),
+	}
+	if version := pc.ProxyProtocolVersion(); version != 0 {
+		options = append(options, bucket.WithProxyProtocol(version))
+	}
+	if pc.Protocol != "" {
+		options = append(options, bucket.WithProtocol(pc.Protocol))
+	}
+	tlsConfig, err := pc.ClientTLS()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		options = append(options, bucket.WithTLS(tlsConfig))
+	}
+	return options, nil
+}
+
+// sameServerSettings - check if servers of one pool can be reused by another
+// Changed TLS files are picked up only by new server instances
+func sameServerSettings(a, b config.Pool) bool {
+	return a.ProxyProtocol == b.ProxyProtocol && a.Protocol == b.Protocol &&
+		reflect.DeepEqual(a.HealthCheck, b.HealthCheck) && reflect.DeepEqual(a.TLS, b.TLS)
+}
+
+// stop - stop pool's discovery and services
+func (p *pool) stop() {
+	p.cancel()
+	p.bucket.Stop()
+}
+
+// drain - stop replaced pool and wait for its in-flight requests
+// Series of servers, which aren't in the next pool, are deleted at once, their upgraded connections
+// are closed if configured so.
+func drain(name string, p, next *pool) {
+	p.stop()
+	if removed := removedServers(p, next); len(removed) > 0 {
+		addresses := make([]string, 0, len(removed))
+		for _, srv := range removed {
+			addresses = append(addresses, srv.Address().String())
+		}
+		bucket.DeleteMetrics(name, addresses...)
+		if p.config.WebSocket.CloseOnRemoval {
+			p.bucket.CloseUpgraded(removed...)
+		}
+	}
+	for p.bucket.InFlight() > 0 {
+		time.Sleep(drainCheckPeriod)
+	}
+	log.Printf("[reload] old servers bucket %s drained\n", name)
+}
+
+// removedServers - servers of pool, which addresses aren't in the next one, all of them if pool is removed
+// Servers replaced with new instances of the same address share series with them, they aren't removed.
+func removedServers(p, next *pool) []bucket.Server {
+	kept := map[string]bool{}
+	if next != nil {
+		for _, srv := range next.bucket.Servers() {
+			kept[srv.Address().String()] = true
+		}
+	}
+	removed := []bucket.Server{}
+	for _, srv := range p.bucket.Servers() {
+		if !kept[srv.Address().String()] {
+			removed = append(removed, srv)
+		}
+	}
+	return removed
+}
+
+// listenerKey - listener's socket identity, udp and tcp listeners may share an address
+func listenerKey(listener config.Listener) string {
+	return listener.Mode + " " + listener.Address
+}
+
+// sameListeners - check if listener sockets are unchanged: addresses, modes, TLS, h2c, PROXY protocol, UDP sessions
+// and unix socket permissions. HTTPS redirects are part of swapped handlers, they may change.
+func sameListeners(current, next *config.Config) bool {
+	if len(current.Listeners) != len(next.Listeners) {
+		return false
+	}
+	listeners := map[string]config.Listener{}
+	for _, listener := range current.Listeners {
+		listeners[listenerKey(listener)] = listener
+	}
+	for _, listener := range next.Listeners {
+		old, ok := listeners[listenerKey(listener)]
+		if !ok || old.H2C != listener.H2C || !reflect.DeepEqual(old.TLS, listener.TLS) || !reflect.DeepEqual(old.ProxyProtocol, listener.ProxyProtocol) ||
+			!reflect.DeepEqual(old.UDP, listener.UDP) || !reflect.DeepEqual(old.Socket, listener.Socket) {
+			return false
+		}
+	}
+	return true
+}
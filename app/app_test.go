@@ -0,0 +1,505 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/freundallein/loadbalancer/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newBackend(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+}
+
+// newConfig - configuration of pools, which servers are available before their first check
+func newConfig(pools ...config.Pool) *config.Config {
+	for i := range pools {
+		pools[i].HealthCheck.AssumeAvailable = true
+	}
+	cfg := &config.Config{
+		Listeners: []config.Listener{{Address: "127.0.0.1:0", Pool: pools[0].Name}},
+		Pools:     pools,
+		Admin:     config.Admin{ReloadToken: "secret"},
+	}
+	cfg.SetDefaults()
+	return cfg
+}
+
+func loadConfigs(configs ...*config.Config) func() (*config.Config, error) {
+	return func() (*config.Config, error) {
+		cfg := configs[0]
+		configs = configs[1:]
+		return cfg, nil
+	}
+}
+
+func get(t *testing.T, app *App, method, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	app.servers[app.listeners[0].Address].Handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// stalledBackend - address of server, which accepts connections and never answers, TLS handshakes hang
+func stalledBackend(t *testing.T) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	return "https://" + ln.Addr().String(), func() {
+		ln.Close()
+		close(conns)
+		for conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+func TestReloadCarriesOverServers(t *testing.T) {
+	one, two := newBackend("one"), newBackend("two")
+	defer one.Close()
+	defer two.Close()
+	stalled, closeStalled := stalledBackend(t)
+	defer closeStalled()
+	retries := 1
+	timeout := config.Duration(time.Second)
+	initial := newConfig(config.Pool{Name: "api", Servers: []string{stalled, one.URL}, HealthCheck: config.HealthCheck{Timeout: timeout}})
+	changed := newConfig(config.Pool{
+		Name:        "api",
+		Servers:     []string{stalled, one.URL, two.URL},
+		Retry:       config.Retry{MaxRetries: &retries},
+		HealthCheck: config.HealthCheck{Timeout: timeout},
+	})
+	app, err := New(initial, loadConfigs(changed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Shutdown(context.Background())
+	old := app.current().pools["api"]
+	old.bucket.Servers()[0].SetAvailable(false)
+	started := time.Now()
+	if err := app.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed > timeout.Duration()/2 {
+		t.Error("Expected", "reload without probing servers", "got", elapsed)
+	}
+	next := app.current().pools["api"]
+	if next == old {
+		t.Fatal("Expected", "new pool", "got", "old one")
+	}
+	servers := next.bucket.Servers()
+	if len(servers) != 3 {
+		t.Fatal("Expected", 3, "got", len(servers))
+	}
+	if servers[0] != old.bucket.Servers()[0] || servers[1] != old.bucket.Servers()[1] {
+		t.Error("Expected", "carried over servers", "got", "new instances")
+	}
+	if servers[0].IsAvailable() {
+		t.Error("Expected", "unavailable server stays unavailable", "got", "available")
+	}
+}
+
+func TestRemovedServers(t *testing.T) {
+	one, two := newBackend("one"), newBackend("two")
+	defer one.Close()
+	defer two.Close()
+	initial := newConfig(config.Pool{Name: "api", Servers: []string{one.URL, two.URL}})
+	changed := newConfig(config.Pool{Name: "api", Servers: []string{one.URL}})
+	app, err := New(initial, loadConfigs(changed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := app.current().pools["api"]
+	if err := app.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	next := app.current().pools["api"]
+	removed := removedServers(old, next)
+	if len(removed) != 1 || removed[0] != old.bucket.Servers()[1] {
+		t.Error("Expected", two.URL, "got", removed)
+	}
+	if removed := removedServers(old, nil); len(removed) != 2 {
+		t.Error("Expected", 2, "got", len(removed))
+	}
+}
+
+// hasSeries - whether server's availability series of pool is exported
+func hasSeries(t *testing.T, pool, server string) bool {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "lb_server_available" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["pool"] == pool && labels["server"] == server {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestReloadDeletesRemovedSeries(t *testing.T) {
+	one, two := newBackend("one"), newBackend("two")
+	defer one.Close()
+	defer two.Close()
+	initial := newConfig(
+		config.Pool{Name: "series", Servers: []string{one.URL, two.URL}},
+		config.Pool{Name: "series-removed", Servers: []string{two.URL}},
+	)
+	changed := newConfig(config.Pool{Name: "series", Servers: []string{one.URL}})
+	app, err := New(initial, loadConfigs(changed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasSeries(t, "series", two.URL) || !hasSeries(t, "series-removed", two.URL) {
+		t.Fatal("Expected", "series of configured servers", "got", "none")
+	}
+	if err := app.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && (hasSeries(t, "series", two.URL) || hasSeries(t, "series-removed", two.URL)); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if hasSeries(t, "series", two.URL) || hasSeries(t, "series-removed", two.URL) {
+		t.Error("Expected", "series of removed server and pool deleted", "got", "series present")
+	}
+	if !hasSeries(t, "series", one.URL) {
+		t.Error("Expected", "series of carried over server kept", "got", "none")
+	}
+}
+
+func TestNewServersWaitFirstCheck(t *testing.T) {
+	one := newBackend("one")
+	defer one.Close()
+	cfg := newConfig(config.Pool{Name: "api", Servers: []string{one.URL}})
+	cfg.Pools[0].HealthCheck.AssumeAvailable = false
+	app, err := New(cfg, loadConfigs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Shutdown(context.Background())
+	srv := app.current().pools["api"].bucket.Servers()[0]
+	for i := 0; i < 100 && !srv.IsAvailable(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !srv.IsAvailable() {
+		t.Error("Expected", "server available after the first check", "got", srv.IsAvailable())
+	}
+}
+
+func TestReloadKeepsUnchangedPool(t *testing.T) {
+	one := newBackend("one")
+	defer one.Close()
+	pool := config.Pool{Name: "api", Servers: []string{one.URL}}
+	app, err := New(newConfig(pool), loadConfigs(newConfig(pool)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := app.current().pools["api"]
+	if err := app.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if app.current().pools["api"] != old {
+		t.Error("Expected", "unchanged pool", "got", "new one")
+	}
+}
+
+func TestReloadFailureKeepsConfig(t *testing.T) {
+	one := newBackend("one")
+	defer one.Close()
+	initial := newConfig(config.Pool{Name: "api", Servers: []string{one.URL}})
+	invalidAlgorithm := newConfig(config.Pool{Name: "api", Algorithm: "random", Servers: []string{one.URL}})
+	movedListener := newConfig(config.Pool{Name: "api", Servers: []string{one.URL}})
+	movedListener.Listeners[0].Address = "127.0.0.1:1"
+	loadErr := errors.New("line 1: unknown field")
+	calls := 0
+	load := func() (*config.Config, error) {
+		calls++
+		switch calls {
+		case 1:
+			return nil, loadErr
+		case 2:
+			return invalidAlgorithm, nil
+		}
+		return movedListener, nil
+	}
+	app, err := New(initial, load)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := app.current()
+	if err := app.Reload(); err != loadErr {
+		t.Error("Expected", loadErr, "got", err)
+	}
+	if err := app.Reload(); err == nil {
+		t.Error("Expected", "invalid algorithm error", "got", nil)
+	}
+	if err := app.Reload(); err != ErrListenersChanged {
+		t.Error("Expected", ErrListenersChanged, "got", err)
+	}
+	if app.current() != current {
+		t.Error("Expected", "running configuration", "got", "replaced one")
+	}
+}
+
+func TestReloadListenerSettings(t *testing.T) {
+	one := newBackend("one")
+	defer one.Close()
+	initial := newConfig(config.Pool{Name: "api", Servers: []string{one.URL}})
+	redirect := newConfig(config.Pool{Name: "api", Servers: []string{one.URL}})
+	redirect.Listeners[0].HTTPSRedirect = &config.HTTPSRedirect{}
+	redirect.SetDefaults()
+	h2c := newConfig(config.Pool{Name: "api", Servers: []string{one.URL}})
+	h2c.Listeners[0].H2C = true
+	app, err := New(initial, loadConfigs(redirect, h2c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(t, app, http.MethodGet, "/"); rec.Code != http.StatusPermanentRedirect {
+		t.Error("Expected", http.StatusPermanentRedirect, "got", rec.Code)
+	}
+	if err := app.Reload(); err != ErrListenersChanged {
+		t.Error("Expected", ErrListenersChanged, "got", err)
+	}
+}
+
+func TestReloadEndpoint(t *testing.T) {
+	one, two := newBackend("one"), newBackend("two")
+	defer one.Close()
+	defer two.Close()
+	initial := newConfig(config.Pool{Name: "one", Servers: []string{one.URL}})
+	switched := newConfig(
+		config.Pool{Name: "one", Servers: []string{one.URL}},
+		config.Pool{Name: "two", Servers: []string{two.URL}},
+	)
+	switched.Listeners[0].Pool = "two"
+	app, err := New(initial, loadConfigs(switched))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := get(t, app, http.MethodGet, "/").Body.String(); body != "one" {
+		t.Error("Expected", "one", "got", body)
+	}
+	if rec := get(t, app, http.MethodPost, reloadPath); rec.Code != http.StatusOK {
+		t.Fatal("Expected", http.StatusOK, "got", rec.Code, rec.Body.String())
+	}
+	if body := get(t, app, http.MethodGet, "/").Body.String(); body != "two" {
+		t.Error("Expected", "two", "got", body)
+	}
+}
+
+func TestRedirectListener(t *testing.T) {
+	one := newBackend("one")
+	defer one.Close()
+	cfg := newConfig(config.Pool{Name: "api", Servers: []string{one.URL}})
+	cfg.Listeners[0].Pool = ""
+	cfg.Listeners[0].HTTPSRedirect = &config.HTTPSRedirect{}
+	cfg.SetDefaults()
+	app, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := get(t, app, http.MethodGet, "http://example.com/path")
+	if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != "https://example.com/path" {
+		t.Error("Expected", "redirect to https", "got", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lb.sock")
+	stale, _ := net.Listen("unix", path)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := open(config.Listener{Address: "unix://" + path, Socket: &config.Socket{Mode: "0600"}}, nil)
+	if err != nil {
+		t.Fatal("Expected", "stale socket replaced", "got", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Expected", "0600", "got", info, err)
+	}
+	ln.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected", "socket removed on close", "got", err)
+	}
+}
+
+// blockingBackend - backend answering when released
+func blockingBackend(release chan struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "done")
+	}))
+}
+
+// startRequest - send request to app in background, once it is in flight
+func startRequest(t *testing.T, app *App) chan *httptest.ResponseRecorder {
+	responses := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		responses <- get(t, app, "GET", "/slow")
+	}()
+	for i := 0; i < 200 && app.current().pools["api"].bucket.InFlight() == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return responses
+}
+
+func TestShutdownWaitsInFlight(t *testing.T) {
+	release := make(chan struct{})
+	backend := blockingBackend(release)
+	defer backend.Close()
+	cfg := newConfig(config.Pool{Name: "api", Servers: []string{backend.URL}})
+	cfg.Shutdown.DrainDelay = config.Duration(50 * time.Millisecond)
+	app, err := New(cfg, loadConfigs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := get(t, app, "GET", "/healthz"); rec.Code != http.StatusOK {
+		t.Error("Expected", http.StatusOK, "got", rec.Code)
+	}
+	responses := startRequest(t, app)
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Shutdown(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if rec := get(t, app, "GET", "/healthz"); rec.Code != http.StatusServiceUnavailable {
+		t.Error("Expected", http.StatusServiceUnavailable, "got", rec.Code)
+	}
+	select {
+	case err := <-done:
+		t.Fatal("Expected", "in-flight request waited for", "got", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Expected", nil, "got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected", "shutdown after request finished", "got", "timeout")
+	}
+	if rec := <-responses; rec.Code != http.StatusOK || rec.Body.String() != "done" {
+		t.Error("Expected", "done", "got", rec.Code, rec.Body.String())
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	release := make(chan struct{})
+	backend := blockingBackend(release)
+	defer backend.Close()
+	defer close(release)
+	cfg := newConfig(config.Pool{Name: "api", Servers: []string{backend.URL}})
+	cfg.Shutdown.Timeout = config.Duration(50 * time.Millisecond)
+	app, err := New(cfg, loadConfigs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	startRequest(t, app)
+	started := time.Now()
+	if err := app.Shutdown(context.Background()); err != context.DeadlineExceeded {
+		t.Error("Expected", context.DeadlineExceeded, "got", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Error("Expected", "shutdown within timeout", "got", elapsed)
+	}
+}
+
+func TestServeInheritedSocket(t *testing.T) {
+	backend := newBackend("one")
+	defer backend.Close()
+	cfg := newConfig(config.Pool{Name: "api", Servers: []string{backend.URL}})
+	cfg.Listeners[0].Name = "public"
+	app, err := New(cfg, loadConfigs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ln.(*net.TCPListener).File()
+	ln.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Inherit(map[string]*os.File{"public": file})
+	go app.ListenAndServe()
+	defer app.Shutdown(context.Background())
+	resp, err := http.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal("Expected", "inherited socket served", "got", err)
+	}
+	defer resp.Body.Close()
+	if body, _ := ioutil.ReadAll(resp.Body); string(body) != "one" {
+		t.Error("Expected", "one", "got", string(body))
+	}
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	if _, ok := app.sockets["http 127.0.0.1:0"]; !ok || len(app.inherited) != 0 {
+		t.Error("Expected", "inherited socket used", "got", app.sockets, app.inherited)
+	}
+}
+
+func TestShutdownAfterUpgradeSkipsDrainDelay(t *testing.T) {
+	cfg := newConfig(config.Pool{Name: "api", Servers: []string{"http://127.0.0.1:1"}})
+	cfg.Shutdown.DrainDelay = config.Duration(time.Minute)
+	app, err := New(cfg, loadConfigs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.upgraded = true
+	done := make(chan error, 1)
+	go func() {
+		done <- app.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Expected", nil, "got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected", "shutdown without drain delay", "got", "timeout")
+	}
+}
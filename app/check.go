@@ -0,0 +1,119 @@
+package app
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/freundallein/loadbalancer/bucket"
+	"github.com/freundallein/loadbalancer/config"
+)
+
+// probe - single backend reachability check result
+type probe struct {
+	pool   string
+	server string
+	status string
+	failed bool
+}
+
+// CheckConfig - validate configuration file and print its summary, returns exit code
+// Usage: check-config [-probe] <file>
+func CheckConfig(args []string, out io.Writer) int {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	flags.SetOutput(out)
+	reachability := flags.Bool("probe", false, "check reachability of every backend once")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(out, "usage: loadbalancer check-config [-probe] <file>")
+		return 2
+	}
+	path := flags.Arg(0)
+	cfg, err := config.Load(path)
+	if err != nil {
+		if errs, ok := err.(config.Errors); ok {
+			for _, e := range errs {
+				fmt.Fprintf(out, "%s: %s\n", path, e.Error())
+			}
+		} else {
+			fmt.Fprintf(out, "%s: %s\n", path, err.Error())
+		}
+		fmt.Fprintf(out, "%s: invalid\n", path)
+		return 1
+	}
+
+	table := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "LISTENER\tADDRESS\tPOOL")
+	for _, listener := range cfg.Listeners {
+		fmt.Fprintf(table, "%s\t%s\t%s\n", listener.Name, listener.Address, listener.Pool)
+	}
+	fmt.Fprintln(table, "\t\t")
+	fmt.Fprintln(table, "POOL\tALGORITHM\tSERVER\tSTATUS")
+	failed := false
+	for _, result := range probeServers(cfg, *reachability) {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", result.pool, algorithm(cfg, result.pool), result.server, result.status)
+		failed = failed || result.failed
+	}
+	table.Flush()
+	if failed {
+		fmt.Fprintf(out, "%s: unreachable servers found\n", path)
+		return 1
+	}
+	fmt.Fprintf(out, "%s: ok\n", path)
+	return 0
+}
+
+// probeServers - list pools servers, pinging them concurrently if asked
+func probeServers(cfg *config.Config, reachability bool) []*probe {
+	results := []*probe{}
+	var wg sync.WaitGroup
+	for _, pool := range cfg.Pools {
+		if pool.Kubernetes != nil {
+			results = append(results, &probe{
+				pool:   pool.Name,
+				server: "kubernetes:" + pool.Kubernetes.Service,
+				status: "discovered at runtime",
+			})
+		}
+		for _, addr := range pool.Servers {
+			result := &probe{pool: pool.Name, server: addr, status: "-"}
+			results = append(results, result)
+			if !reachability {
+				continue
+			}
+			options, err := serverOptions(pool)
+			if err != nil {
+				result.status, result.failed = err.Error(), true
+				continue
+			}
+			srv, err := bucket.NewServer(addr, options...)
+			if err != nil {
+				result.status, result.failed = err.Error(), true
+				continue
+			}
+			wg.Add(1)
+			go func(result *probe) {
+				defer wg.Done()
+				result.status = "reachable"
+				if !srv.PingServer() {
+					result.status, result.failed = "unreachable", true
+				}
+			}(result)
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+func algorithm(cfg *config.Config, name string) string {
+	for _, pool := range cfg.Pools {
+		if pool.Name == name {
+			return pool.Algorithm
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yml")
+	ioutil.WriteFile(path, []byte(data), 0644)
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestCheckConfigUsage(t *testing.T) {
+	out := &bytes.Buffer{}
+	if code := CheckConfig([]string{}, out); code != 2 {
+		t.Error("Expected", 2, "got", code)
+	}
+}
+
+func TestCheckConfigInvalid(t *testing.T) {
+	path, cleanup := writeConfig(t, "pools:\n  - name: api\n    algorithm: random\n    servers: [api:9000]\n")
+	defer cleanup()
+	out := &bytes.Buffer{}
+	if code := CheckConfig([]string{path}, out); code != 1 {
+		t.Error("Expected", 1, "got", code)
+	}
+	for _, expected := range []string{
+		path + `: line 3: pools[0].algorithm: invalid balancing algorithm chosen.: "random"`,
+		path + `: line 4: pools[0].servers[0]: server address must have scheme and host: "api:9000"`,
+		path + ": listeners: at least one listener is required",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Error("Expected", expected, "got", out.String())
+		}
+	}
+}
+
+func TestCheckConfigProbe(t *testing.T) {
+	backend := newBackend("ok")
+	defer backend.Close()
+	data := fmt.Sprintf(
+		"listeners:\n  - address: \":8000\"\npools:\n  - name: api\n    servers: [%s, http://127.0.0.1:1]\n",
+		backend.URL,
+	)
+	path, cleanup := writeConfig(t, data)
+	defer cleanup()
+	out := &bytes.Buffer{}
+	if code := CheckConfig([]string{path}, out); code != 0 {
+		t.Error("Expected", 0, "got", code, out.String())
+	}
+	out.Reset()
+	if code := CheckConfig([]string{"-probe", path}, out); code != 1 {
+		t.Error("Expected", 1, "got", code)
+	}
+	if !strings.Contains(out.String(), "reachable") || !strings.Contains(out.String(), "unreachable") {
+		t.Error("Expected", "probe statuses", "got", out.String())
+	}
+}
@@ -1,7 +1,10 @@
 package bucket
 
 import (
+	"context"
 	"errors"
+	"net"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"time"
@@ -9,30 +12,80 @@ import (
 
 var (
 	ErrInvalidAlgorithm = errors.New("invalid balancing algorithm chosen.")
+	ErrInvalidAddress   = errors.New("server address must have scheme and host")
+	ErrInvalidSocket    = errors.New("unix server address must have socket path and no host")
+	ErrInvalidProtocol  = errors.New("protocol must be http1, h2 or h2c")
+	ErrInvalidState     = errors.New("state must be active, draining or disabled")
 )
 
 // NewServer - backend server factory
-func NewServer(URL string) (Server, error) {
+func NewServer(URL string, options ...ServerOption) (Server, error) {
 	addr, err := url.Parse(URL)
 	if err != nil {
 		return nil, err
 	}
-	reverseProxy := httputil.NewSingleHostReverseProxy(addr)
-	return &DefaultServer{
+	target := addr
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dial := dialer.DialContext
+	if addr.Scheme == Unix {
+		if addr.Host != "" || addr.Path == "" {
+			return nil, ErrInvalidSocket
+		}
+		// Requests are HTTP ones, every connection goes to the socket
+		target = &url.URL{Scheme: "http", Host: "localhost"}
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", addr.Path)
+		}
+	} else if addr.Scheme == "" || addr.Host == "" {
+		return nil, ErrInvalidAddress
+	}
+	reverseProxy := httputil.NewSingleHostReverseProxy(target)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dial
+	reverseProxy.Transport = transport
+	srv := &DefaultServer{
 		address:      addr,
-		isAvailable:  true,
+		isAvailable:  1,
 		reverseProxy: reverseProxy,
+		transport:    transport,
 		lastSeen:     time.Now().Unix(),
-	}, nil
+		pingTimeout:  defaultPingTimeout,
+	}
+	setProxyHandlers(reverseProxy, srv)
+	director := reverseProxy.Director
+	reverseProxy.Director = func(r *http.Request) {
+		director(r)
+		if modify := GetDirectorFromContext(r); modify != nil {
+			modify(r, srv)
+		}
+	}
+	for _, option := range options {
+		option(srv)
+	}
+	reverseProxy.Transport = srv.roundTripper()
+	if srv.protocol == H2 || srv.protocol == H2C {
+		// Streams, like gRPC ones, have to be delivered without buffering
+		reverseProxy.FlushInterval = -1
+	}
+	return srv, nil
 }
 
 // New - backends pool factory, can use different balancing algorithms in future
-func New(algo string) (ServerBucket, error) {
+func New(algo string, options ...Option) (ServerBucket, error) {
+	cfg := defaultSettings()
+	for _, option := range options {
+		option(&cfg)
+	}
 	var bckt ServerBucket
 	switch algo {
 	case RoundRobin:
 		bckt = &RoundRobinServerBucket{
-			servers: []Server{},
+			settings: cfg,
+		}
+	case LeastConnections:
+		bckt = &RoundRobinServerBucket{
+			settings:  cfg,
+			leastConn: true,
 		}
 	}
 	if bckt == nil {
@@ -1,6 +1,8 @@
 package bucket
 
 import (
+	"context"
+	"net/http"
 	"reflect"
 	"testing"
 )
@@ -16,6 +18,24 @@ func TestNewServer(t *testing.T) {
 		t.Error("Expected", expectedType, "got", observedType)
 	}
 }
+func TestNewServerDirector(t *testing.T) {
+	srv, _ := NewServer("http://testhost:8000")
+	var chosen Server
+	director := func(r *http.Request, s Server) {
+		chosen = s
+		r.Header.Set("X-Backend", s.Address().Host)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/test", nil)
+	req = req.WithContext(context.WithValue(req.Context(), DirectorKey, director))
+	srv.ReverseProxy().Director(req)
+	if chosen != srv {
+		t.Error("Expected", srv, "got", chosen)
+	}
+	if req.URL.Host != "testhost:8000" || req.Header.Get("X-Backend") != "testhost:8000" {
+		t.Error("Expected", "testhost:8000", "got", req.URL.Host, req.Header.Get("X-Backend"))
+	}
+}
+
 func TestNewServerInvalidUrl(t *testing.T) {
 	_, err := NewServer("\x80testhost:8000")
 	if err == nil {
@@ -24,6 +44,15 @@ func TestNewServerInvalidUrl(t *testing.T) {
 	}
 }
 
+func TestNewServerWithoutHost(t *testing.T) {
+	for _, addr := range []string{"testhost:8000", "/path", "http://"} {
+		_, err := NewServer(addr)
+		if err != ErrInvalidAddress {
+			t.Error(addr, "expected", ErrInvalidAddress, "got", err)
+		}
+	}
+}
+
 func TestNew(t *testing.T) {
 	observed, _ := New(RoundRobin)
 	observedType := reflect.TypeOf(observed)
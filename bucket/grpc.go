@@ -0,0 +1,137 @@
+package bucket
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// gRPC status codes, which matter for balancing
+const (
+	GRPCOk          = 0
+	GRPCUnavailable = 14
+)
+
+var (
+	ErrGRPCUnavailable = errors.New("server responded with grpc-status UNAVAILABLE")
+)
+
+// IsGRPC - check if request is a gRPC call
+func IsGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// WriteError - respond with error, gRPC calls get trailers-only UNAVAILABLE response
+func WriteError(w http.ResponseWriter, r *http.Request, err error, status int) {
+	if !IsGRPC(r) {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(GRPCUnavailable))
+	w.Header().Set("Grpc-Message", grpcMessage(err.Error()))
+	w.WriteHeader(http.StatusOK)
+}
+
+// grpcMessage - percent-encode message as gRPC requires
+func grpcMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+			continue
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+// grpcStatus - status code from headers or trailers, false if there is none
+func grpcStatus(header http.Header) (int, bool) {
+	value := header.Get("Grpc-Status")
+	if value == "" {
+		return 0, false
+	}
+	status, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return status, true
+}
+
+// trackedBody - request body, which remembers if anything was read from it
+// Calls with consumed body can't be retried.
+type trackedBody struct {
+	io.ReadCloser
+	read int32
+}
+
+func (tb *trackedBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if n > 0 {
+		atomic.StoreInt32(&tb.read, 1)
+	}
+	return n, err
+}
+
+// replayable - check if request may be sent again
+func replayable(r *http.Request) bool {
+	body, ok := r.Body.(*trackedBody)
+	return r.Body == nil || r.Body == http.NoBody || (ok && atomic.LoadInt32(&body.read) == 0)
+}
+
+// trailersBody - response body, which reports gRPC status from trailers at EOF
+type trailersBody struct {
+	io.ReadCloser
+	response *http.Response
+	report   func(status int)
+	once     int32
+}
+
+func (tb *trailersBody) Read(p []byte) (int, error) {
+	n, err := tb.ReadCloser.Read(p)
+	if err == io.EOF && atomic.CompareAndSwapInt32(&tb.once, 0, 1) {
+		if status, ok := grpcStatus(tb.response.Trailer); ok {
+			tb.report(status)
+		}
+	}
+	return n, err
+}
+
+// getResponseModifier - gRPC status handling for server's reverse proxy
+// Trailers-only UNAVAILABLE responses are turned into errors, so the call is retried like a failed request,
+// if its body wasn't sent yet. Consecutive UNAVAILABLE statuses beyond maxRetries mark server unavailable.
+func (sb *RoundRobinServerBucket) getResponseModifier(srv Server) func(*http.Response) error {
+	var failures int64
+	report := func(status int) {
+		if status != GRPCUnavailable {
+			atomic.StoreInt64(&failures, 0)
+			return
+		}
+		if atomic.AddInt64(&failures, 1) > int64(sb.settings.maxRetries) {
+			atomic.StoreInt64(&failures, 0)
+			sb.Eject(srv, EjectGRPCUnavailable)
+			log.Printf("[outlier] %s marked unavailable after consecutive grpc UNAVAILABLE statuses\n", srv.Address())
+		}
+	}
+	return func(res *http.Response) error {
+		if !IsGRPC(res.Request) {
+			return nil
+		}
+		if status, ok := grpcStatus(res.Header); ok {
+			if status == GRPCUnavailable && replayable(res.Request) {
+				return ErrGRPCUnavailable
+			}
+			report(status)
+			return nil
+		}
+		res.Body = &trailersBody{ReadCloser: res.Body, response: res, report: report}
+		return nil
+	}
+}
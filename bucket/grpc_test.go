@@ -0,0 +1,167 @@
+package bucket
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcBackend - backend answering with name and grpc-status in trailers, or trailers-only
+func grpcBackend(name string, status string, trailersOnly bool) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		if trailersOnly {
+			w.Header().Set("Grpc-Status", status)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("X-Backend", name)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("message"))
+		w.Header().Set("Grpc-Status", status)
+	}), &http2.Server{}))
+}
+
+func grpcCall(bckt ServerBucket, body io.Reader) *http.Response {
+	req, _ := http.NewRequest(http.MethodPost, "/pkg.Service/Method", body)
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	rec := httptest.NewRecorder()
+	if err := bckt.Serve(rec, req); err != nil {
+		WriteError(rec, req, err, http.StatusServiceUnavailable)
+	}
+	return rec.Result()
+}
+
+func newGRPCBucket(backends ...*httptest.Server) ServerBucket {
+	bckt, _ := New(RoundRobin, WithMaxRetries(1), WithRetryDelay(time.Millisecond))
+	for _, backend := range backends {
+		srv, _ := NewServer(backend.URL, WithProtocol(H2C))
+		bckt.AddServer(srv)
+	}
+	return bckt
+}
+
+func TestWriteError(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "/", nil)
+	rec := httptest.NewRecorder()
+	WriteError(rec, req, ErrNoServersAvailable, http.StatusServiceUnavailable)
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "no servers available\n" {
+		t.Error("Expected", "plain 503", "got", rec.Code, rec.Body.String())
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	rec = httptest.NewRecorder()
+	WriteError(rec, req, ErrNoServersAvailable, http.StatusServiceUnavailable)
+	if rec.Code != http.StatusOK || rec.Header().Get("Grpc-Status") != "14" || rec.Header().Get("Grpc-Message") != "no servers available" {
+		t.Error("Expected", "grpc UNAVAILABLE", "got", rec.Code, rec.Header())
+	}
+	if observed := grpcMessage("50% off\n"); observed != "50%25 off%0A" {
+		t.Error("Expected", "50%25 off%0A", "got", observed)
+	}
+}
+
+func TestGRPCPerCallBalancing(t *testing.T) {
+	one, two := grpcBackend("one", "0", false), grpcBackend("two", "0", false)
+	defer one.Close()
+	defer two.Close()
+	bckt := newGRPCBucket(one, two)
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		res := grpcCall(bckt, strings.NewReader("request"))
+		seen[res.Header.Get("X-Backend")]++
+		if res.Trailer.Get("Grpc-Status") != "0" {
+			t.Error("Expected", "grpc-status 0", "got", res.Trailer)
+		}
+	}
+	if seen["one"] != 2 || seen["two"] != 2 {
+		t.Error("Expected", "calls spread over servers", "got", seen)
+	}
+}
+
+func TestGRPCUnavailableRetried(t *testing.T) {
+	failing, healthy := grpcBackend("failing", "14", true), grpcBackend("healthy", "0", false)
+	defer failing.Close()
+	defer healthy.Close()
+	bckt := newGRPCBucket(failing, healthy)
+	res := grpcCall(bckt, nil)
+	if res.Header.Get("X-Backend") != "healthy" {
+		t.Error("Expected", "call retried on healthy server", "got", res.Header)
+	}
+	if bckt.Servers()[0].IsAvailable() {
+		t.Error("Expected", "failing server unavailable", "got", "available")
+	}
+}
+
+func TestGRPCUnavailableNotReplayed(t *testing.T) {
+	failing := grpcBackend("failing", "14", true)
+	defer failing.Close()
+	bckt := newGRPCBucket(failing)
+	res := grpcCall(bckt, strings.NewReader("request"))
+	if res.Header.Get("Grpc-Status") != "14" {
+		t.Error("Expected", "backend status passed through", "got", res.Header)
+	}
+	if !bckt.Servers()[0].IsAvailable() {
+		t.Error("Expected", "available after the first failure", "got", "unavailable")
+	}
+	grpcCall(bckt, strings.NewReader("request"))
+	if bckt.Servers()[0].IsAvailable() {
+		t.Error("Expected", "unavailable after consecutive failures", "got", "available")
+	}
+}
+
+func TestGRPCConsumedCallNotRetried(t *testing.T) {
+	calls := 0
+	failingOnce := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		calls++
+		if calls == 1 {
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "0")
+		w.WriteHeader(http.StatusOK)
+	}), &http2.Server{}))
+	defer failingOnce.Close()
+	healthy := grpcBackend("healthy", "0", false)
+	defer healthy.Close()
+	bckt := newGRPCBucket(failingOnce, healthy)
+	res := grpcCall(bckt, strings.NewReader("request"))
+	if res.Header.Get("Grpc-Status") != "14" || res.Header.Get("X-Backend") != "" {
+		t.Error("Expected", "grpc UNAVAILABLE without retry", "got", res.Header)
+	}
+	if calls != 1 {
+		t.Error("Expected", 1, "got", calls)
+	}
+	for _, srv := range bckt.Servers() {
+		if !srv.IsAvailable() {
+			t.Error("Expected", "servers not ejected", "got", srv.Address(), "unavailable")
+		}
+	}
+}
+
+func TestGRPCTrailersOutlier(t *testing.T) {
+	failing := grpcBackend("failing", "14", false)
+	defer failing.Close()
+	bckt := newGRPCBucket(failing)
+	for i := 0; i < 2; i++ {
+		res := grpcCall(bckt, strings.NewReader("request"))
+		if res.Trailer.Get("Grpc-Status") != "14" {
+			t.Error("Expected", "status in trailers", "got", res.Trailer)
+		}
+	}
+	if bckt.Servers()[0].IsAvailable() {
+		t.Error("Expected", "unavailable after consecutive failures", "got", "available")
+	}
+	res := grpcCall(bckt, nil)
+	if res.Header.Get("Grpc-Status") != "14" || res.Header.Get("Grpc-Message") != "all servers unreachable" {
+		t.Error("Expected", "grpc UNAVAILABLE from balancer", "got", res.Header)
+	}
+}
@@ -0,0 +1,129 @@
+package bucket
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var (
+	ErrNoH2 = errors.New("server didn't negotiate h2")
+)
+
+// h2ConnPool - HTTP/2 connections to server, dialed with context of request that needed them
+// Stock pool of http2.Transport dials without context, so cancelled requests wait for slow servers
+// and PROXY protocol header misses the client.
+type h2ConnPool struct {
+	sync.Mutex
+	transport *http2.Transport
+	dial      func(ctx context.Context, addr string) (net.Conn, error)
+	conns     map[string][]*http2.ClientConn
+}
+
+// newH2Transport - HTTP/2 transport dialing through pool
+func newH2Transport(dial func(ctx context.Context, addr string) (net.Conn, error)) *http2.Transport {
+	transport := &http2.Transport{AllowHTTP: true}
+	transport.ConnPool = &h2ConnPool{
+		transport: transport,
+		dial:      dial,
+		conns:     map[string][]*http2.ClientConn{},
+	}
+	return transport
+}
+
+// GetClientConn - connection able to take request, new one dialed if none
+func (p *h2ConnPool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	p.Lock()
+	for _, cc := range p.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			p.Unlock()
+			return cc, nil
+		}
+	}
+	p.Unlock()
+	conn, err := p.dial(req.Context(), addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.Lock()
+	p.conns[addr] = append(p.conns[addr], cc)
+	p.Unlock()
+	return cc, nil
+}
+
+// MarkDead - forget broken or closed connection
+func (p *h2ConnPool) MarkDead(dead *http2.ClientConn) {
+	p.Lock()
+	defer p.Unlock()
+	for addr, conns := range p.conns {
+		for i, cc := range conns {
+			if cc != dead {
+				continue
+			}
+			conns = append(conns[:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(p.conns, addr)
+			} else {
+				p.conns[addr] = conns
+			}
+			return
+		}
+	}
+}
+
+// dialH2C - cleartext connection to h2c server
+func (ds *DefaultServer) dialH2C(ctx context.Context, addr string) (net.Conn, error) {
+	return ds.transport.DialContext(ctx, "tcp", addr)
+}
+
+// dialH2 - TLS connection to https server, negotiated for HTTP/2
+// Handshake gives up on transport's handshake timeout or when request is cancelled.
+func (ds *DefaultServer) dialH2(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := ds.transport.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if ds.tlsConfig != nil {
+		cfg = ds.tlsConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	tlsConn := tls.Client(conn, cfg)
+	if timeout := ds.transport.TLSHandshakeTimeout; timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- tlsConn.Handshake()
+	}()
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		conn.Close()
+		<-errc
+		return nil, ctx.Err()
+	}
+	if err == nil && tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		err = ErrNoH2
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,154 @@
+package bucket
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthCheckWorkers = 10
+	healthCheckRescanPeriod   = time.Second // how soon servers added to bucket get scheduled
+)
+
+// Healthcheck - check availability of all servers at once, with limited concurrency
+func (sb *RoundRobinServerBucket) Healthcheck() {
+	servers := sb.Servers()
+	if len(servers) < 1 {
+		log.Printf("[healthcheck] %s \n", ErrNoServersAvailable.Error())
+		return
+	}
+	workers := make(chan struct{}, sb.healthCheckWorkers())
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(srv Server) {
+			defer wg.Done()
+			sb.check(srv)
+			<-workers
+		}(srv)
+	}
+	wg.Wait()
+}
+
+// check - ping server and update its availability, administrative state is never changed
+func (sb *RoundRobinServerBucket) check(srv Server) {
+	started := time.Now()
+	status := srv.PingServer()
+	m := sb.metrics(srv)
+	m.checked(status, time.Since(started))
+	if !status && srv.IsAvailable() {
+		m.ejected(EjectHealthCheck)
+	}
+	srv.SetAvailable(status)
+	m.setAvailable(status)
+	msg := "available"
+	if !status {
+		msg = "unreachable"
+	}
+	log.Printf("[healthcheck] %s (%s)\n", srv.Address(), msg)
+}
+
+// runHealthChecks - check every server once a period, shifted by jitter, until ctx is done or bucket is stopped
+// Servers are checked at once on start, servers added later - within jitter after they are noticed.
+// Limited number of checks run concurrently, the next check of a server waits for the previous one.
+func (sb *RoundRobinServerBucket) runHealthChecks(ctx context.Context, done chan struct{}) {
+	defer sb.services.Done()
+	period := sb.settings.healthCheckPeriod
+	if period <= 0 {
+		return
+	}
+	rescan := period
+	if rescan > healthCheckRescanPeriod {
+		rescan = healthCheckRescanPeriod
+	}
+	workers := make(chan struct{}, sb.healthCheckWorkers())
+	finished := make(chan Server)
+	scheduled := map[Server]time.Time{}
+	running := map[Server]bool{}
+	wakeup := time.After(0)
+	for first := true; ; first = false {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case srv := <-finished:
+			delete(running, srv)
+		case <-wakeup:
+		}
+		now := time.Now()
+		wake := now.Add(rescan)
+		current := map[Server]bool{}
+		for _, srv := range sb.Servers() {
+			current[srv] = true
+			at, ok := scheduled[srv]
+			if !ok && !first {
+				at = now.Add(sb.spread())
+			}
+			if !at.After(now) && !running[srv] {
+				at = now.Add(period + sb.jitter())
+				sb.services.Add(1)
+				go func(srv Server) {
+					defer sb.services.Done()
+					select {
+					case workers <- struct{}{}:
+					case <-done:
+						return
+					case <-ctx.Done():
+						return
+					}
+					sb.check(srv)
+					<-workers
+					select {
+					case finished <- srv:
+					case <-done:
+					case <-ctx.Done():
+					}
+				}(srv)
+				scheduled[srv] = at
+				running[srv] = true
+				continue
+			}
+			scheduled[srv] = at
+			if !running[srv] && at.Before(wake) { // running ones are rescheduled when finished
+				wake = at
+			}
+		}
+		for srv := range scheduled {
+			if !current[srv] {
+				delete(scheduled, srv)
+			}
+		}
+		wakeup = time.After(time.Until(wake))
+	}
+}
+
+// healthCheckWorkers - limit of concurrent availability checks
+func (sb *RoundRobinServerBucket) healthCheckWorkers() int {
+	if sb.settings.healthCheckWorkers > 0 {
+		return sb.settings.healthCheckWorkers
+	}
+	return defaultHealthCheckWorkers
+}
+
+// jitter - random shift of the next check, up to configured jitter either way
+func (sb *RoundRobinServerBucket) jitter() time.Duration {
+	jitter := sb.settings.healthCheckJitter
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(2*jitter))) - jitter
+}
+
+// spread - random delay of the first check of a new server, up to configured jitter
+func (sb *RoundRobinServerBucket) spread() time.Duration {
+	jitter := sb.settings.healthCheckJitter
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
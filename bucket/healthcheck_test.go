@@ -0,0 +1,111 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowServer - server, which pings for a while, counting concurrent pings
+type slowServer struct {
+	*MockServer
+	delay   time.Duration
+	running *int64
+	peak    *int64
+	lock    sync.Mutex
+}
+
+func (ss *slowServer) PingServer() bool {
+	now := atomic.AddInt64(ss.running, 1)
+	for peak := atomic.LoadInt64(ss.peak); now > peak; peak = atomic.LoadInt64(ss.peak) {
+		if atomic.CompareAndSwapInt64(ss.peak, peak, now) {
+			break
+		}
+	}
+	time.Sleep(ss.delay)
+	atomic.AddInt64(ss.running, -1)
+	return true
+}
+
+func (ss *slowServer) SetAvailable(status bool) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	ss.MockServer.SetAvailable(status)
+}
+
+func (ss *slowServer) IsAvailable() bool {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	return ss.MockServer.IsAvailable()
+}
+
+func TestHealthcheckConcurrency(t *testing.T) {
+	bckt, _ := New(RoundRobin, WithHealthCheckWorkers(3))
+	var running, peak int64
+	servers := []Server{}
+	for i := 0; i < 9; i++ {
+		addr, _ := url.Parse(fmt.Sprintf("http://testhost%d:8000", i))
+		servers = append(servers, &slowServer{
+			MockServer: &MockServer{address: addr},
+			delay:      50 * time.Millisecond,
+			running:    &running,
+			peak:       &peak,
+		})
+	}
+	bckt.(*RoundRobinServerBucket).servers.Store(servers)
+	started := time.Now()
+	bckt.Healthcheck()
+	if elapsed := time.Since(started); elapsed > 400*time.Millisecond {
+		t.Error("Expected", "concurrent checks", "got", elapsed)
+	}
+	if peak != 3 {
+		t.Error("Expected", 3, "got", peak)
+	}
+	for _, srv := range bckt.Servers() {
+		if !srv.IsAvailable() {
+			t.Error("Expected", "available", "got", srv.Address())
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	bckt, _ := New(RoundRobin, WithHealthCheckJitter(10*time.Millisecond))
+	rr := bckt.(*RoundRobinServerBucket)
+	for i := 0; i < 1000; i++ {
+		if jitter := rr.jitter(); jitter < -10*time.Millisecond || jitter >= 10*time.Millisecond {
+			t.Fatal("Expected", "jitter within 10ms either way", "got", jitter)
+		}
+		if spread := rr.spread(); spread < 0 || spread >= 10*time.Millisecond {
+			t.Fatal("Expected", "spread within 10ms", "got", spread)
+		}
+	}
+	rr.settings.healthCheckJitter = 0
+	if rr.jitter() != 0 || rr.spread() != 0 {
+		t.Error("Expected", 0, "got", rr.jitter(), rr.spread())
+	}
+}
+
+func TestRunHealthChecksNewServer(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	bckt, _ := New(RoundRobin, WithHealthCheckPeriod(time.Hour), WithHealthCheckJitter(10*time.Millisecond))
+	bckt.RunServices(context.Background(), time.Minute)
+	defer bckt.Stop()
+	srv, _ := NewServer(backend.URL)
+	bckt.AddServer(srv)
+	srv.SetAvailable(false)
+	checked := false
+	for i := 0; i < 300 && !checked; i++ {
+		time.Sleep(10 * time.Millisecond)
+		checked = srv.IsAvailable()
+	}
+	if !checked {
+		t.Error("Expected", "new server checked", "got", "unavailable")
+	}
+}
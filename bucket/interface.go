@@ -1,6 +1,8 @@
 package bucket
 
 import (
+	"context"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -9,7 +11,29 @@ import (
 
 // Available loadbalancing algorithms
 const (
-	RoundRobin = "round-robin"
+	RoundRobin       = "round-robin"
+	LeastConnections = "least-connections"
+)
+
+// Available protocols toward servers
+const (
+	HTTP1 = "http1" // HTTP/1.1 only
+	H2    = "h2"    // HTTP/2 over TLS
+	H2C   = "h2c"   // HTTP/2 over cleartext, prior knowledge
+)
+
+// Schemes of servers besides http and https
+const (
+	TCP  = "tcp"  // raw connections
+	UDP  = "udp"  // datagrams
+	Unix = "unix" // HTTP over Unix socket, like unix:///run/app.sock
+)
+
+// Administrative states of servers, kept apart from availability set by health checks
+const (
+	StateActive   = "active"   // gets new requests while available
+	StateDraining = "draining" // no new requests, sticky flows and in-flight requests finish
+	StateDisabled = "disabled" // no new requests and no sticky flows
 )
 
 // Server - common backend server interface
@@ -20,17 +44,34 @@ type Server interface {
 	IsAvailable() bool
 	SetAvailable(bool)
 
+	State() string
+	SetState(string) error
+	Drained() bool
+
 	LastSeen() int64
 
+	InFlight() int64
+	AddInFlight(int64)
+
 	PingServer() bool
+	Dial(context.Context) (net.Conn, error)
 }
 
 // ServerBucket - common servers pool interface
 type ServerBucket interface {
 	AddServer(Server) error
+	RemoveServer(string) error
+	Servers() []Server
 	Size() int
+	InFlight() int64
 	Serve(http.ResponseWriter, *http.Request) error
+	ServeConn(net.Conn) error
+	Next() (Server, error)
 	Healthcheck()
 	RemoveStale(time.Duration)
-	RunServices(int)
+	RunServices(context.Context, time.Duration)
+	Stop()
+	CloseUpgraded(...Server)
+	CountDatagram(Server, string, int)
+	Eject(Server, string)
 }
@@ -0,0 +1,337 @@
+package bucket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Ejection reasons, servers are marked unavailable until the next successful check
+const (
+	EjectProxyError      = "proxy_error"
+	EjectConnectError    = "connect_error"
+	EjectGRPCUnavailable = "grpc_unavailable"
+	EjectHealthCheck     = "health_check"
+)
+
+// Status classes of served requests, error - no response from server
+var statusClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx", "error"}
+
+var ejectReasons = []string{EjectProxyError, EjectConnectError, EjectGRPCUnavailable, EjectHealthCheck}
+
+// Series are labeled by pool and server only, removed servers' series are deleted,
+// so the number of series follows the number of configured and discovered servers.
+var (
+	serverRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_server_requests_total",
+		Help: "The total requests proxied to server by status class, error - server failed request, it was retried elsewhere or refused",
+	}, []string{"pool", "server", "code"})
+	serverRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_server_request_duration_seconds",
+		Help:    "The time server took to serve request, upgraded connections excluded",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"pool", "server"})
+	serverInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_server_requests_in_flight",
+		Help: "The number of requests being served by server right now",
+	}, []string{"pool", "server"})
+	serverBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_server_bytes_total",
+		Help: "The total bytes of requests bodies and responses, in - from clients, out - to clients",
+	}, []string{"pool", "server", "direction"})
+	serverRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_server_retries_total",
+		Help: "The total retries of requests with the same server after proxy errors",
+	}, []string{"pool", "server"})
+	serverAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_server_attempts_total",
+		Help: "The total requests passed to another server after server failed them",
+	}, []string{"pool", "server"})
+	serverAvailable = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_server_available",
+		Help: "Whether server is available, 1 - available, 0 - unreachable",
+	}, []string{"pool", "server"})
+	serverEjections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_server_ejections_total",
+		Help: "The total times available server was marked unavailable, by reason",
+	}, []string{"pool", "server", "reason"})
+	healthChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_health_checks_total",
+		Help: "The total server availability checks by result, success or failure",
+	}, []string{"pool", "server", "result"})
+	healthCheckDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_health_check_duration_seconds",
+		Help:    "The duration of server availability checks",
+		Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 2, 5, 10},
+	}, []string{"pool", "server"})
+)
+
+// StatusClass - label of response status, like 2xx, error for anything, that isn't a status
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "error"
+	}
+	return statusClasses[status/100-1]
+}
+
+// serverMetrics - server's series in bucket, resolved once when server is added
+// Removed servers get nil metrics, all methods do nothing then, so their series aren't recreated
+// by in-flight requests and running checks.
+type serverMetrics struct {
+	requests      map[string]prometheus.Counter // by status class
+	duration      prometheus.Observer
+	inFlight      prometheus.Gauge
+	bytesIn       prometheus.Counter
+	bytesOut      prometheus.Counter
+	retries       prometheus.Counter
+	attempts      prometheus.Counter
+	available     prometheus.Gauge
+	ejections     map[string]prometheus.Counter // by reason
+	checks        map[bool]prometheus.Counter   // by result
+	checkDuration prometheus.Observer
+	upgraded      *upgradeMetrics // http servers only
+	tcp           *tcpMetrics     // tcp servers only
+	udp           *udpMetrics     // udp servers only
+}
+
+func newServerMetrics(pool string, address *url.URL) *serverMetrics {
+	server := address.String()
+	m := &serverMetrics{
+		requests:      map[string]prometheus.Counter{},
+		duration:      serverRequestDuration.WithLabelValues(pool, server),
+		inFlight:      serverInFlight.WithLabelValues(pool, server),
+		bytesIn:       serverBytes.WithLabelValues(pool, server, "in"),
+		bytesOut:      serverBytes.WithLabelValues(pool, server, "out"),
+		retries:       serverRetries.WithLabelValues(pool, server),
+		attempts:      serverAttempts.WithLabelValues(pool, server),
+		available:     serverAvailable.WithLabelValues(pool, server),
+		ejections:     map[string]prometheus.Counter{},
+		checks:        map[bool]prometheus.Counter{},
+		checkDuration: healthCheckDuration.WithLabelValues(pool, server),
+	}
+	for _, class := range statusClasses {
+		m.requests[class] = serverRequests.WithLabelValues(pool, server, class)
+	}
+	for _, reason := range ejectReasons {
+		m.ejections[reason] = serverEjections.WithLabelValues(pool, server, reason)
+	}
+	m.checks[true] = healthChecks.WithLabelValues(pool, server, "success")
+	m.checks[false] = healthChecks.WithLabelValues(pool, server, "failure")
+	switch address.Scheme {
+	case TCP:
+		m.tcp = newTCPMetrics(pool, server)
+	case UDP:
+		m.udp = newUDPMetrics(pool, server)
+	default:
+		m.upgraded = newUpgradeMetrics(pool, server)
+	}
+	return m
+}
+
+// deleteServerMetrics - remove all series of server in pool
+func deleteServerMetrics(pool, server string) {
+	for _, class := range statusClasses {
+		serverRequests.DeleteLabelValues(pool, server, class)
+	}
+	for _, reason := range ejectReasons {
+		serverEjections.DeleteLabelValues(pool, server, reason)
+	}
+	serverRequestDuration.DeleteLabelValues(pool, server)
+	serverInFlight.DeleteLabelValues(pool, server)
+	serverBytes.DeleteLabelValues(pool, server, "in")
+	serverBytes.DeleteLabelValues(pool, server, "out")
+	serverRetries.DeleteLabelValues(pool, server)
+	serverAttempts.DeleteLabelValues(pool, server)
+	serverAvailable.DeleteLabelValues(pool, server)
+	healthChecks.DeleteLabelValues(pool, server, "success")
+	healthChecks.DeleteLabelValues(pool, server, "failure")
+	healthCheckDuration.DeleteLabelValues(pool, server)
+	deleteUpgradeMetrics(pool, server)
+	deleteTCPMetrics(pool, server)
+	deleteUDPMetrics(pool, server)
+}
+
+// DeleteMetrics - remove series of pool's servers, like ones dropped from configuration on reload
+func DeleteMetrics(pool string, servers ...string) {
+	for _, server := range servers {
+		deleteServerMetrics(pool, server)
+	}
+}
+
+// served - count request served by server, failed ones have no response of their own
+func (m *serverMetrics) served(mw *metricsWriter, in int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	if mw.failed {
+		m.requests["error"].Inc()
+		return
+	}
+	m.requests[StatusClass(mw.status)].Inc()
+	m.bytesIn.Add(float64(in))
+	m.bytesOut.Add(float64(mw.size))
+	if mw.status != http.StatusSwitchingProtocols {
+		m.duration.Observe(duration.Seconds())
+	}
+}
+
+func (m *serverMetrics) addInFlight(delta float64) {
+	if m != nil {
+		m.inFlight.Add(delta)
+	}
+}
+
+func (m *serverMetrics) retried() {
+	if m != nil {
+		m.retries.Inc()
+	}
+}
+
+func (m *serverMetrics) attempted() {
+	if m != nil {
+		m.attempts.Inc()
+	}
+}
+
+func (m *serverMetrics) setAvailable(status bool) {
+	if m == nil {
+		return
+	}
+	if status {
+		m.available.Set(1)
+		return
+	}
+	m.available.Set(0)
+}
+
+func (m *serverMetrics) ejected(reason string) {
+	if m != nil {
+		m.ejections[reason].Inc()
+	}
+}
+
+func (m *serverMetrics) checked(status bool, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.checks[status].Inc()
+	m.checkDuration.Observe(duration.Seconds())
+}
+
+func (m *serverMetrics) upgrades() *upgradeMetrics {
+	if m == nil {
+		return nil
+	}
+	return m.upgraded
+}
+
+func (m *serverMetrics) conns() *tcpMetrics {
+	if m == nil {
+		return nil
+	}
+	return m.tcp
+}
+
+func (m *serverMetrics) datagrams() *udpMetrics {
+	if m == nil {
+		return nil
+	}
+	return m.udp
+}
+
+// metrics - server's series in bucket, nil for servers, which aren't in bucket
+func (sb *RoundRobinServerBucket) metrics(srv Server) *serverMetrics {
+	if m, ok := sb.series.Load(srv); ok {
+		return m.(*serverMetrics)
+	}
+	return nil
+}
+
+// Eject - mark server unavailable until the next successful check, counting the change
+func (sb *RoundRobinServerBucket) Eject(srv Server, reason string) {
+	m := sb.metrics(srv)
+	if srv.IsAvailable() {
+		m.ejected(reason)
+	}
+	srv.SetAvailable(false)
+	m.setAvailable(false)
+}
+
+// metricsWriter - response writer, remembering status and size of response for server's metrics
+// Keeps flushing and hijacking available for streaming and upgraded connections
+type metricsWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+	failed bool // server failed request, it was retried with another one or refused
+}
+
+func (mw *metricsWriter) WriteHeader(status int) {
+	if mw.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		mw.status = status
+	}
+	mw.ResponseWriter.WriteHeader(status)
+}
+
+func (mw *metricsWriter) Write(data []byte) (int, error) {
+	if mw.status == 0 {
+		mw.status = http.StatusOK
+	}
+	n, err := mw.ResponseWriter.Write(data)
+	mw.size += int64(n)
+	return n, err
+}
+
+// Flush - flush buffered data to client if supported
+func (mw *metricsWriter) Flush() {
+	if flusher, ok := mw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack - take over client connection, used by protocol upgrades
+func (mw *metricsWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := mw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	if mw.status == 0 {
+		mw.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+// markFailed - count request as failed by server, if it is served with metrics
+func markFailed(w http.ResponseWriter) {
+	if mw, ok := w.(*metricsWriter); ok {
+		mw.failed = true
+	}
+}
+
+// countedBody - request body, which counts bytes read from it by all servers trying the request
+type countedBody struct {
+	io.ReadCloser
+	read int64
+}
+
+func (cb *countedBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	atomic.AddInt64(&cb.read, int64(n))
+	return n, err
+}
+
+// count - bytes read so far, zero for requests without body
+func (cb *countedBody) count() int64 {
+	if cb == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&cb.read)
+}
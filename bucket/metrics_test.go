@@ -0,0 +1,168 @@
+package bucket
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStatusClass(t *testing.T) {
+	expected := map[int]string{0: "error", 101: "1xx", 200: "2xx", 304: "3xx", 404: "4xx", 503: "5xx", 600: "error"}
+	for status, class := range expected {
+		if observed := StatusClass(status); observed != class {
+			t.Error("Expected", class, "got", observed)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer backend.Close()
+	bckt, _ := New(RoundRobin, WithName("metrics-serve"))
+	srv, _ := NewServer(backend.URL)
+	bckt.AddServer(srv)
+	rec := httptest.NewRecorder()
+	bckt.Serve(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello")))
+	if rec.Body.String() != "hello" {
+		t.Fatal("Expected", "hello", "got", rec.Body.String())
+	}
+	addr := srv.Address().String()
+	observed := map[string]float64{
+		"2xx":       testutil.ToFloat64(serverRequests.WithLabelValues("metrics-serve", addr, "2xx")),
+		"in":        testutil.ToFloat64(serverBytes.WithLabelValues("metrics-serve", addr, "in")),
+		"out":       testutil.ToFloat64(serverBytes.WithLabelValues("metrics-serve", addr, "out")),
+		"in flight": testutil.ToFloat64(serverInFlight.WithLabelValues("metrics-serve", addr)),
+		"available": testutil.ToFloat64(serverAvailable.WithLabelValues("metrics-serve", addr)),
+	}
+	for name, value := range map[string]float64{"2xx": 1, "in": 5, "out": 5, "in flight": 0, "available": 1} {
+		if observed[name] != value {
+			t.Error("Expected", name, value, "got", observed[name])
+		}
+	}
+}
+
+func TestFailoverMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	bckt, _ := New(RoundRobin, WithName("metrics-failover"), WithMaxRetries(1), WithRetryDelay(0))
+	failing, _ := NewServer(closed.URL)
+	working, _ := NewServer(backend.URL)
+	bckt.AddServer(failing)
+	bckt.AddServer(working)
+	failing.SetAvailable(true)
+	rec := httptest.NewRecorder()
+	bckt.Serve(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatal("Expected", http.StatusOK, "got", rec.Code)
+	}
+	failed, served := failing.Address().String(), working.Address().String()
+	observed := map[string]float64{
+		"error":     testutil.ToFloat64(serverRequests.WithLabelValues("metrics-failover", failed, "error")),
+		"retries":   testutil.ToFloat64(serverRetries.WithLabelValues("metrics-failover", failed)),
+		"attempts":  testutil.ToFloat64(serverAttempts.WithLabelValues("metrics-failover", failed)),
+		"ejections": testutil.ToFloat64(serverEjections.WithLabelValues("metrics-failover", failed, EjectProxyError)),
+		"available": testutil.ToFloat64(serverAvailable.WithLabelValues("metrics-failover", failed)),
+		"2xx":       testutil.ToFloat64(serverRequests.WithLabelValues("metrics-failover", served, "2xx")),
+	}
+	for name, value := range map[string]float64{"error": 1, "retries": 1, "attempts": 1, "ejections": 1, "available": 0, "2xx": 1} {
+		if observed[name] != value {
+			t.Error("Expected", name, value, "got", observed[name])
+		}
+	}
+}
+
+func TestHealthcheckMetrics(t *testing.T) {
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	bckt, _ := New(RoundRobin, WithName("metrics-healthcheck"))
+	srv, _ := NewServer(closed.URL)
+	bckt.AddServer(srv)
+	srv.SetAvailable(true)
+	bckt.Healthcheck()
+	addr := srv.Address().String()
+	if observed := testutil.ToFloat64(healthChecks.WithLabelValues("metrics-healthcheck", addr, "failure")); observed != 1 {
+		t.Error("Expected", 1, "got", observed)
+	}
+	if observed := testutil.ToFloat64(serverEjections.WithLabelValues("metrics-healthcheck", addr, EjectHealthCheck)); observed != 1 {
+		t.Error("Expected", 1, "got", observed)
+	}
+	bckt.Healthcheck()
+	if observed := testutil.ToFloat64(serverEjections.WithLabelValues("metrics-healthcheck", addr, EjectHealthCheck)); observed != 1 {
+		t.Error("Expected", "unreachable server not ejected again", "got", observed)
+	}
+}
+
+func TestRemoveServerDeletesMetrics(t *testing.T) {
+	bckt, _ := New(RoundRobin, WithName("metrics-remove"))
+	srv, _ := NewServer("http://127.0.0.1:1")
+	bckt.AddServer(srv)
+	addr := srv.Address().String()
+	bckt.RemoveServer(addr)
+	if serverAvailable.DeleteLabelValues("metrics-remove", addr) {
+		t.Error("Expected", "removed server's series deleted", "got", "series present")
+	}
+	rr := bckt.(*RoundRobinServerBucket)
+	if rr.metrics(srv) != nil {
+		t.Error("Expected", nil, "got", rr.metrics(srv))
+	}
+	rr.Eject(srv, EjectProxyError)
+	if serverEjections.DeleteLabelValues("metrics-remove", addr, EjectProxyError) {
+		t.Error("Expected", "no series for removed server", "got", "series recreated")
+	}
+}
+
+func TestTCPMetrics(t *testing.T) {
+	bckt, _ := New(RoundRobin, WithName("metrics-tcp"), WithMaxAttempts(1))
+	srv, _ := NewServer("tcp://127.0.0.1:1")
+	bckt.AddServer(srv)
+	srv.SetAvailable(true)
+	client, conn := net.Pipe()
+	defer client.Close()
+	bckt.ServeConn(conn)
+	addr := srv.Address().String()
+	if observed := testutil.ToFloat64(tcpConnectFailures.WithLabelValues("metrics-tcp", addr)); observed != 1 {
+		t.Error("Expected", 1, "got", observed)
+	}
+	rr := bckt.(*RoundRobinServerBucket)
+	if rr.metrics(srv).upgrades() != nil {
+		t.Error("Expected", "no upgraded connections series", "got", rr.metrics(srv).upgrades())
+	}
+	bckt.RemoveServer(addr)
+	if tcpConnectFailures.DeleteLabelValues("metrics-tcp", addr) {
+		t.Error("Expected", "removed server's series deleted", "got", "series present")
+	}
+}
+
+func TestUDPMetrics(t *testing.T) {
+	bckt, _ := New(RoundRobin, WithName("metrics-udp"))
+	srv, _ := NewServer("udp://127.0.0.1:1")
+	bckt.AddServer(srv)
+	bckt.CountDatagram(srv, DatagramIn, 5)
+	bckt.CountDatagram(srv, DatagramOut, 3)
+	addr := srv.Address().String()
+	observed := map[string]float64{
+		"packets in": testutil.ToFloat64(udpPackets.WithLabelValues("metrics-udp", addr, DatagramIn)),
+		"bytes in":   testutil.ToFloat64(udpBytes.WithLabelValues("metrics-udp", addr, DatagramIn)),
+		"bytes out":  testutil.ToFloat64(udpBytes.WithLabelValues("metrics-udp", addr, DatagramOut)),
+	}
+	for name, value := range map[string]float64{"packets in": 1, "bytes in": 5, "bytes out": 3} {
+		if observed[name] != value {
+			t.Error("Expected", name, value, "got", observed[name])
+		}
+	}
+	bckt.RemoveServer(addr)
+	bckt.CountDatagram(srv, DatagramIn, 5)
+	if udpPackets.DeleteLabelValues("metrics-udp", addr, DatagramIn) {
+		t.Error("Expected", "no series for removed server", "got", "series recreated")
+	}
+}
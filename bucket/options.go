@@ -0,0 +1,181 @@
+package bucket
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/freundallein/loadbalancer/proxyproto"
+)
+
+const (
+	defaultHealthCheckPeriod = 5 * time.Second
+	defaultRemoveStalePeriod = 60 * time.Second
+	defaultMaxRetries        = 3
+	defaultMaxAttempts       = 3
+	defaultRetryDelay        = 10 * time.Millisecond
+	defaultPingTimeout       = 2 * time.Second
+)
+
+// settings - servers pool tunables
+type settings struct {
+	healthCheckPeriod time.Duration // period between availability checks
+	removeStalePeriod time.Duration // period between stale servers removals
+	maxRetries        int           // retries of the same server per request
+	maxAttempts       int           // servers to try per request
+	retryDelay        time.Duration // pause before retrying the same server
+
+	healthCheckJitter  time.Duration // random shift of every server's next check, up to jitter either way
+	healthCheckWorkers int           // concurrent availability checks, defaultHealthCheckWorkers if zero
+
+	upgradedIdleTimeout time.Duration // close idle upgraded connections, never if zero
+	closeUpgraded       bool          // close upgraded connections of removed servers
+
+	connectTimeout time.Duration // raw connections dial timeout, dialer's own if zero
+	tcpIdleTimeout time.Duration // close idle raw connections, never if zero
+
+	name string // pool name, metrics label
+}
+
+func defaultSettings() settings {
+	return settings{
+		healthCheckPeriod: defaultHealthCheckPeriod,
+		removeStalePeriod: defaultRemoveStalePeriod,
+		maxRetries:        defaultMaxRetries,
+		maxAttempts:       defaultMaxAttempts,
+		retryDelay:        defaultRetryDelay,
+	}
+}
+
+// Option - servers pool setting
+type Option func(*settings)
+
+// WithName - set pool name, servers' metrics are labeled with it
+func WithName(name string) Option {
+	return func(s *settings) {
+		s.name = name
+	}
+}
+
+// WithHealthCheckPeriod - set period between availability checks
+func WithHealthCheckPeriod(period time.Duration) Option {
+	return func(s *settings) {
+		s.healthCheckPeriod = period
+	}
+}
+
+// WithHealthCheckJitter - shift every server's next check randomly, up to jitter either way
+// Spreads checks of servers added at once over the period.
+func WithHealthCheckJitter(jitter time.Duration) Option {
+	return func(s *settings) {
+		s.healthCheckJitter = jitter
+	}
+}
+
+// WithHealthCheckWorkers - limit concurrent availability checks
+func WithHealthCheckWorkers(workers int) Option {
+	return func(s *settings) {
+		s.healthCheckWorkers = workers
+	}
+}
+
+// WithRemoveStalePeriod - set period between stale servers removals
+func WithRemoveStalePeriod(period time.Duration) Option {
+	return func(s *settings) {
+		s.removeStalePeriod = period
+	}
+}
+
+// WithMaxRetries - set how many times the same server is retried per request
+func WithMaxRetries(retries int) Option {
+	return func(s *settings) {
+		s.maxRetries = retries
+	}
+}
+
+// WithMaxAttempts - set how many servers are tried per request
+func WithMaxAttempts(attempts int) Option {
+	return func(s *settings) {
+		s.maxAttempts = attempts
+	}
+}
+
+// WithRetryDelay - set pause before retrying the same server
+func WithRetryDelay(delay time.Duration) Option {
+	return func(s *settings) {
+		s.retryDelay = delay
+	}
+}
+
+// WithUpgradedIdleTimeout - close upgraded (WebSocket) connections without traffic for timeout
+func WithUpgradedIdleTimeout(timeout time.Duration) Option {
+	return func(s *settings) {
+		s.upgradedIdleTimeout = timeout
+	}
+}
+
+// WithCloseUpgraded - close upgraded connections of servers removed from bucket
+func WithCloseUpgraded(close bool) Option {
+	return func(s *settings) {
+		s.closeUpgraded = close
+	}
+}
+
+// WithConnectTimeout - limit dialing a server for raw connection, next server is tried on failure
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(s *settings) {
+		s.connectTimeout = timeout
+	}
+}
+
+// WithTCPIdleTimeout - close raw connections without traffic for timeout
+func WithTCPIdleTimeout(timeout time.Duration) Option {
+	return func(s *settings) {
+		s.tcpIdleTimeout = timeout
+	}
+}
+
+// ServerOption - backend server setting
+type ServerOption func(*DefaultServer)
+
+// WithPingTimeout - set dial timeout for server availability checks
+func WithPingTimeout(timeout time.Duration) ServerOption {
+	return func(ds *DefaultServer) {
+		ds.pingTimeout = timeout
+	}
+}
+
+// WithAvailable - set server's availability until its first health check
+func WithAvailable(status bool) ServerOption {
+	return func(ds *DefaultServer) {
+		ds.SetAvailable(status)
+	}
+}
+
+// WithProxyProtocol - send PROXY protocol header of given version (1 or 2) to server
+// Client connections are not shared, so keep-alive connections to server are disabled.
+func WithProxyProtocol(version int) ServerOption {
+	return func(ds *DefaultServer) {
+		dial, err := proxyproto.Dialer(version, ds.transport.DialContext)
+		if err != nil {
+			return
+		}
+		ds.transport.DialContext = dial
+		ds.transport.DisableKeepAlives = true
+	}
+}
+
+// WithProtocol - set protocol toward server: http1, h2 or h2c
+// HTTP/2 connections are shared by clients, so it can't be combined with PROXY protocol
+func WithProtocol(protocol string) ServerOption {
+	return func(ds *DefaultServer) {
+		ds.protocol = protocol
+	}
+}
+
+// WithTLS - set TLS settings toward https server, used by health checks as well
+func WithTLS(cfg *tls.Config) ServerOption {
+	return func(ds *DefaultServer) {
+		ds.transport.TLSClientConfig = cfg.Clone() // HTTP/2 setup of transport changes it
+		ds.tlsConfig = cfg
+	}
+}
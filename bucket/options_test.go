@@ -0,0 +1,56 @@
+package bucket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewDefaultSettings(t *testing.T) {
+	bckt, _ := New(RoundRobin)
+	observed := bckt.(*RoundRobinServerBucket).settings
+	expected := defaultSettings()
+	if observed != expected {
+		t.Error("Expected", expected, "got", observed)
+	}
+}
+
+func TestNewWithOptions(t *testing.T) {
+	bckt, _ := New(
+		RoundRobin,
+		WithHealthCheckPeriod(time.Second),
+		WithRemoveStalePeriod(time.Minute),
+		WithMaxRetries(0),
+		WithMaxAttempts(5),
+		WithRetryDelay(time.Millisecond),
+	)
+	observed := bckt.(*RoundRobinServerBucket).settings
+	expected := settings{
+		healthCheckPeriod: time.Second,
+		removeStalePeriod: time.Minute,
+		maxRetries:        0,
+		maxAttempts:       5,
+		retryDelay:        time.Millisecond,
+	}
+	if observed != expected {
+		t.Error("Expected", expected, "got", observed)
+	}
+}
+
+func TestNewServerWithPingTimeout(t *testing.T) {
+	srv, _ := NewServer("http://testhost:8000", WithPingTimeout(time.Second))
+	observed := srv.(*DefaultServer).pingTimeout
+	if observed != time.Second {
+		t.Error("Expected", time.Second, "got", observed)
+	}
+}
+
+func TestNewServerWithProxyProtocol(t *testing.T) {
+	srv, _ := NewServer("http://testhost:8000", WithProxyProtocol(2))
+	if !srv.(*DefaultServer).transport.DisableKeepAlives {
+		t.Error("Expected", "disabled keep-alives", "got", "enabled")
+	}
+	srv, _ = NewServer("http://testhost:8000", WithProxyProtocol(3))
+	if srv.(*DefaultServer).transport.DisableKeepAlives {
+		t.Error("Expected", "ignored invalid version", "got", "disabled keep-alives")
+	}
+}
@@ -0,0 +1,143 @@
+package bucket
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// protoBackend - backend answering with request protocol and a trailer
+func protoBackend(r *http.Request, w http.ResponseWriter) {
+	w.Header().Set("Trailer", "Grpc-Status")
+	w.Header().Set("X-Proto", r.Proto)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("body"))
+	w.Header().Set("Grpc-Status", "0")
+}
+
+func proxy(srv Server) *http.Response {
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/", nil)
+	srv.ReverseProxy().ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+func TestServerWithH2C(t *testing.T) {
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protoBackend(r, w)
+	}), &http2.Server{}))
+	defer backend.Close()
+	srv, _ := NewServer(backend.URL, WithProtocol(H2C))
+	res := proxy(srv)
+	if res.Header.Get("X-Proto") != "HTTP/2.0" {
+		t.Error("Expected", "HTTP/2.0", "got", res.Header.Get("X-Proto"))
+	}
+	if res.Trailer.Get("Grpc-Status") != "0" {
+		t.Error("Expected", "grpc-status trailer", "got", res.Trailer)
+	}
+	if srv.ReverseProxy().FlushInterval >= 0 {
+		t.Error("Expected", "immediate flushing", "got", srv.ReverseProxy().FlushInterval)
+	}
+}
+
+func TestServerWithH2AndHTTP1(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protoBackend(r, w)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+	insecure, _ := ClientTLSConfig("", "", "", "", true)
+	cases := map[string]string{
+		H2:    "HTTP/2.0",
+		HTTP1: "HTTP/1.1",
+		"":    "HTTP/2.0",
+	}
+	for protocol, expected := range cases {
+		srv, _ := NewServer(backend.URL, WithTLS(insecure), WithProtocol(protocol))
+		res := proxy(srv)
+		if res.Header.Get("X-Proto") != expected {
+			t.Error("Expected", expected, "got", res.Header.Get("X-Proto"), "for", protocol)
+		}
+		if res.Trailer.Get("Grpc-Status") != "0" {
+			t.Error("Expected", "grpc-status trailer", "got", res.Trailer, "for", protocol)
+		}
+	}
+}
+
+func TestServerWithH2DialsThroughTransport(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protoBackend(r, w)
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+	insecure, _ := ClientTLSConfig("", "", "", "", true)
+	srv, _ := NewServer(backend.URL, WithTLS(insecure), WithProtocol(H2))
+	transport := srv.(*DefaultServer).transport
+	dial := transport.DialContext
+	dials := 0
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		return dial(ctx, network, addr)
+	}
+	for i := 0; i < 2; i++ {
+		res := proxy(srv)
+		if res.Header.Get("X-Proto") != "HTTP/2.0" {
+			t.Error("Expected", "HTTP/2.0", "got", res.Header.Get("X-Proto"))
+		}
+	}
+	if dials != 1 {
+		t.Error("Expected", 1, "got", dials)
+	}
+}
+
+func TestServerWithH2StalledHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	insecure, _ := ClientTLSConfig("", "", "", "", true)
+	srv, _ := NewServer("https://"+ln.Addr().String(), WithTLS(insecure), WithProtocol(H2))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest(http.MethodPost, "/", nil)
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	srv.ReverseProxy().ServeHTTP(rec, req.WithContext(ctx))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Error("Expected", "request to give up with its context", "got", elapsed)
+	}
+	if rec.Code != http.StatusBadGateway {
+		t.Error("Expected", http.StatusBadGateway, "got", rec.Code)
+	}
+}
+
+func TestServerWithH2NotNegotiated(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protoBackend(r, w)
+	}))
+	defer backend.Close()
+	insecure, _ := ClientTLSConfig("", "", "", "", true)
+	srv, _ := NewServer(backend.URL, WithTLS(insecure), WithProtocol(H2))
+	res := proxy(srv)
+	if res.StatusCode != http.StatusBadGateway {
+		t.Error("Expected", http.StatusBadGateway, "got", res.StatusCode)
+	}
+}
@@ -5,20 +5,15 @@ import (
 	"errors"
 	"log"
 	"net/http"
+	"net/http/httputil"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-const (
-	healthCheckPeriod = 5 * time.Second
-	removeStalePeriod = 60 * time.Second
-	maxRetries        = 3
-	maxAttempts       = 3
-)
-
 var (
 	ErrInvalidServer         = errors.New("expected Server, got nil")
+	ErrServerNotFound        = errors.New("server not found")
 	ErrNoServersAvailable    = errors.New("no servers available")
 	ErrAllServersUnreachable = errors.New("all servers unreachable")
 	ErrServiceUnavailable    = errors.New("service not available")
@@ -26,86 +21,259 @@ var (
 
 // RoundRobinServerBucket - round-robin representatino of servers pool
 type RoundRobinServerBucket struct {
-	servers []Server     // servers storage
-	last    uint64       // last used server index
-	lock    sync.RWMutex // lock for servers slice
+	last     uint64         // last used server index, first for atomic alignment
+	servers  atomic.Value   // current []Server, replaced as a whole on changes, never modified
+	lock     sync.Mutex     // serializes servers replacements
+	settings settings       // periods and retry limits
+	inFlight int64          // requests being served right now
+	done     chan struct{}  // closed to stop services
+	stopOnce sync.Once      // guard for done channel
+	services sync.WaitGroup // running services
+
+	leastConn     bool     // choose the least loaded server, round-robin among equally loaded
+	upgrades      upgrades // upgraded connections by server
+	proxyHandlers sync.Map // *serverHandlers by server
+	series        sync.Map // *serverMetrics by server, present while server is in bucket
+}
+
+// serverHandlers - bucket's reverse proxy handlers of a server
+type serverHandlers struct {
+	errHandler func(http.ResponseWriter, *http.Request, error)
+	modifier   func(*http.Response) error
 }
 
 // AddServer - collect Server instance
+// Server keeps its availability until its first health check, which runs within jitter after it is noticed.
 func (sb *RoundRobinServerBucket) AddServer(srv Server) error {
 	if srv == nil {
 		return ErrInvalidServer
 	}
-	srv.ReverseProxy().ErrorHandler = sb.getErrHandler(srv)
-	status := srv.PingServer()
-	srv.SetAvailable(status)
+	if proxy := srv.ReverseProxy(); proxy.ErrorHandler == nil {
+		setProxyHandlers(proxy, srv)
+	}
+	status := srv.IsAvailable()
 	sb.lock.Lock()
-	sb.servers = append(sb.servers, srv)
-	sb.lock.Unlock()
+	defer sb.lock.Unlock()
+	current := sb.snapshot()
+	servers := make([]Server, 0, len(current)+1)
+	sb.servers.Store(append(append(servers, current...), srv))
+	m, _ := sb.series.LoadOrStore(srv, newServerMetrics(sb.settings.name, srv.Address()))
+	m.(*serverMetrics).setAvailable(status)
 	return nil
 }
+
+// RemoveServer - remove Server instance with provided address from storage
+// In-flight requests are not interrupted, server just stops getting new ones
+func (sb *RoundRobinServerBucket) RemoveServer(address string) error {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	current := sb.snapshot()
+	for i, srv := range current {
+		if srv.Address().String() == address {
+			sb.servers.Store(append(current[:i:i], current[i+1:]...))
+			sb.forget(srv)
+			if sb.settings.closeUpgraded {
+				sb.upgrades.close(srv)
+			}
+			return nil
+		}
+	}
+	return ErrServerNotFound
+}
+
+// Servers - copy of servers storage
+func (sb *RoundRobinServerBucket) Servers() []Server {
+	return append([]Server{}, sb.snapshot()...)
+}
+
 func (sb *RoundRobinServerBucket) Size() int {
-	return len(sb.servers)
+	return len(sb.snapshot())
+}
+
+// snapshot - current servers, must not be modified
+func (sb *RoundRobinServerBucket) snapshot() []Server {
+	servers, _ := sb.servers.Load().([]Server)
+	return servers
+}
+
+// forget - drop bucket's handlers and metrics of removed server
+func (sb *RoundRobinServerBucket) forget(srv Server) {
+	sb.proxyHandlers.Delete(srv)
+	sb.series.Delete(srv)
+	deleteServerMetrics(sb.settings.name, srv.Address().String())
+}
+
+// InFlight - amount of requests being served by the bucket
+func (sb *RoundRobinServerBucket) InFlight() int64 {
+	return atomic.LoadInt64(&sb.inFlight)
 }
 
 // Serve - serve incoming request with server's proxy
+// Each gRPC call is balanced separately, even if calls share a connection
 func (sb *RoundRobinServerBucket) Serve(w http.ResponseWriter, r *http.Request) error {
 	srv, err := sb.getNextServer()
 	if err != nil {
 		return err
 	}
+	if served, _ := r.Context().Value(bucketKey).(*RoundRobinServerBucket); served != sb {
+		ctx := context.WithValue(r.Context(), bucketKey, sb)
+		if r.Body != nil && r.Body != http.NoBody {
+			body := &countedBody{ReadCloser: r.Body}
+			ctx = context.WithValue(ctx, bodyKey, body)
+			r = r.WithContext(ctx)
+			r.Body = body
+		} else {
+			r = r.WithContext(ctx)
+		}
+	}
+	if _, tracked := r.Body.(*trackedBody); IsGRPC(r) && r.Body != nil && r.Body != http.NoBody && !tracked {
+		r = r.WithContext(r.Context())
+		r.Body = &trackedBody{ReadCloser: r.Body}
+	}
 	proxy := srv.ReverseProxy()
 	log.Println("[proxy] to", srv.Address())
-	proxy.ServeHTTP(w, r)
+	if IsUpgrade(r) {
+		var untrack func()
+		w, untrack = sb.track(w, srv)
+		defer untrack()
+	}
+	m := sb.metrics(srv)
+	mw := &metricsWriter{ResponseWriter: w}
+	body, _ := r.Context().Value(bodyKey).(*countedBody)
+	read := body.count()
+	started := time.Now()
+	atomic.AddInt64(&sb.inFlight, 1)
+	srv.AddInFlight(1)
+	m.addInFlight(1)
+	defer func() {
+		m.addInFlight(-1)
+		srv.AddInFlight(-1)
+		atomic.AddInt64(&sb.inFlight, -1)
+		m.served(mw, body.count()-read, time.Since(started))
+	}()
+	proxy.ServeHTTP(mw, r)
 	return nil
 }
 
+// Next - choose server for callers, which proxy on their own, like UDP sessions
+func (sb *RoundRobinServerBucket) Next() (Server, error) {
+	return sb.getNextServer()
+}
+
 // getNextServer - round-robin algorithm for chosing next server
 // Check if current server is available to serve request,
-// in other case we just get next, while not find good one
+// in other case we just get next, while not find good one.
+// Works on servers snapshot without locking, concurrent changes are seen by the next requests.
 func (sb *RoundRobinServerBucket) getNextServer() (Server, error) {
-	srvAmount := uint64(len(sb.servers))
+	servers := sb.snapshot()
+	srvAmount := uint64(len(servers))
 	if srvAmount == 0 {
 		return nil, ErrNoServersAvailable
 	}
-	next := sb.last % srvAmount
-	defer atomic.AddUint64(&sb.last, 1)
+	next := (atomic.AddUint64(&sb.last, 1) - 1) % srvAmount
 	full := next + srvAmount
-	sb.lock.Lock()
+	if sb.leastConn {
+		return getLeastLoaded(servers, next, full)
+	}
 	for pos := next; pos < full; pos++ {
 		index := pos % srvAmount
-		if sb.servers[index].IsAvailable() {
+		if acceptsNew(servers[index]) {
 			if index != next {
-				atomic.StoreUint64(&sb.last, pos)
+				atomic.AddUint64(&sb.last, pos-next)
 			}
-			srv := sb.servers[index]
-			sb.lock.Unlock()
-			return srv, nil
+			return servers[index], nil
 		}
 	}
-	sb.lock.Unlock()
 	return nil, ErrAllServersUnreachable
 }
 
+// getLeastLoaded - available server with the fewest in-flight requests
+// Upgraded connections are in-flight until closed. Search starts at round-robin position,
+// so equally loaded servers take turns.
+func getLeastLoaded(servers []Server, next, full uint64) (Server, error) {
+	srvAmount := uint64(len(servers))
+	if srvAmount == 0 {
+		return nil, ErrNoServersAvailable
+	}
+	var chosen Server
+	for pos := next; pos < full; pos++ {
+		srv := servers[pos%srvAmount]
+		if acceptsNew(srv) && (chosen == nil || srv.InFlight() < chosen.InFlight()) {
+			chosen = srv
+		}
+	}
+	if chosen == nil {
+		return nil, ErrAllServersUnreachable
+	}
+	return chosen, nil
+}
+
+// acceptsNew - whether server may be chosen for new requests
+func acceptsNew(srv Server) bool {
+	return srv.IsAvailable() && srv.State() == StateActive
+}
+
+// setProxyHandlers - set up server's reverse proxy to use handlers of the bucket serving request
+// Servers are shared by buckets on reload, so proxy must not be changed once it serves requests.
+func setProxyHandlers(proxy *httputil.ReverseProxy, srv Server) {
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
+		sb, ok := r.Context().Value(bucketKey).(*RoundRobinServerBucket)
+		if !ok {
+			log.Printf("[%s] %s\n", srv.Address(), e.Error())
+			WriteError(w, r, e, http.StatusBadGateway)
+			return
+		}
+		sb.handlers(srv).errHandler(w, r, e)
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		sb, ok := res.Request.Context().Value(bucketKey).(*RoundRobinServerBucket)
+		if !ok {
+			return nil
+		}
+		return sb.handlers(srv).modifier(res)
+	}
+}
+
+// handlers - bucket's proxy handlers of server, created on first use
+// Removed servers get them again, if their in-flight requests need them.
+func (sb *RoundRobinServerBucket) handlers(srv Server) *serverHandlers {
+	if handlers, ok := sb.proxyHandlers.Load(srv); ok {
+		return handlers.(*serverHandlers)
+	}
+	handlers, _ := sb.proxyHandlers.LoadOrStore(srv, &serverHandlers{
+		errHandler: sb.getErrHandler(srv),
+		modifier:   sb.getResponseModifier(srv),
+	})
+	return handlers.(*serverHandlers)
+}
+
 // getErrHandler - error handler func for reverse proxy instance
-// First, we try MAX_RETRIES time to serve request with current server
+// First, we try maxRetries time to serve request with current server
 // Second, we recurrently call Serve func, to switch server
 // Count retries for each server separately
 // Count attempts for each request
+// gRPC calls with consumed body can't be sent again, they fail at once, server isn't blamed for them
 func (sb *RoundRobinServerBucket) getErrHandler(srv Server) func(w http.ResponseWriter, r *http.Request, e error) {
 	return func(w http.ResponseWriter, r *http.Request, e error) {
+		if IsGRPC(r) && !replayable(r) {
+			log.Printf("[%s] %s (%s) %s, not retrying consumed call\n", srv.Address(), r.RemoteAddr, r.URL.Path, e.Error())
+			WriteError(w, r, e, http.StatusServiceUnavailable)
+			return
+		}
 		attempts := GetAttemptsFromContext(r)
-		if attempts > maxAttempts {
+		if attempts > sb.settings.maxAttempts {
+			markFailed(w)
 			log.Printf("[attempt] %s (%s) Too much attempts, refusing\n", r.RemoteAddr, r.URL.Path)
-			http.Error(w, ErrServiceUnavailable.Error(), http.StatusServiceUnavailable)
+			WriteError(w, r, ErrServiceUnavailable, http.StatusServiceUnavailable)
 			return
 		}
 		log.Printf("[%s] %s\n", srv.Address(), e.Error())
 		retries := GetRetriesFromContext(r)
 		proxy := srv.ReverseProxy()
-		if retries < maxRetries {
+		if retries < sb.settings.maxRetries {
+			sb.metrics(srv).retried()
 			select {
-			case <-time.After(10 * time.Millisecond):
+			case <-time.After(sb.settings.retryDelay):
 				ctx := context.WithValue(r.Context(), RetriesKey, retries+1)
 
 				log.Printf("[retry] %s (%s) Retrying server %d\n", r.RemoteAddr, r.URL.Path, attempts)
@@ -113,26 +281,14 @@ func (sb *RoundRobinServerBucket) getErrHandler(srv Server) func(w http.Response
 			}
 			return
 		}
-		srv.SetAvailable(false)
+		markFailed(w)
+		sb.Eject(srv, EjectProxyError)
+		sb.metrics(srv).attempted()
 		log.Printf("[attempt] %s (%s) Attempting server %d\n", r.RemoteAddr, r.URL.Path, attempts)
 		ctx := context.WithValue(r.Context(), AttemptsKey, attempts+1)
-		sb.Serve(w, r.WithContext(ctx))
-	}
-}
-
-// Healthcheck - passive server's availability checks
-func (sb *RoundRobinServerBucket) Healthcheck() {
-	if sb.Size() < 1 {
-		log.Printf("[healthcheck] %s \n", ErrNoServersAvailable.Error())
-	}
-	for _, srv := range sb.servers {
-		msg := "available"
-		status := srv.PingServer()
-		srv.SetAvailable(status)
-		if !status {
-			msg = "unreachable"
+		if err := sb.Serve(w, r.WithContext(ctx)); err != nil {
+			WriteError(w, r, err, http.StatusServiceUnavailable)
 		}
-		log.Printf("[healthcheck] %s (%s)\n", srv.Address(), msg)
 	}
 }
 
@@ -142,38 +298,92 @@ func (sb *RoundRobinServerBucket) RemoveStale(timeout time.Duration) {
 		return
 	}
 	sb.lock.Lock()
+	current := sb.snapshot()
 	newServers := []Server{}
-	for _, srv := range sb.servers {
+	removed := []Server{}
+	for _, srv := range current {
 		addr := srv.Address()
 		timeDiff := time.Since(time.Unix(srv.LastSeen(), 0))
 		if !srv.IsAvailable() && timeDiff > timeout {
 			log.Printf("[remove] %s is stale and will be removed\n", addr)
+			removed = append(removed, srv)
+			sb.forget(srv)
 			continue
 		}
 		newServers = append(newServers, srv)
 	}
-	if len(newServers) != len(sb.servers) {
-		sb.servers = newServers
+	if len(newServers) != len(current) {
+		sb.servers.Store(newServers)
 	}
 	sb.lock.Unlock()
+	if sb.settings.closeUpgraded && len(removed) > 0 {
+		sb.upgrades.close(removed...)
+	}
 }
 
-// RunServices - execute servers pool services
-func (sb *RoundRobinServerBucket) RunServices(staleTimeout int) {
-	go func() {
-		for {
-			select {
-			case <-time.After(healthCheckPeriod):
-				sb.Healthcheck()
-			}
-		}
-	}()
-	go func() {
-		for {
-			select {
-			case <-time.After(removeStalePeriod):
-				sb.RemoveStale(time.Minute * time.Duration(staleTimeout))
-			}
+// RunServices - execute servers pool services until ctx is done or Stop is called
+// Health checks start at once, every server on its own schedule, see runHealthChecks.
+// Stale servers are removed after the first period. Services with non-positive period are not run.
+func (sb *RoundRobinServerBucket) RunServices(ctx context.Context, staleTimeout time.Duration) {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if sb.done == nil {
+		sb.done = make(chan struct{})
+	}
+	select {
+	case <-sb.done:
+		return
+	default:
+	}
+	sb.services.Add(2)
+	go sb.runHealthChecks(ctx, sb.done)
+	go sb.runService(ctx, sb.done, sb.settings.removeStalePeriod, func() {
+		sb.RemoveStale(staleTimeout)
+	})
+}
+
+// runService - call service every period until ctx is done or bucket is stopped
+func (sb *RoundRobinServerBucket) runService(ctx context.Context, done chan struct{}, period time.Duration, service func()) {
+	defer sb.services.Done()
+	if period <= 0 {
+		return
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			service()
 		}
-	}()
+	}
+}
+
+// CloseUpgraded - close upgraded connections of servers, all of them if none provided, like on shutdown
+func (sb *RoundRobinServerBucket) CloseUpgraded(servers ...Server) {
+	sb.upgrades.close(servers...)
+}
+
+// Stop - stop servers pool services and wait for running checks, in-flight requests
+// and upgraded connections are not affected
+func (sb *RoundRobinServerBucket) Stop() {
+	done := sb.stopChannel()
+	sb.stopOnce.Do(func() {
+		sb.lock.Lock()
+		close(done)
+		sb.lock.Unlock()
+	})
+	sb.services.Wait()
+}
+
+func (sb *RoundRobinServerBucket) stopChannel() chan struct{} {
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+	if sb.done == nil {
+		sb.done = make(chan struct{})
+	}
+	return sb.done
 }
@@ -1,7 +1,10 @@
 package bucket
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
 	"net/url"
 	"reflect"
@@ -19,6 +22,8 @@ type MockServer struct {
 	address     *url.URL
 	isAvailable bool
 	ping        bool
+	inFlight    int64
+	state       string
 }
 
 func (ms *MockServer) IsAvailable() bool {
@@ -29,6 +34,22 @@ func (ms *MockServer) SetAvailable(status bool) {
 	ms.isAvailable = status
 }
 
+func (ms *MockServer) State() string {
+	if ms.state == "" {
+		return StateActive
+	}
+	return ms.state
+}
+
+func (ms *MockServer) SetState(state string) error {
+	ms.state = state
+	return nil
+}
+
+func (ms *MockServer) Drained() bool {
+	return ms.State() != StateActive && ms.inFlight == 0
+}
+
 func (ms *MockServer) Address() *url.URL {
 	return ms.address
 }
@@ -42,22 +63,34 @@ func (ms *MockServer) LastSeen() int64 {
 	return 1
 }
 
+func (ms *MockServer) InFlight() int64 {
+	return ms.inFlight
+}
+
+func (ms *MockServer) AddInFlight(delta int64) {
+	ms.inFlight += delta
+}
+
 func (ms *MockServer) PingServer() bool {
 	return ms.ping
 }
 
+func (ms *MockServer) Dial(ctx context.Context) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", ms.address.Host)
+}
+
 func TestAddServer(t *testing.T) {
-	bckt := &RoundRobinServerBucket{
-		servers: []Server{},
-	}
+	bckt := &RoundRobinServerBucket{}
 
 	srv, _ := NewServer("http://testhost:8000")
+	unavailable, _ := NewServer("http://testhost:8001", WithAvailable(false))
 	bckt.AddServer(srv)
-	if len(bckt.servers) != 1 {
-		t.Error("Expected", 1, "got", len(bckt.servers))
+	bckt.AddServer(unavailable)
+	if len(bckt.snapshot()) != 2 {
+		t.Error("Expected", 2, "got", len(bckt.snapshot()))
 	}
-	if srv.IsAvailable() {
-		t.Error("Expected", false, "got", srv.IsAvailable())
+	if !srv.IsAvailable() || unavailable.IsAvailable() {
+		t.Error("Expected", "availability kept until the first check", "got", srv.IsAvailable(), unavailable.IsAvailable())
 	}
 	// Check if proxy ErrorHandler was installed
 	errHandler := &srv.ReverseProxy().ErrorHandler
@@ -66,13 +99,79 @@ func TestAddServer(t *testing.T) {
 	}
 }
 
+func TestRemoveServer(t *testing.T) {
+	bckt := &RoundRobinServerBucket{}
+	addrs := []string{"http://testhost1:8000", "http://testhost2:8000", "http://testhost3:8000"}
+	for i := 0; i < 3; i++ {
+		addr, _ := url.Parse(addrs[i])
+		bckt.AddServer(&MockServer{address: addr, isAvailable: true})
+	}
+	if err := bckt.RemoveServer("http://testhost2:8000"); err != nil {
+		t.Error("Expected", nil, "got", err)
+	}
+	if len(bckt.snapshot()) != 2 {
+		t.Error("Expected", 2, "got", len(bckt.snapshot()))
+	}
+	for _, srv := range bckt.snapshot() {
+		if srv.Address().Host == "testhost2:8000" {
+			t.Error("Expected", "testhost2:8000", "to be removed")
+		}
+	}
+	if err := bckt.RemoveServer("http://testhost2:8000"); err != ErrServerNotFound {
+		t.Error("Expected", ErrServerNotFound, "got", err)
+	}
+}
+
 func TestServe(t *testing.T) {
-	// TODO:
+	bckt := &RoundRobinServerBucket{}
+	var observed int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		observed = bckt.InFlight()
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+	srv, _ := NewServer(backend.URL)
+	bckt.AddServer(srv)
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	if err := bckt.Serve(rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusTeapot {
+		t.Error("Expected", http.StatusTeapot, "got", rec.Code)
+	}
+	if observed != 1 {
+		t.Error("Expected", 1, "got", observed)
+	}
+	if bckt.InFlight() != 0 || srv.InFlight() != 0 {
+		t.Error("Expected", 0, "got", bckt.InFlight(), srv.InFlight())
+	}
 }
-func TestGetNextServer(t *testing.T) {
-	bckt := &RoundRobinServerBucket{
-		servers: []Server{},
+
+func TestServers(t *testing.T) {
+	bckt := &RoundRobinServerBucket{}
+	addr, _ := url.Parse("http://testhost1:8000")
+	bckt.AddServer(&MockServer{address: addr, isAvailable: true})
+	servers := bckt.Servers()
+	servers[0] = nil
+	if bckt.snapshot()[0] == nil {
+		t.Error("Expected", "copy of servers", "got", "storage itself")
+	}
+}
+
+func TestStop(t *testing.T) {
+	bckt, _ := New(RoundRobin, WithHealthCheckPeriod(time.Millisecond))
+	bckt.RunServices(context.Background(), time.Minute)
+	bckt.Stop()
+	bckt.Stop()
+	select {
+	case <-bckt.(*RoundRobinServerBucket).done:
+	default:
+		t.Error("Expected", "closed done channel")
 	}
+}
+func TestGetNextServer(t *testing.T) {
+	bckt := &RoundRobinServerBucket{}
 	addrs := []string{"http://testhost1:8000", "http://testhost2:8000", "http://testhost3:8000"}
 	for i := 0; i < 3; i++ {
 		addr, _ := url.Parse(addrs[i])
@@ -93,9 +192,7 @@ func TestGetNextServer(t *testing.T) {
 
 }
 func TestGetNextServerEmpty(t *testing.T) {
-	bckt := &RoundRobinServerBucket{
-		servers: []Server{},
-	}
+	bckt := &RoundRobinServerBucket{}
 	srv, err := bckt.getNextServer()
 	if err == nil {
 		t.Error("Expected", ErrNoServersAvailable, "got", nil)
@@ -105,9 +202,7 @@ func TestGetNextServerEmpty(t *testing.T) {
 	}
 }
 func TestGetNextServerUnreachable(t *testing.T) {
-	bckt := &RoundRobinServerBucket{
-		servers: []Server{},
-	}
+	bckt := &RoundRobinServerBucket{}
 	addr, _ := url.Parse("http://testhost1:8000")
 
 	bckt.AddServer(&MockServer{address: addr, isAvailable: false})
@@ -120,9 +215,7 @@ func TestGetNextServerUnreachable(t *testing.T) {
 	}
 }
 func TestGetErrHandler(t *testing.T) {
-	bckt := &RoundRobinServerBucket{
-		servers: []Server{},
-	}
+	bckt := &RoundRobinServerBucket{}
 	addr, _ := url.Parse("http://testhost1:8000")
 	srv := &MockServer{address: addr, isAvailable: true}
 	bckt.AddServer(srv)
@@ -136,9 +229,7 @@ func TestGetErrHandler(t *testing.T) {
 }
 
 func TestHealthcheck(t *testing.T) {
-	bckt := &RoundRobinServerBucket{
-		servers: []Server{},
-	}
+	bckt := &RoundRobinServerBucket{}
 	addrs := []string{"http://testhost7:8000", "http://testhost8:8000", "http://testhost9:8000"}
 	flag := true
 	for i := 0; i < 3; i++ {
@@ -153,7 +244,7 @@ func TestHealthcheck(t *testing.T) {
 	}
 	bckt.Healthcheck()
 	flag = true
-	for _, srv := range bckt.servers {
+	for _, srv := range bckt.snapshot() {
 		if srv.IsAvailable() != flag {
 			t.Error("Expected", srv, "got", srv.IsAvailable())
 		}
@@ -163,9 +254,7 @@ func TestHealthcheck(t *testing.T) {
 }
 
 func TestRemoveStale(t *testing.T) {
-	bckt := &RoundRobinServerBucket{
-		servers: []Server{},
-	}
+	bckt := &RoundRobinServerBucket{}
 	addrs := []string{"http://testhost1:8000", "http://testhost2:8000", "http://testhost3:8000"}
 	for i := 0; i < 3; i++ {
 		addr, _ := url.Parse(addrs[i])
@@ -176,14 +265,12 @@ func TestRemoveStale(t *testing.T) {
 		bckt.AddServer(srv)
 	}
 	bckt.RemoveStale(time.Second * 0)
-	if len(bckt.servers) != 0 {
-		t.Error("Expected", 0, "got", len(bckt.servers))
+	if len(bckt.snapshot()) != 0 {
+		t.Error("Expected", 0, "got", len(bckt.snapshot()))
 	}
 }
 func TestRemoveStaleDifferent(t *testing.T) {
-	bckt := &RoundRobinServerBucket{
-		servers: []Server{},
-	}
+	bckt := &RoundRobinServerBucket{}
 	addrs := []string{"http://testhost3:8000", "http://testhost4:8000", "http://testhost5:8000"}
 	flag := true
 	for i := 0; i < 3; i++ {
@@ -197,7 +284,61 @@ func TestRemoveStaleDifferent(t *testing.T) {
 		flag = !flag
 	}
 	bckt.RemoveStale(time.Second * 0)
-	if len(bckt.servers) != 2 {
-		t.Error("Expected", 2, "got", len(bckt.servers))
+	if len(bckt.snapshot()) != 2 {
+		t.Error("Expected", 2, "got", len(bckt.snapshot()))
+	}
+}
+
+func TestGetNextServerSkipsDrained(t *testing.T) {
+	for _, leastConn := range []bool{false, true} {
+		bckt := &RoundRobinServerBucket{leastConn: leastConn}
+		for _, state := range []string{StateDraining, StateActive, StateDisabled} {
+			addr, _ := url.Parse("http://" + state + ":8000")
+			bckt.AddServer(&MockServer{address: addr, isAvailable: true, ping: true, state: state})
+		}
+		for i := 0; i < 3; i++ {
+			srv, _ := bckt.getNextServer()
+			if srv == nil || srv.State() != StateActive {
+				t.Error("Expected", StateActive, "got", srv)
+			}
+		}
+		bckt.snapshot()[1].SetState(StateDraining)
+		if srv, err := bckt.getNextServer(); err != ErrAllServersUnreachable {
+			t.Error("Expected", ErrAllServersUnreachable, "got", srv, err)
+		}
+	}
+}
+
+func TestRunServicesChecksAtOnce(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	bckt, _ := New(RoundRobin, WithHealthCheckPeriod(time.Hour))
+	srv, _ := NewServer(backend.URL)
+	bckt.AddServer(srv)
+	srv.SetAvailable(false)
+	bckt.RunServices(context.Background(), time.Minute)
+	defer bckt.Stop()
+	if !waitFor(srv.IsAvailable) {
+		t.Error("Expected", "server checked at start", "got", "unavailable")
+	}
+}
+
+func TestRunServicesContext(t *testing.T) {
+	bckt, _ := New(RoundRobin, WithHealthCheckPeriod(time.Millisecond), WithRemoveStalePeriod(time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	bckt.RunServices(ctx, time.Minute)
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		bckt.(*RoundRobinServerBucket).services.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected", "services stopped with context", "got", "timeout")
 	}
+	bckt.Stop()
+	bckt.RunServices(context.Background(), time.Minute)
+	bckt.Stop()
 }
@@ -1,38 +1,78 @@
 package bucket
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
 	"net"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// udpProbeWait - how long udp availability check waits for refusal
+const udpProbeWait = 200 * time.Millisecond
+
 // DefaultServer - default backend server implementation
 type DefaultServer struct {
+	lastSeen     int64                  // unixtime for last time, when server was available, first for atomic alignment
+	inFlight     int64                  // requests being served right now
 	address      *url.URL               // server address
-	isAvailable  bool                   // current status
-	lock         sync.RWMutex           // lock for isAvailable attribute
+	isAvailable  int32                  // current status, 1 if available
+	state        atomic.Value           // administrative state, active if not set
 	reverseProxy *httputil.ReverseProxy // reverse proxy for request forwarding
-	lastSeen     int64                  // unixtime for last time, when server was available
+	transport    *http.Transport        // reverse proxy transport, tuned by options
+	tlsConfig    *tls.Config            // TLS settings toward https server, system defaults if nil
+	protocol     string                 // protocol toward server, HTTP/2 is negotiated for https if empty
+	pingTimeout  time.Duration          // dial timeout for availability checks
 }
 
 // IsAvailable - getter for server's availability
 func (ds *DefaultServer) IsAvailable() bool {
-	ds.lock.RLock()
-	status := ds.isAvailable
-	ds.lock.RUnlock()
-	return status
+	return atomic.LoadInt32(&ds.isAvailable) == 1
 }
 
 // SetAvailable - setter for server's availability
 func (ds *DefaultServer) SetAvailable(status bool) {
-	ds.lock.Lock()
-	ds.isAvailable = status
-	if status {
-		ds.lastSeen = time.Now().Unix()
+	if !status {
+		atomic.StoreInt32(&ds.isAvailable, 0)
+		return
+	}
+	atomic.StoreInt64(&ds.lastSeen, time.Now().Unix())
+	atomic.StoreInt32(&ds.isAvailable, 1)
+}
+
+// State - getter for server's administrative state
+func (ds *DefaultServer) State() string {
+	if state, ok := ds.state.Load().(string); ok {
+		return state
+	}
+	return StateActive
+}
+
+// SetState - setter for server's administrative state, health checks never change it
+// Server taken out of rotation reports, when its in-flight requests are done.
+func (ds *DefaultServer) SetState(state string) error {
+	switch state {
+	case StateActive, StateDraining, StateDisabled:
+	default:
+		return ErrInvalidState
+	}
+	ds.state.Store(state)
+	log.Printf("[state] %s is %s\n", ds.address, state)
+	if ds.Drained() {
+		log.Printf("[state] %s is drained\n", ds.address)
 	}
-	ds.lock.Unlock()
+	return nil
+}
+
+// Drained - whether server is out of rotation and has no in-flight requests
+func (ds *DefaultServer) Drained() bool {
+	return ds.State() != StateActive && ds.InFlight() == 0
 }
 
 // Address - getter for server address
@@ -47,15 +87,113 @@ func (ds *DefaultServer) ReverseProxy() *httputil.ReverseProxy {
 
 // LastSeen - getter for lastSeen time field
 func (ds *DefaultServer) LastSeen() int64 {
-	return ds.lastSeen
+	return atomic.LoadInt64(&ds.lastSeen)
 }
 
+// InFlight - getter for amount of requests being served
+func (ds *DefaultServer) InFlight() int64 {
+	return atomic.LoadInt64(&ds.inFlight)
+}
+
+// AddInFlight - change amount of requests being served
+func (ds *DefaultServer) AddInFlight(delta int64) {
+	if atomic.AddInt64(&ds.inFlight, delta) == 0 && delta < 0 && ds.State() != StateActive {
+		log.Printf("[state] %s is drained\n", ds.address)
+	}
+}
+
+// roundTripper - reverse proxy transport for server's protocol
+func (ds *DefaultServer) roundTripper() http.RoundTripper {
+	switch ds.protocol {
+	case HTTP1:
+		ds.transport.ForceAttemptHTTP2 = false
+		ds.transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	case H2:
+		return newH2Transport(ds.dialH2)
+	case H2C:
+		return newH2Transport(ds.dialH2C)
+	}
+	return ds.transport
+}
+
+// hostPort - server's host with port, scheme's default port if omitted
+func (ds *DefaultServer) hostPort() string {
+	if ds.address.Port() != "" {
+		return ds.address.Host
+	}
+	port := "80"
+	if ds.address.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(ds.address.Hostname(), port)
+}
+
+// Dial - open raw connection to server, with PROXY protocol header if enabled
+// Client connection for the header is taken from context, see proxyproto.WithConn.
+// Servers with udp scheme get connected UDP socket.
+func (ds *DefaultServer) Dial(ctx context.Context) (net.Conn, error) {
+	network := "tcp"
+	if ds.address.Scheme == UDP {
+		network = "udp"
+	}
+	return ds.transport.DialContext(ctx, network, ds.hostPort())
+}
+
+// PingServer - check if server accepts tcp connections, or connections to its Unix socket
+// Https server has to complete TLS handshake as well.
+// Udp server gets an empty datagram and is unreachable only if ICMP port unreachable comes back.
 func (ds *DefaultServer) PingServer() bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", ds.address.Host, timeout)
+	dialer := &net.Dialer{Timeout: ds.pingTimeout}
+	host := ds.hostPort()
+	switch ds.address.Scheme {
+	case UDP:
+		return pingUDP(dialer, host)
+	case Unix:
+		conn, err := dialer.Dial("unix", ds.address.Path)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	if ds.address.Scheme != "https" {
+		conn, err := dialer.Dial("tcp", host)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	cfg := &tls.Config{}
+	if ds.tlsConfig != nil {
+		cfg = ds.tlsConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = ds.address.Hostname()
+	}
+	conn, err := tls.DialWithDialer(dialer, "tcp", host, cfg)
 	if err != nil {
 		return false
 	}
 	conn.Close()
 	return true
 }
+
+// pingUDP - send empty datagram and wait for refusal, silence means server is there
+func pingUDP(dialer *net.Dialer, host string) bool {
+	conn, err := dialer.Dial("udp", host)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	wait := udpProbeWait
+	if dialer.Timeout > 0 && dialer.Timeout < wait {
+		wait = dialer.Timeout
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	if _, err := conn.Write([]byte{}); err != nil {
+		return false
+	}
+	_, err = conn.Read(make([]byte, 1))
+	return !errors.Is(err, syscall.ECONNREFUSED)
+}
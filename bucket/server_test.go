@@ -1,7 +1,13 @@
 package bucket
 
 import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -26,6 +32,28 @@ func TestSetAvailable(t *testing.T) {
 	}
 }
 
+func TestSetState(t *testing.T) {
+	srv, _ := NewServer("http://127.0.0.1:1")
+	if srv.State() != StateActive || srv.Drained() {
+		t.Error("Expected", StateActive, "got", srv.State(), srv.Drained())
+	}
+	if err := srv.SetState("paused"); err != ErrInvalidState {
+		t.Error("Expected", ErrInvalidState, "got", err)
+	}
+	srv.AddInFlight(1)
+	srv.SetState(StateDraining)
+	bckt, _ := New(RoundRobin)
+	bckt.AddServer(srv)
+	bckt.Healthcheck()
+	if srv.State() != StateDraining || srv.Drained() {
+		t.Error("Expected", "draining with in-flight request", "got", srv.State(), srv.Drained())
+	}
+	srv.AddInFlight(-1)
+	if !srv.Drained() {
+		t.Error("Expected", "drained", "got", srv.InFlight())
+	}
+}
+
 func TestAddress(t *testing.T) {
 	srv, _ := NewServer("http://testhost:8000")
 	url := srv.Address()
@@ -49,3 +77,52 @@ func TestLastSeen(t *testing.T) {
 		t.Error("Expected", time.Now().Unix(), "got", srv.LastSeen())
 	}
 }
+
+func TestPingUDPServer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := NewServer("udp://" + conn.LocalAddr().String())
+	if !srv.PingServer() {
+		t.Error("Expected", "silent server available", "got", "unreachable")
+	}
+	conn.Close()
+	if srv.PingServer() {
+		t.Error("Expected", "refusing server unreachable", "got", "available")
+	}
+}
+
+func TestUnixServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &httptest.Server{Listener: ln, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host + r.URL.Path))
+	})}}
+	backend.Start()
+	defer backend.Close()
+	srv, err := NewServer("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !srv.PingServer() {
+		t.Error("Expected", "available", "got", "unreachable")
+	}
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "http://lb.local/status", nil)
+	srv.ReverseProxy().ServeHTTP(rec, req)
+	if rec.Body.String() != "lb.local/status" {
+		t.Error("Expected", "lb.local/status", "got", rec.Body.String())
+	}
+	if _, err := NewServer("unix://host/app.sock"); err != ErrInvalidSocket {
+		t.Error("Expected", ErrInvalidSocket, "got", err)
+	}
+}
@@ -0,0 +1,172 @@
+package bucket
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newStressBucket - bucket of available servers, nobody listens on their addresses
+func newStressBucket(algorithm string, amount int) ServerBucket {
+	bckt, _ := New(algorithm, WithHealthCheckWorkers(amount))
+	for i := 0; i < amount; i++ {
+		srv, _ := NewServer(fmt.Sprintf("http://127.0.0.1:%d", i+1), WithPingTimeout(10*time.Millisecond))
+		bckt.AddServer(srv)
+		srv.SetAvailable(true)
+	}
+	return bckt
+}
+
+// hammer - run workers concurrently until duration passes
+func hammer(duration time.Duration, workers ...func()) {
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, work := range workers {
+		wg.Add(1)
+		go func(work func()) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					work()
+				}
+			}
+		}(work)
+	}
+	time.Sleep(duration)
+	close(stop)
+	wg.Wait()
+}
+
+func TestConcurrentPoolChanges(t *testing.T) {
+	for _, algorithm := range []string{RoundRobin, LeastConnections} {
+		bckt := newStressBucket(algorithm, 5)
+		extra, _ := NewServer("http://127.0.0.1:6", WithPingTimeout(10*time.Millisecond))
+		errs := make(chan error, 1)
+		next := func() {
+			srv, err := bckt.Next()
+			if err != nil && err != ErrAllServersUnreachable && err != ErrNoServersAvailable {
+				select {
+				case errs <- err:
+				default:
+				}
+				return
+			}
+			if srv != nil {
+				srv.AddInFlight(1)
+				srv.AddInFlight(-1)
+			}
+		}
+		hammer(200*time.Millisecond,
+			next, next, next, next,
+			func() {
+				bckt.Size()
+				for _, srv := range bckt.Servers() {
+					srv.LastSeen()
+					srv.Drained()
+				}
+			},
+			func() {
+				bckt.AddServer(extra)
+				bckt.RemoveServer(extra.Address().String())
+			},
+			func() {
+				servers := bckt.Servers()
+				servers[0].SetAvailable(false)
+				servers[1].SetState(StateDraining)
+				servers[0].SetAvailable(true)
+				servers[1].SetState(StateActive)
+			},
+			func() {
+				bckt.RemoveStale(time.Hour)
+			},
+			bckt.Healthcheck,
+		)
+		select {
+		case err := <-errs:
+			t.Error("Expected", "a server or no servers error", "got", err)
+		default:
+		}
+		if bckt.Size() < 5 {
+			t.Error("Expected", "at least 5 servers", "got", bckt.Size())
+		}
+	}
+}
+
+func TestConcurrentServe(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	bckt, _ := New(RoundRobin)
+	for i := 0; i < 3; i++ {
+		srv, _ := NewServer(backend.URL)
+		bckt.AddServer(srv)
+	}
+	extra, _ := NewServer(backend.URL)
+	var lock sync.Mutex
+	codes := map[int]int{}
+	serve := func() {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if err := bckt.Serve(rec, req); err != nil {
+			rec.Code = http.StatusServiceUnavailable
+		}
+		lock.Lock()
+		codes[rec.Code]++
+		lock.Unlock()
+	}
+	hammer(200*time.Millisecond,
+		serve, serve, serve, serve,
+		func() {
+			bckt.AddServer(extra)
+			bckt.RemoveServer(extra.Address().String())
+		},
+	)
+	if len(codes) != 1 || codes[http.StatusOK] == 0 {
+		t.Error("Expected", "only successful responses", "got", codes)
+	}
+	if bckt.InFlight() != 0 {
+		t.Error("Expected", 0, "got", bckt.InFlight())
+	}
+}
+
+func benchmarkNext(b *testing.B, algorithm string, changing bool) {
+	bckt := newStressBucket(algorithm, 10)
+	if changing {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			srv := bckt.Servers()[0]
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Millisecond):
+					srv.SetAvailable(!srv.IsAvailable())
+				}
+			}
+		}()
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			srv, err := bckt.Next()
+			if err != nil {
+				b.Fatal(err)
+			}
+			srv.AddInFlight(1)
+			srv.AddInFlight(-1)
+		}
+	})
+}
+
+// BenchmarkNext - server selection throughput, compare with -cpu 1,2,4,8
+func BenchmarkNext(b *testing.B) {
+	b.Run("round-robin", func(b *testing.B) { benchmarkNext(b, RoundRobin, false) })
+	b.Run("least-connections", func(b *testing.B) { benchmarkNext(b, LeastConnections, false) })
+	b.Run("round-robin-changing", func(b *testing.B) { benchmarkNext(b, RoundRobin, true) })
+}
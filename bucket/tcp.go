@@ -0,0 +1,185 @@
+package bucket
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/freundallein/loadbalancer/proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tcpConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_tcp_connections",
+		Help: "The number of open raw TCP connections per server",
+	}, []string{"pool", "server"})
+	tcpConnectFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_tcp_connect_failures_total",
+		Help: "The total failed attempts to connect to server",
+	}, []string{"pool", "server"})
+	tcpConnBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_tcp_connection_bytes",
+		Help:    "The bytes passed through a raw TCP connection, in - from clients, out - to clients",
+		Buckets: prometheus.ExponentialBuckets(64, 8, 9),
+	}, []string{"pool", "server", "direction"})
+	tcpConnDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_tcp_connection_duration_seconds",
+		Help:    "The lifetime of raw TCP connections",
+		Buckets: []float64{0.01, 0.1, 1, 10, 60, 300, 900, 3600, 4 * 3600},
+	}, []string{"pool", "server"})
+)
+
+// tcpMetrics - series of server's raw TCP connections, nil for removed servers
+type tcpMetrics struct {
+	conns           prometheus.Gauge
+	connectFailures prometheus.Counter
+	bytesIn         prometheus.Observer
+	bytesOut        prometheus.Observer
+	duration        prometheus.Observer
+}
+
+func newTCPMetrics(pool, server string) *tcpMetrics {
+	return &tcpMetrics{
+		conns:           tcpConns.WithLabelValues(pool, server),
+		connectFailures: tcpConnectFailures.WithLabelValues(pool, server),
+		bytesIn:         tcpConnBytes.WithLabelValues(pool, server, "in"),
+		bytesOut:        tcpConnBytes.WithLabelValues(pool, server, "out"),
+		duration:        tcpConnDuration.WithLabelValues(pool, server),
+	}
+}
+
+func deleteTCPMetrics(pool, server string) {
+	tcpConns.DeleteLabelValues(pool, server)
+	tcpConnectFailures.DeleteLabelValues(pool, server)
+	tcpConnBytes.DeleteLabelValues(pool, server, "in")
+	tcpConnBytes.DeleteLabelValues(pool, server, "out")
+	tcpConnDuration.DeleteLabelValues(pool, server)
+}
+
+func (tm *tcpMetrics) connectFailed() {
+	if tm != nil {
+		tm.connectFailures.Inc()
+	}
+}
+
+func (tm *tcpMetrics) opened() {
+	if tm != nil {
+		tm.conns.Inc()
+	}
+}
+
+func (tm *tcpMetrics) closed(in, out int64, duration time.Duration) {
+	if tm == nil {
+		return
+	}
+	tm.conns.Dec()
+	tm.bytesIn.Observe(float64(in))
+	tm.bytesOut.Observe(float64(out))
+	tm.duration.Observe(duration.Seconds())
+}
+
+// ServeConn - pipe raw client connection to the next server, connection is closed when done
+// Server failing to connect is marked unavailable and the next one is tried, up to maxAttempts servers.
+func (sb *RoundRobinServerBucket) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	ctx := proxyproto.WithConn(context.Background(), conn)
+	var srv Server
+	var backend net.Conn
+	for attempt := 1; backend == nil; attempt++ {
+		if attempt > sb.settings.maxAttempts {
+			log.Printf("[attempt] %s Too much attempts, refusing\n", conn.RemoteAddr())
+			return ErrServiceUnavailable
+		}
+		next, err := sb.getNextServer()
+		if err != nil {
+			return err
+		}
+		backend, err = sb.dial(ctx, next)
+		if err != nil {
+			sb.metrics(next).conns().connectFailed()
+			log.Printf("[%s] %s\n", next.Address(), err.Error())
+			sb.Eject(next, EjectConnectError)
+			continue
+		}
+		srv = next
+	}
+	address := srv.Address().String()
+	log.Println("[proxy] to", address)
+	atomic.AddInt64(&sb.inFlight, 1)
+	srv.AddInFlight(1)
+	metrics := sb.metrics(srv).conns()
+	metrics.opened()
+	started := time.Now()
+	in, out := pipe(conn, backend, sb.settings.tcpIdleTimeout)
+	duration := time.Since(started)
+	srv.AddInFlight(-1)
+	atomic.AddInt64(&sb.inFlight, -1)
+	metrics.closed(in, out, duration)
+	log.Printf("[tcp] %s - %s in %d out %d bytes %s\n", conn.RemoteAddr(), address, in, out, duration)
+	return nil
+}
+
+// dial - connect to server within connect timeout
+func (sb *RoundRobinServerBucket) dial(ctx context.Context, srv Server) (net.Conn, error) {
+	if sb.settings.connectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, sb.settings.connectTimeout)
+		defer cancel()
+	}
+	return srv.Dial(ctx)
+}
+
+// activeReader - reader, reporting each successful read
+type activeReader struct {
+	net.Conn
+	touch func()
+}
+
+func (ar *activeReader) Read(p []byte) (int, error) {
+	n, err := ar.Conn.Read(p)
+	if n > 0 {
+		ar.touch()
+	}
+	return n, err
+}
+
+// pipe - copy data both ways until both sides are done, returns bytes from and to client
+// Without traffic in either direction for idle timeout both connections are closed.
+func pipe(client, backend net.Conn, idle time.Duration) (int64, int64) {
+	defer client.Close()
+	defer backend.Close()
+	touch := func() {}
+	if idle > 0 {
+		timer := time.AfterFunc(idle, func() {
+			log.Printf("[tcp] %s connection is idle, closing\n", client.RemoteAddr())
+			client.Close()
+			backend.Close()
+		})
+		defer timer.Stop()
+		touch = func() { timer.Reset(idle) }
+	}
+	in := make(chan int64, 1)
+	go func() {
+		in <- copyConn(backend, &activeReader{Conn: client, touch: touch})
+	}()
+	out := copyConn(client, &activeReader{Conn: backend, touch: touch})
+	return <-in, out
+}
+
+// copyConn - copy until EOF and half-close destination, so the other side learns about it
+// On errors both connections are closed, since the other direction can't finish gracefully.
+func copyConn(dst net.Conn, src *activeReader) int64 {
+	n, err := io.Copy(dst, src)
+	if closer, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+		closer.CloseWrite()
+		return n
+	}
+	dst.Close()
+	src.Close()
+	return n
+}
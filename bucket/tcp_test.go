@@ -0,0 +1,136 @@
+package bucket
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoBackend - tcp server prefixing echoed data with its name
+func echoBackend(t *testing.T, name string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(name))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// closedAddress - address nobody listens on
+func closedAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	return ln.Addr().String()
+}
+
+// serveConn - serve client side of a pipe in background, returning error channel
+func serveConn(bckt ServerBucket) (net.Conn, chan error) {
+	client, conn := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- bckt.ServeConn(conn)
+	}()
+	return client, errs
+}
+
+func newTCPBucket(addresses []string, options ...Option) ServerBucket {
+	bckt, _ := New(RoundRobin, options...)
+	for _, addr := range addresses {
+		srv, _ := NewServer("tcp://" + addr)
+		bckt.AddServer(srv)
+		srv.SetAvailable(true)
+	}
+	return bckt
+}
+
+func TestServeConn(t *testing.T) {
+	backend := echoBackend(t, "one")
+	defer backend.Close()
+	bckt := newTCPBucket([]string{backend.Addr().String()})
+	client, errs := serveConn(bckt)
+	client.Write([]byte("ping"))
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "oneping" {
+		t.Error("Expected", "oneping", "got", string(buf), err)
+	}
+	if bckt.InFlight() != 1 {
+		t.Error("Expected", 1, "got", bckt.InFlight())
+	}
+	client.Close()
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Error("Expected", nil, "got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected", "connection done", "got", "timeout")
+	}
+	if bckt.InFlight() != 0 {
+		t.Error("Expected", 0, "got", bckt.InFlight())
+	}
+}
+
+func TestServeConnFailover(t *testing.T) {
+	backend := echoBackend(t, "healthy")
+	defer backend.Close()
+	bckt := newTCPBucket([]string{closedAddress(t), backend.Addr().String()}, WithConnectTimeout(time.Second))
+	client, _ := serveConn(bckt)
+	defer client.Close()
+	buf := make([]byte, 7)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "healthy" {
+		t.Error("Expected", "healthy", "got", string(buf), err)
+	}
+	if bckt.Servers()[0].IsAvailable() {
+		t.Error("Expected", "failing server unavailable", "got", "available")
+	}
+}
+
+func TestServeConnAllFailing(t *testing.T) {
+	bckt := newTCPBucket([]string{closedAddress(t), closedAddress(t)}, WithMaxAttempts(2))
+	client, errs := serveConn(bckt)
+	if err := <-errs; err != ErrServiceUnavailable {
+		t.Error("Expected", ErrServiceUnavailable, "got", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Expected", "client connection closed", "got", err)
+	}
+	client, errs = serveConn(bckt)
+	defer client.Close()
+	if err := <-errs; err != ErrAllServersUnreachable {
+		t.Error("Expected", ErrAllServersUnreachable, "got", err)
+	}
+}
+
+func TestServeConnIdleTimeout(t *testing.T) {
+	backend := echoBackend(t, "one")
+	defer backend.Close()
+	bckt := newTCPBucket([]string{backend.Addr().String()}, WithTCPIdleTimeout(50*time.Millisecond))
+	client, errs := serveConn(bckt)
+	defer client.Close()
+	data, err := ioutil.ReadAll(client)
+	if string(data) != "one" || err != nil {
+		t.Error("Expected", "greeting and close", "got", string(data), err)
+	}
+	select {
+	case <-errs:
+	case <-time.After(2 * time.Second):
+		t.Error("Expected", "idle connection closed", "got", "timeout")
+	}
+}
@@ -0,0 +1,72 @@
+package bucket
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientTLSConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(empty, []byte("no certificates"), 0600)
+	cfg, err := ClientTLSConfig("", "", "", "api.internal", true)
+	if err != nil || cfg.ServerName != "api.internal" || !cfg.InsecureSkipVerify || cfg.RootCAs != nil {
+		t.Error("Expected", "server name and insecure flag", "got", cfg, err)
+	}
+	if _, err := ClientTLSConfig(empty, "", "", "", false); err == nil {
+		t.Error("Expected", ErrInvalidCA, "got", nil)
+	}
+	if _, err := ClientTLSConfig("", "client.crt", "", "", false); err != ErrIncompleteKeyPair {
+		t.Error("Expected", ErrIncompleteKeyPair, "got", err)
+	}
+	if _, err := ClientTLSConfig(filepath.Join(dir, "missing.pem"), "", "", "", false); err == nil {
+		t.Error("Expected", "missing file error", "got", nil)
+	}
+}
+
+func TestServerWithTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer backend.Close()
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}), 0600)
+
+	untrusted, _ := NewServer(backend.URL, WithPingTimeout(time.Second))
+	if untrusted.PingServer() {
+		t.Error("Expected", "failed handshake", "got", "available")
+	}
+	cfg, err := ClientTLSConfig(ca, "", "", "example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := NewServer(backend.URL, WithPingTimeout(time.Second), WithTLS(cfg))
+	if !srv.PingServer() {
+		t.Error("Expected", "available", "got", "failed handshake")
+	}
+	rec := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	srv.ReverseProxy().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Error("Expected", http.StatusNoContent, "got", rec.Code)
+	}
+	wrongName, _ := ClientTLSConfig(ca, "", "", "other.org", false)
+	srv, _ = NewServer(backend.URL, WithPingTimeout(time.Second), WithTLS(wrongName))
+	if srv.PingServer() {
+		t.Error("Expected", "name mismatch", "got", "available")
+	}
+	insecure, _ := ClientTLSConfig("", "", "", "", true)
+	srv, _ = NewServer(backend.URL, WithPingTimeout(time.Second), WithTLS(insecure))
+	if !srv.PingServer() {
+		t.Error("Expected", "available", "got", "failed handshake")
+	}
+}
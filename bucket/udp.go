@@ -0,0 +1,55 @@
+package bucket
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Directions of datagrams, in - from clients, out - to clients
+const (
+	DatagramIn  = "in"
+	DatagramOut = "out"
+)
+
+var (
+	udpPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_udp_packets_total",
+		Help: "The total datagrams passed to and from server, in - from clients, out - to clients",
+	}, []string{"pool", "server", "direction"})
+	udpBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_udp_bytes_total",
+		Help: "The total bytes of datagrams passed to and from server, in - from clients, out - to clients",
+	}, []string{"pool", "server", "direction"})
+)
+
+// udpMetrics - series of server's datagrams, nil for removed servers
+type udpMetrics struct {
+	packets map[string]prometheus.Counter // by direction
+	bytes   map[string]prometheus.Counter // by direction
+}
+
+func newUDPMetrics(pool, server string) *udpMetrics {
+	um := &udpMetrics{packets: map[string]prometheus.Counter{}, bytes: map[string]prometheus.Counter{}}
+	for _, direction := range []string{DatagramIn, DatagramOut} {
+		um.packets[direction] = udpPackets.WithLabelValues(pool, server, direction)
+		um.bytes[direction] = udpBytes.WithLabelValues(pool, server, direction)
+	}
+	return um
+}
+
+func deleteUDPMetrics(pool, server string) {
+	for _, direction := range []string{DatagramIn, DatagramOut} {
+		udpPackets.DeleteLabelValues(pool, server, direction)
+		udpBytes.DeleteLabelValues(pool, server, direction)
+	}
+}
+
+// CountDatagram - count datagram passed to or from server in its series, servers out of bucket aren't counted
+func (sb *RoundRobinServerBucket) CountDatagram(srv Server, direction string, size int) {
+	um := sb.metrics(srv).datagrams()
+	if um == nil || um.packets[direction] == nil {
+		return
+	}
+	um.packets[direction].Inc()
+	um.bytes[direction].Add(float64(size))
+}
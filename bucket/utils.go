@@ -5,6 +5,10 @@ import "net/http"
 const (
 	AttemptsKey = "attempts"
 	RetriesKey  = "retries"
+	DirectorKey = "director"
+
+	bucketKey = "bucket" // bucket serving request, for shared servers' proxy handlers
+	bodyKey   = "body"   // counted request body, shared by all servers trying the request
 )
 
 // GetAttemptsFromContext - extract attempts for request
@@ -22,3 +26,12 @@ func GetRetriesFromContext(r *http.Request) int {
 	}
 	return 0
 }
+
+// GetDirectorFromContext - extract outgoing request modifier
+// It is called after the server is chosen, before request is sent to it
+func GetDirectorFromContext(r *http.Request) func(*http.Request, Server) {
+	if director, ok := r.Context().Value(DirectorKey).(func(*http.Request, Server)); ok {
+		return director
+	}
+	return nil
+}
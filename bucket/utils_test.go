@@ -43,3 +43,17 @@ func TestGetRetriesFromContextFilled(t *testing.T) {
 		t.Error("Expected", expected, "got ", observed)
 	}
 }
+
+func TestGetDirectorFromContext(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, "/test", nil)
+	if GetDirectorFromContext(request) != nil {
+		t.Error("Expected", nil)
+	}
+	called := false
+	director := func(*http.Request, Server) { called = true }
+	ctx := context.WithValue(request.Context(), DirectorKey, director)
+	GetDirectorFromContext(request.WithContext(ctx))(request, nil)
+	if !called {
+		t.Error("Expected", "director to be called")
+	}
+}
@@ -0,0 +1,233 @@
+package bucket
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	upgradedConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_upgraded_connections",
+		Help: "The number of open upgraded (WebSocket) connections per server",
+	}, []string{"pool", "server"})
+	upgradedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_upgraded_bytes_total",
+		Help: "The total bytes passed through upgraded connections, in - from clients, out - to clients",
+	}, []string{"pool", "server", "direction"})
+	upgradedDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_upgraded_connection_duration_seconds",
+		Help:    "The lifetime of upgraded connections",
+		Buckets: []float64{1, 10, 60, 300, 900, 3600, 4 * 3600, 24 * 3600},
+	}, []string{"pool", "server"})
+
+	ErrNotHijacker = errors.New("response writer doesn't support hijacking")
+)
+
+// IsUpgrade - check if request asks to switch protocol, like WebSocket handshake
+func IsUpgrade(r *http.Request) bool {
+	for _, value := range r.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return r.Header.Get("Upgrade") != ""
+			}
+		}
+	}
+	return false
+}
+
+// upgradeMetrics - series of server's upgraded connections, nil for removed servers
+type upgradeMetrics struct {
+	conns    prometheus.Gauge
+	bytesIn  prometheus.Counter
+	bytesOut prometheus.Counter
+	duration prometheus.Observer
+}
+
+func newUpgradeMetrics(pool, server string) *upgradeMetrics {
+	return &upgradeMetrics{
+		conns:    upgradedConns.WithLabelValues(pool, server),
+		bytesIn:  upgradedBytes.WithLabelValues(pool, server, "in"),
+		bytesOut: upgradedBytes.WithLabelValues(pool, server, "out"),
+		duration: upgradedDuration.WithLabelValues(pool, server),
+	}
+}
+
+func deleteUpgradeMetrics(pool, server string) {
+	upgradedConns.DeleteLabelValues(pool, server)
+	upgradedBytes.DeleteLabelValues(pool, server, "in")
+	upgradedBytes.DeleteLabelValues(pool, server, "out")
+	upgradedDuration.DeleteLabelValues(pool, server)
+}
+
+func (um *upgradeMetrics) opened() {
+	if um != nil {
+		um.conns.Inc()
+	}
+}
+
+func (um *upgradeMetrics) closed(duration time.Duration) {
+	if um == nil {
+		return
+	}
+	um.conns.Dec()
+	um.duration.Observe(duration.Seconds())
+}
+
+func (um *upgradeMetrics) transferred(in, out int) {
+	if um == nil {
+		return
+	}
+	um.bytesIn.Add(float64(in))
+	um.bytesOut.Add(float64(out))
+}
+
+// upgradedConn - hijacked client connection, counting bytes and closing itself when idle
+type upgradedConn struct {
+	net.Conn
+	metrics *upgradeMetrics
+	idle    time.Duration
+	timer   *time.Timer // nil without idle timeout
+	started time.Time
+}
+
+func (uc *upgradedConn) Read(p []byte) (int, error) {
+	n, err := uc.Conn.Read(p)
+	if n > 0 {
+		uc.metrics.transferred(n, 0)
+		uc.touch()
+	}
+	return n, err
+}
+
+func (uc *upgradedConn) Write(p []byte) (int, error) {
+	n, err := uc.Conn.Write(p)
+	if n > 0 {
+		uc.metrics.transferred(0, n)
+		uc.touch()
+	}
+	return n, err
+}
+
+// touch - postpone idle timeout
+func (uc *upgradedConn) touch() {
+	if uc.timer != nil {
+		uc.timer.Reset(uc.idle)
+	}
+}
+
+// upgradeWriter - response writer, which tracks connection hijacked by reverse proxy
+type upgradeWriter struct {
+	http.ResponseWriter
+	hijack func() (net.Conn, *bufio.ReadWriter, error)
+}
+
+func (uw *upgradeWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return uw.hijack()
+}
+
+// upgrades - upgraded connections of bucket's servers
+type upgrades struct {
+	lock  sync.Mutex
+	conns map[Server]map[*upgradedConn]bool
+}
+
+// track - wrap writer to register connection, once it is hijacked
+// Returned function unregisters connection, it has to be called when proxying is over.
+func (sb *RoundRobinServerBucket) track(w http.ResponseWriter, srv Server) (http.ResponseWriter, func()) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return w, func() {}
+	}
+	var conn *upgradedConn
+	writer := &upgradeWriter{ResponseWriter: w}
+	writer.hijack = func() (net.Conn, *bufio.ReadWriter, error) {
+		raw, brw, err := hijacker.Hijack()
+		if err != nil {
+			return nil, nil, err
+		}
+		address := srv.Address().String()
+		conn = &upgradedConn{Conn: raw, metrics: sb.metrics(srv).upgrades(), idle: sb.settings.upgradedIdleTimeout, started: time.Now()}
+		if conn.idle > 0 {
+			conn.timer = time.AfterFunc(conn.idle, func() {
+				log.Printf("[upgrade] %s connection from %s is idle, closing\n", address, raw.RemoteAddr())
+				raw.Close()
+			})
+		}
+		sb.upgrades.add(srv, conn)
+		conn.metrics.opened()
+		return conn, brw, nil
+	}
+	return writer, func() {
+		if conn == nil {
+			return
+		}
+		if conn.timer != nil {
+			conn.timer.Stop()
+		}
+		sb.upgrades.remove(srv, conn)
+		conn.metrics.closed(time.Since(conn.started))
+	}
+}
+
+func (u *upgrades) add(srv Server, conn *upgradedConn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.conns == nil {
+		u.conns = map[Server]map[*upgradedConn]bool{}
+	}
+	if u.conns[srv] == nil {
+		u.conns[srv] = map[*upgradedConn]bool{}
+	}
+	u.conns[srv][conn] = true
+}
+
+func (u *upgrades) remove(srv Server, conn *upgradedConn) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.conns[srv], conn)
+	if len(u.conns[srv]) == 0 {
+		delete(u.conns, srv)
+	}
+}
+
+// count - amount of server's upgraded connections
+func (u *upgrades) count(srv Server) int {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return len(u.conns[srv])
+}
+
+// close - close upgraded connections of servers, all of them if none provided
+func (u *upgrades) close(servers ...Server) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	for srv, conns := range u.conns {
+		if len(servers) > 0 && !containsServer(servers, srv) {
+			continue
+		}
+		for conn := range conns {
+			conn.Conn.Close()
+		}
+		if len(conns) > 0 {
+			log.Printf("[upgrade] %d connections to %s closed\n", len(conns), srv.Address())
+		}
+	}
+}
+
+func containsServer(servers []Server, srv Server) bool {
+	for _, s := range servers {
+		if s == srv {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package bucket
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// upgradeBackend - backend switching protocols and echoing everything back
+func upgradeBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsUpgrade(r) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+}
+
+// frontend - balancer in front of bucket
+func frontend(bckt ServerBucket) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := bckt.Serve(w, r); err != nil {
+			WriteError(w, r, err, http.StatusServiceUnavailable)
+		}
+	}))
+}
+
+// dialUpgrade - connect to balancer and switch protocols
+func dialUpgrade(t *testing.T, address string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: lb\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Expected", http.StatusSwitchingProtocols, "got", res.StatusCode)
+	}
+	return conn, reader
+}
+
+// waitFor - poll condition, since connections are tracked by other goroutines
+func waitFor(condition func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func newUpgradeBucket(backend *httptest.Server, options ...Option) (*RoundRobinServerBucket, Server) {
+	bckt, _ := New(RoundRobin, options...)
+	srv, _ := NewServer(backend.URL)
+	bckt.AddServer(srv)
+	return bckt.(*RoundRobinServerBucket), srv
+}
+
+func TestIsUpgrade(t *testing.T) {
+	cases := map[string]bool{
+		"Upgrade":             true,
+		"keep-alive, upgrade": true,
+		"keep-alive":          false,
+	}
+	for connection, expected := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Connection", connection)
+		req.Header.Set("Upgrade", "websocket")
+		if observed := IsUpgrade(req); observed != expected {
+			t.Error("Expected", expected, "got", observed, "for", connection)
+		}
+	}
+}
+
+func TestUpgradedConnectionTracked(t *testing.T) {
+	backend := upgradeBackend()
+	defer backend.Close()
+	bckt, srv := newUpgradeBucket(backend)
+	lb := frontend(bckt)
+	defer lb.Close()
+	conn, reader := dialUpgrade(t, lb.Listener.Addr().String())
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Error("Expected", "ping", "got", string(buf), err)
+	}
+	if count := bckt.upgrades.count(srv); count != 1 {
+		t.Error("Expected", 1, "got", count)
+	}
+	if srv.InFlight() != 1 {
+		t.Error("Expected", "connection in flight", "got", srv.InFlight())
+	}
+	conn.Close()
+	if !waitFor(func() bool { return bckt.upgrades.count(srv) == 0 && srv.InFlight() == 0 }) {
+		t.Error("Expected", "connection untracked after close", "got", bckt.upgrades.count(srv), srv.InFlight())
+	}
+}
+
+func TestUpgradedIdleTimeout(t *testing.T) {
+	backend := upgradeBackend()
+	defer backend.Close()
+	bckt, srv := newUpgradeBucket(backend, WithUpgradedIdleTimeout(50*time.Millisecond))
+	lb := frontend(bckt)
+	defer lb.Close()
+	conn, reader := dialUpgrade(t, lb.Listener.Addr().String())
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("Expected", "idle connection closed", "got", "data")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Error("Expected", "idle connection closed", "got", err)
+	}
+	if !waitFor(func() bool { return bckt.upgrades.count(srv) == 0 }) {
+		t.Error("Expected", "connection untracked after idle timeout", "got", bckt.upgrades.count(srv))
+	}
+}
+
+func TestUpgradedClosedOnRemoval(t *testing.T) {
+	backend := upgradeBackend()
+	defer backend.Close()
+	for _, remove := range []func(*RoundRobinServerBucket, Server){
+		func(bckt *RoundRobinServerBucket, srv Server) { bckt.RemoveServer(srv.Address().String()) },
+		func(bckt *RoundRobinServerBucket, srv Server) { bckt.CloseUpgraded(srv) },
+	} {
+		bckt, srv := newUpgradeBucket(backend, WithCloseUpgraded(true))
+		lb := frontend(bckt)
+		conn, reader := dialUpgrade(t, lb.Listener.Addr().String())
+		if !waitFor(func() bool { return bckt.upgrades.count(srv) == 1 }) {
+			t.Error("Expected", 1, "got", bckt.upgrades.count(srv))
+		}
+		remove(bckt, srv)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := reader.ReadByte(); err == nil {
+			t.Error("Expected", "connection closed", "got", "data")
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Error("Expected", "connection closed", "got", err)
+		}
+		conn.Close()
+		lb.Close()
+	}
+}
+
+func TestUpgradedKeptOnStop(t *testing.T) {
+	backend := upgradeBackend()
+	defer backend.Close()
+	bckt, srv := newUpgradeBucket(backend, WithCloseUpgraded(true))
+	lb := frontend(bckt)
+	defer lb.Close()
+	conn, reader := dialUpgrade(t, lb.Listener.Addr().String())
+	defer conn.Close()
+	if !waitFor(func() bool { return bckt.upgrades.count(srv) == 1 }) {
+		t.Fatal("Expected", 1, "got", bckt.upgrades.count(srv))
+	}
+	bckt.Stop()
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Error("Expected", "no data", "got", "data")
+	} else if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Error("Expected", "connection kept after stop", "got", err)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	bckt, _ := New(LeastConnections)
+	one, _ := NewServer("http://one.local")
+	two, _ := NewServer("http://two.local")
+	three, _ := NewServer("http://three.local")
+	for _, srv := range []Server{one, two, three} {
+		bckt.AddServer(srv)
+		srv.SetAvailable(true)
+	}
+	one.AddInFlight(2)
+	three.AddInFlight(1)
+	rr := bckt.(*RoundRobinServerBucket)
+	for i := 0; i < 3; i++ {
+		if srv, _ := rr.getNextServer(); srv != two {
+			t.Error("Expected", two.Address(), "got", srv.Address())
+		}
+	}
+	two.AddInFlight(1)
+	three.AddInFlight(-1)
+	if srv, _ := rr.getNextServer(); srv != three {
+		t.Error("Expected", three.Address(), "got", srv.Address())
+	}
+	three.AddInFlight(1)
+	one.AddInFlight(-1)
+	seen := map[Server]bool{}
+	for i := 0; i < 3; i++ {
+		srv, _ := rr.getNextServer()
+		seen[srv] = true
+	}
+	if len(seen) != 3 {
+		t.Error("Expected", "equally loaded servers take turns", "got", len(seen))
+	}
+	two.SetAvailable(false)
+	three.SetAvailable(false)
+	one.AddInFlight(5)
+	if srv, _ := rr.getNextServer(); srv != one {
+		t.Error("Expected", one.Address(), "got", srv.Address())
+	}
+}
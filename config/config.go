@@ -0,0 +1,781 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freundallein/loadbalancer/bucket"
+	"github.com/freundallein/loadbalancer/httpserv"
+)
+
+const (
+	DefaultName    = "default"
+	DefaultAddress = ":8000"
+
+	ModeHTTP = "http" // requests routing and proxying
+	ModeTCP  = "tcp"  // raw connections proxying to tcp:// servers
+	ModeUDP  = "udp"  // datagrams proxying to udp:// servers
+
+	defaultHealthCheckPeriod  = 5 * time.Second
+	defaultHealthCheckTimeout = 2 * time.Second
+	defaultHealthCheckWorkers = 10
+	defaultMaxRetries         = 3
+	defaultMaxAttempts        = 3
+	defaultRetryDelay         = 10 * time.Millisecond
+	defaultStaleTimeout       = 60 * time.Minute
+	defaultStaleCheckPeriod   = 60 * time.Second
+	defaultProxyTimeout       = 5 * time.Second
+	defaultTLSMinVersion      = "1.2"
+	defaultCertReloadPeriod   = 10 * time.Second
+	defaultHTTPSPort          = 443
+	defaultConnectTimeout     = 5 * time.Second
+	defaultUDPIdleTimeout     = 30 * time.Second
+	defaultUDPMaxSessions     = 10000
+	defaultShutdownTimeout    = 30 * time.Second
+
+	defaultSubjectHeader     = "X-Client-Cert-Subject"
+	defaultSANHeader         = "X-Client-Cert-San"
+	defaultFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// Config - loadbalancer configuration
+type Config struct {
+	Listeners []Listener `json:"listeners" yaml:"listeners"`
+	Pools     []Pool     `json:"pools" yaml:"pools"`
+	Admin     Admin      `json:"admin" yaml:"admin"`
+	Shutdown  Shutdown   `json:"shutdown" yaml:"shutdown"`
+
+	lines fieldLines // lines of fields in parsed file, for validation errors
+}
+
+// Admin - management endpoints settings
+type Admin struct {
+	ReloadToken string `json:"reload_token" yaml:"reload_token"` // reload endpoint is disabled if empty
+}
+
+// Shutdown - graceful shutdown settings, applied on SIGTERM and SIGINT
+type Shutdown struct {
+	Timeout        Duration `json:"timeout" yaml:"timeout"`                 // in-flight requests deadline, the rest are cut off
+	DrainDelay     Duration `json:"drain_delay" yaml:"drain_delay"`         // healthz fails, while listeners still accept
+	WaitWebSockets bool     `json:"wait_websockets" yaml:"wait_websockets"` // upgraded connections are closed at once if false
+}
+
+// Listener - address to accept requests on and routes to serve them with
+type Listener struct {
+	Name          string         `json:"name" yaml:"name"`
+	Address       string         `json:"address" yaml:"address"` // host:port or unix:///path/to.sock
+	Socket        *Socket        `json:"socket" yaml:"socket"`   // unix socket file settings
+	Mode          string         `json:"mode" yaml:"mode"`       // http, tcp or udp
+	Pool          string         `json:"pool" yaml:"pool"`       // default route, optional with routes
+	Routes        []Route        `json:"routes" yaml:"routes"`
+	RouteMatching string         `json:"route_matching" yaml:"route_matching"` // longest-prefix or first
+	NotFound      *Response      `json:"not_found" yaml:"not_found"`           // when nothing matches
+	Forwarding    *Forwarding    `json:"forwarding" yaml:"forwarding"`
+	ProxyProtocol *ProxyProtocol `json:"proxy_protocol" yaml:"proxy_protocol"`
+	TLS           *TLS           `json:"tls" yaml:"tls"`
+	HTTPSRedirect *HTTPSRedirect `json:"https_redirect" yaml:"https_redirect"` // replaces routing of plain listener
+	H2C           bool           `json:"h2c" yaml:"h2c"`                       // accept HTTP/2 over cleartext
+	UDP           *UDP           `json:"udp" yaml:"udp"`                       // udp mode sessions
+}
+
+// Socket - unix socket file settings
+type Socket struct {
+	Mode string `json:"mode" yaml:"mode"` // octal permissions, like "0660"
+}
+
+// FileMode - parsed socket file permissions
+func (s *Socket) FileMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid permissions %q, expected octal like 0660", s.Mode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// UnixSocket - socket path of unix listener, false for host:port addresses
+func (l *Listener) UnixSocket() (string, bool) {
+	if !strings.HasPrefix(l.Address, bucket.Unix+":") {
+		return "", false
+	}
+	parsed, err := url.Parse(l.Address)
+	if err != nil || parsed.Host != "" {
+		return "", true
+	}
+	return parsed.Path, true
+}
+
+// UDP - client sessions of udp listener
+type UDP struct {
+	IdleTimeout Duration `json:"idle_timeout" yaml:"idle_timeout"` // session expiry without datagrams
+	Balance     string   `json:"balance" yaml:"balance"`           // flow - server per client address, or packet
+	MaxSessions int      `json:"max_sessions" yaml:"max_sessions"` // new clients' datagrams are dropped, when table is full
+}
+
+// TLS - listener's TLS termination settings
+type TLS struct {
+	Certificates []Certificate `json:"certificates" yaml:"certificates"`   // chosen by SNI, the first one is default
+	MinVersion   string        `json:"min_version" yaml:"min_version"`     // 1.0, 1.1, 1.2 or 1.3
+	CipherSuites []string      `json:"cipher_suites" yaml:"cipher_suites"` // IANA names, TLS 1.2 and lower
+	ReloadPeriod Duration      `json:"reload_period" yaml:"reload_period"` // certificate files check period
+	ClientAuth   *ClientAuth   `json:"client_auth" yaml:"client_auth"`
+}
+
+// ClientAuth - client certificates verification
+// Certificates are verified if given, routes or the whole listener may require them
+type ClientAuth struct {
+	CAFile   string            `json:"ca_file" yaml:"ca_file"`
+	Required bool              `json:"required" yaml:"required"` // for every route
+	Headers  ClientCertHeaders `json:"headers" yaml:"headers"`
+}
+
+// ClientCertHeaders - headers to forward verified certificate details in
+type ClientCertHeaders struct {
+	Subject     string `json:"subject" yaml:"subject"`
+	SAN         string `json:"san" yaml:"san"`
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint"` // SHA-256 of certificate
+}
+
+// Certificate - certificate and private key PEM files
+type Certificate struct {
+	CertFile string `json:"cert_file" yaml:"cert_file"`
+	KeyFile  string `json:"key_file" yaml:"key_file"`
+}
+
+// HTTPSRedirect - redirect of plain HTTP requests to HTTPS listener
+type HTTPSRedirect struct {
+	Port   int `json:"port" yaml:"port"`
+	Status int `json:"status" yaml:"status"`
+}
+
+// ProxyProtocol - PROXY protocol header parsing on listener
+type ProxyProtocol struct {
+	TrustedSources []string `json:"trusted_sources" yaml:"trusted_sources"` // CIDRs or plain addresses, required
+	Timeout        Duration `json:"timeout" yaml:"timeout"`                 // header read timeout
+}
+
+// Forwarding - client address derivation from forwarding headers
+type Forwarding struct {
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies"` // CIDRs or plain addresses
+	StripUntrusted bool     `json:"strip_untrusted" yaml:"strip_untrusted"` // drop headers of untrusted peers
+}
+
+// Route - request matching rules and pool to serve matched requests
+type Route struct {
+	Name        string            `json:"name" yaml:"name"`
+	Host        string            `json:"host" yaml:"host"` // exact or wildcard like "*.example.com"
+	PathPrefix  string            `json:"path_prefix" yaml:"path_prefix"`
+	PathRegex   string            `json:"path_regex" yaml:"path_regex"`
+	Methods     []string          `json:"methods" yaml:"methods"`
+	Headers     map[string]string `json:"headers" yaml:"headers"` // "*" requires presence only
+	Rewrite     *Rewrite          `json:"rewrite" yaml:"rewrite"`
+	HeaderRules *HeaderRules      `json:"header_rules" yaml:"header_rules"` // applied after pool's ones
+	Pool        string            `json:"pool" yaml:"pool"`
+
+	RequireClientCert bool `json:"require_client_cert" yaml:"require_client_cert"` // listener's tls.client_auth is required
+}
+
+// HeaderRules - request headers toward backends and response headers toward clients
+// Values may use {client_ip}, {request_id}, {backend}, {route} and {host} variables
+type HeaderRules struct {
+	Request  Headers `json:"request" yaml:"request"`
+	Response Headers `json:"response" yaml:"response"`
+}
+
+// Headers - header changes, applied in order: rename, remove, set, add
+type Headers struct {
+	Rename map[string]string `json:"rename" yaml:"rename"`
+	Remove []string          `json:"remove" yaml:"remove"`
+	Set    map[string]string `json:"set" yaml:"set"`
+	Add    map[string]string `json:"add" yaml:"add"`
+}
+
+// Rewrite - URL rewriting rules, applied before proxying
+// Order: strip prefix, regex replace, add prefix, query changes
+type Rewrite struct {
+	StripPrefix string            `json:"strip_prefix" yaml:"strip_prefix"`
+	AddPrefix   string            `json:"add_prefix" yaml:"add_prefix"`
+	Regex       string            `json:"regex" yaml:"regex"`
+	Replacement string            `json:"replacement" yaml:"replacement"` // may refer groups like $1
+	QueryAdd    map[string]string `json:"query_add" yaml:"query_add"`
+	QueryRemove []string          `json:"query_remove" yaml:"query_remove"`
+}
+
+// Response - static response settings
+type Response struct {
+	Status int    `json:"status" yaml:"status"`
+	Body   string `json:"body" yaml:"body"`
+}
+
+// Pool - named servers bucket settings
+type Pool struct {
+	Name             string       `json:"name" yaml:"name"`
+	Algorithm        string       `json:"algorithm" yaml:"algorithm"`
+	Servers          []string     `json:"servers" yaml:"servers"`
+	Kubernetes       *Kubernetes  `json:"kubernetes" yaml:"kubernetes"`
+	HeaderRules      *HeaderRules `json:"header_rules" yaml:"header_rules"`
+	ProxyProtocol    string       `json:"proxy_protocol" yaml:"proxy_protocol"` // v1 or v2 header sent to servers
+	TLS              *UpstreamTLS `json:"tls" yaml:"tls"`                       // settings toward https servers
+	Protocol         string       `json:"protocol" yaml:"protocol"`             // http1, h2 or h2c, HTTP/2 is negotiated with https servers if empty
+	HealthCheck      HealthCheck  `json:"health_check" yaml:"health_check"`
+	Retry            Retry        `json:"retry" yaml:"retry"`
+	WebSocket        WebSocket    `json:"websocket" yaml:"websocket"`
+	TCP              TCP          `json:"tcp" yaml:"tcp"`
+	StaleTimeout     Duration     `json:"stale_timeout" yaml:"stale_timeout"`
+	StaleCheckPeriod Duration     `json:"stale_check_period" yaml:"stale_check_period"`
+}
+
+// UpstreamTLS - TLS settings toward servers, health checks use them as well
+type UpstreamTLS struct {
+	CAFile             string `json:"ca_file" yaml:"ca_file"`         // system roots if empty
+	CertFile           string `json:"cert_file" yaml:"cert_file"`     // client certificate
+	KeyFile            string `json:"key_file" yaml:"key_file"`       // client certificate key
+	ServerName         string `json:"server_name" yaml:"server_name"` // SNI and verified name, server's host if empty
+	InsecureSkipVerify bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+}
+
+// ClientTLS - TLS settings for servers transport, nil if not configured
+func (pool *Pool) ClientTLS() (*tls.Config, error) {
+	if pool.TLS == nil {
+		return nil, nil
+	}
+	t := pool.TLS
+	return bucket.ClientTLSConfig(t.CAFile, t.CertFile, t.KeyFile, t.ServerName, t.InsecureSkipVerify)
+}
+
+// Kubernetes - EndpointSlice discovery settings
+type Kubernetes struct {
+	Service  string `json:"service" yaml:"service"`     // "namespace/name" or "name"
+	PortName string `json:"port_name" yaml:"port_name"` // first endpoint port if empty
+}
+
+// HealthCheck - server availability checks settings
+type HealthCheck struct {
+	Period  Duration  `json:"period" yaml:"period"`
+	Timeout Duration  `json:"timeout" yaml:"timeout"`
+	Jitter  *Duration `json:"jitter" yaml:"jitter"`   // random shift of every server's check either way, nil means 10% of period, 0 disables
+	Workers int       `json:"workers" yaml:"workers"` // concurrent checks
+	// new servers are available until their first check, unavailable otherwise
+	AssumeAvailable bool `json:"assume_available" yaml:"assume_available"`
+}
+
+// Retry - failed request handling settings
+type Retry struct {
+	MaxRetries  *int     `json:"max_retries" yaml:"max_retries"` // nil means default, 0 disables retries
+	MaxAttempts int      `json:"max_attempts" yaml:"max_attempts"`
+	Delay       Duration `json:"delay" yaml:"delay"`
+}
+
+// WebSocket - upgraded connections settings
+type WebSocket struct {
+	IdleTimeout    Duration `json:"idle_timeout" yaml:"idle_timeout"`         // never closed for inactivity if zero
+	CloseOnRemoval bool     `json:"close_on_removal" yaml:"close_on_removal"` // close connections of servers removed from pool
+}
+
+// TCP - raw connections settings for tcp listeners
+type TCP struct {
+	ConnectTimeout Duration `json:"connect_timeout" yaml:"connect_timeout"` // the next server is tried on failure
+	IdleTimeout    Duration `json:"idle_timeout" yaml:"idle_timeout"`       // never closed for inactivity if zero
+}
+
+// ProxyProtocolVersion - PROXY protocol version to send, 0 if disabled or unknown
+func (pool *Pool) ProxyProtocolVersion() int {
+	switch pool.ProxyProtocol {
+	case "v1":
+		return 1
+	case "v2":
+		return 2
+	}
+	return 0
+}
+
+// Default - configuration, used when no file is provided
+func Default() *Config {
+	return &Config{
+		Listeners: []Listener{{Name: DefaultName, Address: DefaultAddress, Pool: DefaultName}},
+		Pools:     []Pool{{Name: DefaultName}},
+	}
+}
+
+// SetDefaults - fill omitted settings
+func (cfg *Config) SetDefaults() {
+	if cfg.Shutdown.Timeout == 0 {
+		cfg.Shutdown.Timeout = Duration(defaultShutdownTimeout)
+	}
+	for i := range cfg.Pools {
+		pool := &cfg.Pools[i]
+		if pool.Algorithm == "" {
+			pool.Algorithm = bucket.RoundRobin
+		}
+		if pool.HealthCheck.Period == 0 {
+			pool.HealthCheck.Period = Duration(defaultHealthCheckPeriod)
+		}
+		if pool.HealthCheck.Timeout == 0 {
+			pool.HealthCheck.Timeout = Duration(defaultHealthCheckTimeout)
+		}
+		if pool.HealthCheck.Jitter == nil {
+			jitter := pool.HealthCheck.Period / 10
+			pool.HealthCheck.Jitter = &jitter
+		}
+		if pool.HealthCheck.Workers == 0 {
+			pool.HealthCheck.Workers = defaultHealthCheckWorkers
+		}
+		if pool.Retry.MaxRetries == nil {
+			retries := defaultMaxRetries
+			pool.Retry.MaxRetries = &retries
+		}
+		if pool.Retry.MaxAttempts == 0 {
+			pool.Retry.MaxAttempts = defaultMaxAttempts
+		}
+		if pool.Retry.Delay == 0 {
+			pool.Retry.Delay = Duration(defaultRetryDelay)
+		}
+		if pool.StaleTimeout == 0 {
+			pool.StaleTimeout = Duration(defaultStaleTimeout)
+		}
+		if pool.StaleCheckPeriod == 0 {
+			pool.StaleCheckPeriod = Duration(defaultStaleCheckPeriod)
+		}
+		if pool.TCP.ConnectTimeout == 0 {
+			pool.TCP.ConnectTimeout = Duration(defaultConnectTimeout)
+		}
+	}
+	for i := range cfg.Listeners {
+		listener := &cfg.Listeners[i]
+		if listener.Pool == "" && len(listener.Routes) == 0 && len(cfg.Pools) == 1 {
+			listener.Pool = cfg.Pools[0].Name
+		}
+		if listener.ProxyProtocol != nil && listener.ProxyProtocol.Timeout == 0 {
+			listener.ProxyProtocol.Timeout = Duration(defaultProxyTimeout)
+		}
+		if listener.TLS != nil {
+			if listener.TLS.MinVersion == "" {
+				listener.TLS.MinVersion = defaultTLSMinVersion
+			}
+			if listener.TLS.ReloadPeriod == 0 {
+				listener.TLS.ReloadPeriod = Duration(defaultCertReloadPeriod)
+			}
+			if auth := listener.TLS.ClientAuth; auth != nil {
+				if auth.Headers.Subject == "" {
+					auth.Headers.Subject = defaultSubjectHeader
+				}
+				if auth.Headers.SAN == "" {
+					auth.Headers.SAN = defaultSANHeader
+				}
+				if auth.Headers.Fingerprint == "" {
+					auth.Headers.Fingerprint = defaultFingerprintHeader
+				}
+			}
+		}
+		if listener.HTTPSRedirect != nil {
+			if listener.HTTPSRedirect.Port == 0 {
+				listener.HTTPSRedirect.Port = defaultHTTPSPort
+			}
+			if listener.HTTPSRedirect.Status == 0 {
+				listener.HTTPSRedirect.Status = http.StatusPermanentRedirect
+			}
+		}
+		if listener.Mode == "" {
+			listener.Mode = ModeHTTP
+		}
+		if listener.Mode == ModeUDP {
+			if listener.UDP == nil {
+				listener.UDP = &UDP{}
+			}
+			if listener.UDP.IdleTimeout == 0 {
+				listener.UDP.IdleTimeout = Duration(defaultUDPIdleTimeout)
+			}
+			if listener.UDP.Balance == "" {
+				listener.UDP.Balance = "flow"
+			}
+			if listener.UDP.MaxSessions == 0 {
+				listener.UDP.MaxSessions = defaultUDPMaxSessions
+			}
+		}
+		if listener.RouteMatching == "" {
+			listener.RouteMatching = "longest-prefix"
+		}
+		for j := range listener.Routes {
+			route := &listener.Routes[j]
+			if route.Name == "" {
+				route.Name = fmt.Sprintf("%s-%d", route.Pool, j)
+			}
+		}
+	}
+}
+
+// Validate - check configuration against schema
+// Expects defaults to be set
+func (cfg *Config) Validate() error {
+	var errs Errors
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, &Error{Line: cfg.lines.line(field), Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+	if len(cfg.Listeners) == 0 {
+		fail("listeners", "at least one listener is required")
+	}
+	if len(cfg.Pools) == 0 {
+		fail("pools", "at least one pool is required")
+	}
+	if cfg.Shutdown.Timeout < 0 {
+		fail("shutdown.timeout", "must be positive")
+	}
+	if cfg.Shutdown.DrainDelay < 0 {
+		fail("shutdown.drain_delay", "must be positive")
+	}
+	pools := map[string]bool{}
+	rawPools := map[string]string{} // pools of tcp or udp servers, with the scheme
+	for i, pool := range cfg.Pools {
+		field := fmt.Sprintf("pools[%d]", i)
+		if pool.Name == "" {
+			fail(field+".name", "is required")
+		} else if pools[pool.Name] {
+			fail(field+".name", "duplicate pool %q", pool.Name)
+		}
+		pools[pool.Name] = true
+		if _, err := bucket.New(pool.Algorithm); err != nil {
+			fail(field+".algorithm", "%s: %q", err.Error(), pool.Algorithm)
+		}
+		if len(pool.Servers) == 0 && pool.Kubernetes == nil {
+			fail(field+".servers", "no addresses provided")
+		}
+		servers := map[string]int{}
+		raw := map[string]int{}
+		for j, addr := range pool.Servers {
+			serverField := fmt.Sprintf("%s.servers[%d]", field, j)
+			srv, err := bucket.NewServer(addr)
+			if err != nil {
+				fail(serverField, "%s: %q", err.Error(), addr)
+				continue
+			}
+			if scheme := srv.Address().Scheme; scheme == bucket.TCP || scheme == bucket.UDP {
+				raw[scheme]++
+				if srv.Address().Port() == "" {
+					fail(serverField, "%s server requires port: %q", scheme, addr)
+				}
+			}
+			normalized := srv.Address().String()
+			if first, ok := servers[normalized]; ok {
+				fail(serverField, "duplicate server %q, already listed as servers[%d]", addr, first)
+				continue
+			}
+			servers[normalized] = j
+		}
+		if len(raw) > 0 {
+			scheme := bucket.TCP
+			if raw[bucket.UDP] > 0 {
+				scheme = bucket.UDP
+			}
+			rawPools[pool.Name] = scheme
+			if len(raw) > 1 || raw[scheme] < len(pool.Servers) {
+				fail(field+".servers", "%s servers can't be mixed with other ones", scheme)
+			}
+			if pool.Protocol != "" || pool.TLS != nil || pool.HeaderRules != nil || pool.Kubernetes != nil {
+				fail(field+".servers", "%s servers can't be used with protocol, tls, header_rules or kubernetes", scheme)
+			}
+			if scheme == bucket.UDP && pool.ProxyProtocol != "" {
+				fail(field+".proxy_protocol", "can't be used with udp servers")
+			}
+		}
+		if pool.TCP.ConnectTimeout < 0 {
+			fail(field+".tcp.connect_timeout", "must be positive")
+		}
+		if pool.TCP.IdleTimeout < 0 {
+			fail(field+".tcp.idle_timeout", "must be positive")
+		}
+		if pool.Kubernetes != nil && pool.Kubernetes.Service == "" {
+			fail(field+".kubernetes.service", "is required")
+		}
+		if pool.HealthCheck.Period < 0 {
+			fail(field+".health_check.period", "must be positive")
+		}
+		if pool.HealthCheck.Timeout < 0 {
+			fail(field+".health_check.timeout", "must be positive")
+		}
+		if *pool.HealthCheck.Jitter < 0 || *pool.HealthCheck.Jitter >= pool.HealthCheck.Period {
+			fail(field+".health_check.jitter", "must not be negative and less than period")
+		}
+		if pool.HealthCheck.Workers < 0 {
+			fail(field+".health_check.workers", "must be positive")
+		}
+		if *pool.Retry.MaxRetries < 0 {
+			fail(field+".retry.max_retries", "must not be negative")
+		}
+		if pool.Retry.MaxAttempts < 0 {
+			fail(field+".retry.max_attempts", "must be positive")
+		}
+		if pool.Retry.Delay < 0 {
+			fail(field+".retry.delay", "must be positive")
+		}
+		if pool.WebSocket.IdleTimeout < 0 {
+			fail(field+".websocket.idle_timeout", "must be positive")
+		}
+		if pool.StaleTimeout < Duration(time.Minute) {
+			fail(field+".stale_timeout", "must be at least 1m")
+		}
+		if pool.StaleCheckPeriod < 0 {
+			fail(field+".stale_check_period", "must be positive")
+		}
+		if _, err := pool.ClientTLS(); err != nil {
+			fail(field+".tls", "%s", err.Error())
+		}
+		switch pool.Protocol {
+		case "", bucket.HTTP1:
+		case bucket.H2, bucket.H2C:
+			scheme := "https"
+			if pool.Protocol == bucket.H2C {
+				scheme = "http"
+			}
+			for j, addr := range pool.Servers {
+				parsed, err := url.Parse(addr)
+				if err == nil && parsed.Scheme == bucket.Unix && pool.Protocol == bucket.H2C {
+					continue
+				}
+				if err == nil && parsed.Scheme != scheme {
+					fail(fmt.Sprintf("%s.servers[%d]", field, j), "%s protocol requires %s scheme: %q", pool.Protocol, scheme, addr)
+				}
+			}
+			if pool.ProxyProtocol != "" {
+				fail(field+".proxy_protocol", "can't be used with %s protocol, connections are shared", pool.Protocol)
+			}
+		default:
+			fail(field+".protocol", "%s: %q", bucket.ErrInvalidProtocol.Error(), pool.Protocol)
+		}
+		if pool.ProxyProtocol != "" && pool.ProxyProtocolVersion() == 0 {
+			fail(field+".proxy_protocol", "unknown version %q, expected v1 or v2", pool.ProxyProtocol)
+		}
+	}
+	listeners := map[string]bool{}
+	for i, listener := range cfg.Listeners {
+		field := fmt.Sprintf("listeners[%d]", i)
+		if listener.Name != "" && listeners[listener.Name] {
+			fail(field+".name", "duplicate listener %q", listener.Name)
+		}
+		listeners[listener.Name] = true
+		path, unix := listener.UnixSocket()
+		if listener.Address == "" {
+			fail(field+".address", "is required")
+		} else if unix {
+			if path == "" {
+				fail(field+".address", "unix socket address must have path and no host: %q", listener.Address)
+			}
+			if listener.Mode == ModeUDP {
+				fail(field+".address", "unix sockets are supported in http and tcp modes")
+			}
+			for j, other := range cfg.Listeners[:i] {
+				if other.Address == listener.Address {
+					fail(field+".address", "%q conflicts with listeners[%d] %q", listener.Address, j, other.Address)
+				}
+			}
+		} else if _, _, err := net.SplitHostPort(listener.Address); err != nil {
+			fail(field+".address", "%s", err.Error())
+		} else {
+			for j, other := range cfg.Listeners[:i] {
+				udp := listener.Mode == ModeUDP || other.Mode == ModeUDP
+				if conflicting(listener.Address, other.Address) && (!udp || listener.Mode == other.Mode) {
+					fail(field+".address", "%q conflicts with listeners[%d] %q", listener.Address, j, other.Address)
+				}
+			}
+		}
+		if listener.Socket != nil {
+			if !unix {
+				fail(field+".socket", "is allowed for unix socket addresses only")
+			}
+			if _, err := listener.Socket.FileMode(); err != nil {
+				fail(field+".socket.mode", "%s", err.Error())
+			}
+		}
+		if listener.Pool == "" && len(listener.Routes) == 0 && listener.HTTPSRedirect == nil {
+			fail(field+".pool", "is required without routes")
+		} else if listener.Pool != "" && !pools[listener.Pool] {
+			fail(field+".pool", "unknown pool %q", listener.Pool)
+		}
+		switch listener.Mode {
+		case ModeHTTP:
+			if scheme := rawPools[listener.Pool]; scheme != "" {
+				fail(field+".pool", "pool %q of %s servers requires %s mode", listener.Pool, scheme, scheme)
+			}
+		case ModeTCP, ModeUDP:
+			if listener.Pool != "" && pools[listener.Pool] && rawPools[listener.Pool] != listener.Mode {
+				fail(field+".pool", "%s mode requires pool of %s servers, %q has none", listener.Mode, listener.Mode, listener.Pool)
+			}
+			if len(listener.Routes) > 0 || listener.TLS != nil || listener.HTTPSRedirect != nil || listener.H2C || listener.Forwarding != nil {
+				fail(field+".mode", "%s listener can't have routes, tls, https_redirect, h2c or forwarding", listener.Mode)
+			}
+			if listener.Mode == ModeUDP && listener.ProxyProtocol != nil {
+				fail(field+".proxy_protocol", "is not supported in udp mode")
+			}
+		default:
+			fail(field+".mode", "unknown mode %q, expected http, tcp or udp", listener.Mode)
+		}
+		if udp := listener.UDP; udp != nil {
+			if listener.Mode != ModeUDP {
+				fail(field+".udp", "is allowed in udp mode only")
+			}
+			if udp.IdleTimeout < 0 {
+				fail(field+".udp.idle_timeout", "must be positive")
+			}
+			if udp.MaxSessions < 0 {
+				fail(field+".udp.max_sessions", "must be positive")
+			}
+			if udp.Balance != "flow" && udp.Balance != "packet" {
+				fail(field+".udp.balance", "unknown mode %q, expected flow or packet", udp.Balance)
+			}
+		}
+		if listener.RouteMatching != "longest-prefix" && listener.RouteMatching != "first" {
+			fail(field+".route_matching", "unknown mode %q, expected longest-prefix or first", listener.RouteMatching)
+		}
+		if listener.NotFound != nil && listener.NotFound.Status != 0 && http.StatusText(listener.NotFound.Status) == "" {
+			fail(field+".not_found.status", "invalid status %d", listener.NotFound.Status)
+		}
+		if listener.Forwarding != nil {
+			for j, proxy := range listener.Forwarding.TrustedProxies {
+				if !validProxy(proxy) {
+					fail(fmt.Sprintf("%s.forwarding.trusted_proxies[%d]", field, j), "invalid CIDR or address %q", proxy)
+				}
+			}
+		}
+		if pp := listener.ProxyProtocol; pp != nil {
+			if len(pp.TrustedSources) == 0 {
+				fail(field+".proxy_protocol.trusted_sources", "required, any client could spoof its address otherwise")
+			}
+			for j, source := range pp.TrustedSources {
+				if !validProxy(source) {
+					fail(fmt.Sprintf("%s.proxy_protocol.trusted_sources[%d]", field, j), "invalid CIDR or address %q", source)
+				}
+			}
+			if pp.Timeout < 0 {
+				fail(field+".proxy_protocol.timeout", "must be positive")
+			}
+		}
+		if listener.TLS != nil {
+			validateTLS(field+".tls", listener.TLS, fail)
+		}
+		if listener.H2C && listener.TLS != nil {
+			fail(field+".h2c", "is allowed on plain listeners only, TLS listeners negotiate HTTP/2")
+		}
+		if redirect := listener.HTTPSRedirect; redirect != nil {
+			if listener.TLS != nil {
+				fail(field+".https_redirect", "is allowed on plain listeners only")
+			}
+			if redirect.Port < 1 || redirect.Port > 65535 {
+				fail(field+".https_redirect.port", "invalid port %d", redirect.Port)
+			}
+			switch redirect.Status {
+			case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+			default:
+				fail(field+".https_redirect.status", "invalid redirect status %d", redirect.Status)
+			}
+		}
+		routes := map[string]bool{}
+		for j, route := range listener.Routes {
+			routeField := fmt.Sprintf("%s.routes[%d]", field, j)
+			if routes[route.Name] {
+				fail(routeField+".name", "duplicate route %q", route.Name)
+			}
+			routes[route.Name] = true
+			if route.Pool == "" {
+				fail(routeField+".pool", "is required")
+			} else if !pools[route.Pool] {
+				fail(routeField+".pool", "unknown pool %q", route.Pool)
+			} else if scheme := rawPools[route.Pool]; scheme != "" {
+				fail(routeField+".pool", "pool %q of %s servers requires %s mode", route.Pool, scheme, scheme)
+			}
+			if route.RequireClientCert && (listener.TLS == nil || listener.TLS.ClientAuth == nil) {
+				fail(routeField+".require_client_cert", "requires listener's tls.client_auth")
+			}
+			if route.Host != "" && strings.Contains(strings.TrimPrefix(route.Host, "*."), "*") {
+				fail(routeField+".host", "wildcard is allowed only as the first label: %q", route.Host)
+			}
+			if route.PathPrefix != "" && !strings.HasPrefix(route.PathPrefix, "/") {
+				fail(routeField+".path_prefix", "must start with /")
+			}
+			if route.PathRegex != "" {
+				if _, err := regexp.Compile(route.PathRegex); err != nil {
+					fail(routeField+".path_regex", "%s", err.Error())
+				}
+			}
+			if rewrite := route.Rewrite; rewrite != nil {
+				if rewrite.StripPrefix != "" && !strings.HasPrefix(rewrite.StripPrefix, "/") {
+					fail(routeField+".rewrite.strip_prefix", "must start with /")
+				}
+				if rewrite.AddPrefix != "" && !strings.HasPrefix(rewrite.AddPrefix, "/") {
+					fail(routeField+".rewrite.add_prefix", "must start with /")
+				}
+				if rewrite.Regex != "" {
+					if _, err := regexp.Compile(rewrite.Regex); err != nil {
+						fail(routeField+".rewrite.regex", "%s", err.Error())
+					}
+				} else if rewrite.Replacement != "" {
+					fail(routeField+".rewrite.replacement", "requires regex")
+				}
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateTLS - check TLS settings, certificates are loaded to be sure they are usable
+func validateTLS(field string, settings *TLS, fail func(field, format string, args ...interface{})) {
+	if len(settings.Certificates) == 0 {
+		fail(field+".certificates", "at least one certificate is required")
+	}
+	for i, cert := range settings.Certificates {
+		certField := fmt.Sprintf("%s.certificates[%d]", field, i)
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			fail(certField, "cert_file and key_file are required")
+			continue
+		}
+		if _, err := tls.LoadX509KeyPair(cert.CertFile, cert.KeyFile); err != nil {
+			fail(certField, "%s", err.Error())
+		}
+	}
+	if _, err := httpserv.ParseTLSVersion(settings.MinVersion); err != nil {
+		fail(field+".min_version", "%s", err.Error())
+	}
+	if _, err := httpserv.ParseCipherSuites(settings.CipherSuites); err != nil {
+		fail(field+".cipher_suites", "%s", err.Error())
+	}
+	if settings.ReloadPeriod < 0 {
+		fail(field+".reload_period", "must be positive")
+	}
+	if auth := settings.ClientAuth; auth != nil {
+		if auth.CAFile == "" {
+			fail(field+".client_auth.ca_file", "is required")
+		} else if _, err := httpserv.ClientCAs(auth.CAFile); err != nil {
+			fail(field+".client_auth.ca_file", "%s", err.Error())
+		}
+	}
+}
+
+// validProxy - check if trusted proxy is a CIDR or plain IP address
+func validProxy(proxy string) bool {
+	if _, _, err := net.ParseCIDR(proxy); err == nil {
+		return true
+	}
+	return net.ParseIP(proxy) != nil
+}
+
+// conflicting - check if two listener addresses can't be bound together
+// Wildcard host conflicts with any host on the same port
+func conflicting(a, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB || portA == "0" {
+		return false
+	}
+	wildcard := func(host string) bool {
+		return host == "" || host == "0.0.0.0" || host == "::"
+	}
+	return hostA == hostB || wildcard(hostA) || wildcard(hostB)
+}
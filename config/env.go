@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ConfigKey       = "CONFIG"
+	serversEnvKey   = "ADDRS"
+	portKey         = "PORT"
+	staleTimeoutKey = "STALE_TIMEOUT"
+	k8sServiceKey   = "K8S_SERVICE"
+	k8sPortNameKey  = "K8S_PORT_NAME"
+	reloadTokenKey  = "RELOAD_TOKEN"
+)
+
+// GetEnv - string env variable with fallback
+func GetEnv(key string, fallback string) (string, error) {
+	if value := os.Getenv(key); value != "" {
+		return value, nil
+	}
+	return fallback, nil
+}
+
+// GetIntEnv - integer env variable with fallback
+func GetIntEnv(key string, fallback int) (int, error) {
+	if v := os.Getenv(key); v != "" {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fallback, err
+		}
+		return int(i), nil
+	}
+	return fallback, nil
+}
+
+// FromEnv - read file from CONFIG or use defaults, then apply env overrides
+func FromEnv() (*Config, error) {
+	path, err := GetEnv(ConfigKey, "")
+	if err != nil {
+		return nil, err
+	}
+	cfg := Default()
+	if path != "" {
+		if cfg, err = Read(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := ApplyEnv(cfg); err != nil {
+		return nil, err
+	}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// ApplyEnv - override first listener and first pool with env variables
+// PORT sets listener port, ADDRS, STALE_TIMEOUT (minutes) and K8S_* set pool's ones
+// RELOAD_TOKEN enables reload endpoint
+func ApplyEnv(cfg *Config) error {
+	port, err := GetIntEnv(portKey, 0)
+	if err != nil {
+		return fmt.Errorf("%s: %s", portKey, err.Error())
+	}
+	addresses, _ := GetEnv(serversEnvKey, "")
+	staleTimeout, err := GetIntEnv(staleTimeoutKey, 0)
+	if err != nil {
+		return fmt.Errorf("%s: %s", staleTimeoutKey, err.Error())
+	}
+	k8sService, _ := GetEnv(k8sServiceKey, "")
+	k8sPortName, _ := GetEnv(k8sPortNameKey, "")
+	reloadToken, _ := GetEnv(reloadTokenKey, "")
+
+	if len(cfg.Pools) == 0 {
+		cfg.Pools = []Pool{{Name: DefaultName}}
+	}
+	if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []Listener{{Name: DefaultName, Address: DefaultAddress, Pool: cfg.Pools[0].Name}}
+	}
+	if port != 0 {
+		cfg.Listeners[0].Address = fmt.Sprintf(":%d", port)
+	}
+	pool := &cfg.Pools[0]
+	if addresses != "" {
+		pool.Servers = []string{}
+		for _, addr := range strings.Split(addresses, ",") {
+			if addr != "" {
+				pool.Servers = append(pool.Servers, addr)
+			}
+		}
+	}
+	if staleTimeout != 0 {
+		pool.StaleTimeout = Duration(time.Duration(staleTimeout) * time.Minute)
+	}
+	if k8sService != "" {
+		pool.Kubernetes = &Kubernetes{Service: k8sService, PortName: k8sPortName}
+	}
+	if reloadToken != "" {
+		cfg.Admin.ReloadToken = reloadToken
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func setEnv(t *testing.T, env map[string]string) func() {
+	previous := map[string]string{}
+	for key, value := range env {
+		previous[key] = os.Getenv(key)
+		os.Setenv(key, value)
+	}
+	return func() {
+		for key, value := range previous {
+			os.Setenv(key, value)
+		}
+	}
+}
+
+func TestGetIntEnvInvalid(t *testing.T) {
+	defer setEnv(t, map[string]string{portKey: "port"})()
+	observed, err := GetIntEnv(portKey, 8000)
+	if err == nil {
+		t.Error("Expected", "error", "got", nil)
+	}
+	if observed != 8000 {
+		t.Error("Expected", 8000, "got", observed)
+	}
+}
+
+func TestFromEnvDefaults(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		ConfigKey:       "",
+		portKey:         "9000",
+		serversEnvKey:   "http://one:8000,http://two:8000",
+		staleTimeoutKey: "2",
+		k8sServiceKey:   "",
+	})()
+	cfg, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listeners[0].Address != ":9000" {
+		t.Error("Expected", ":9000", "got", cfg.Listeners[0].Address)
+	}
+	if len(cfg.Pools[0].Servers) != 2 {
+		t.Error("Expected", 2, "got", len(cfg.Pools[0].Servers))
+	}
+	if cfg.Pools[0].StaleTimeout.Duration() != 2*time.Minute {
+		t.Error("Expected", 2*time.Minute, "got", cfg.Pools[0].StaleTimeout)
+	}
+}
+
+func TestFromEnvNoAddresses(t *testing.T) {
+	defer setEnv(t, map[string]string{ConfigKey: "", serversEnvKey: "", k8sServiceKey: ""})()
+	if _, err := FromEnv(); err == nil {
+		t.Error("Expected", "error", "got", nil)
+	}
+}
+
+func TestApplyEnvKubernetes(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		portKey:         "",
+		serversEnvKey:   "",
+		staleTimeoutKey: "",
+		k8sServiceKey:   "prod/web",
+		k8sPortNameKey:  "http",
+	})()
+	cfg := &Config{}
+	ApplyEnv(cfg)
+	if cfg.Pools[0].Kubernetes == nil || cfg.Pools[0].Kubernetes.Service != "prod/web" {
+		t.Error("Expected", "prod/web", "got", cfg.Pools[0].Kubernetes)
+	}
+	if cfg.Listeners[0].Address != DefaultAddress {
+		t.Error("Expected", DefaultAddress, "got", cfg.Listeners[0].Address)
+	}
+}
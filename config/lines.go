@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fieldLines - file lines of configuration fields, by path like "pools[1].health_check.jitter"
+type fieldLines map[string]int
+
+// line - line of field, the closest parent's one if the field isn't in file, 0 if unknown
+func (fl fieldLines) line(field string) int {
+	for field != "" {
+		if line, ok := fl[field]; ok {
+			return line
+		}
+		cut := strings.LastIndexAny(field, ".[")
+		if cut < 0 {
+			break
+		}
+		field = field[:cut]
+	}
+	return 0
+}
+
+// parseLines - index YAML mappings' fields and sequences' items by paths, JSON is YAML too
+func parseLines(data []byte) fieldLines {
+	lines := fieldLines{}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return lines
+	}
+	var walk func(node *yaml.Node, path string)
+	walk = func(node *yaml.Node, path string) {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			for _, child := range node.Content {
+				walk(child, path)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				field := node.Content[i].Value
+				if path != "" {
+					field = path + "." + field
+				}
+				lines[field] = node.Content[i].Line
+				walk(node.Content[i+1], field)
+			}
+		case yaml.SequenceNode:
+			for i, item := range node.Content {
+				field := fmt.Sprintf("%s[%d]", path, i)
+				lines[field] = item.Line
+				walk(item, field)
+			}
+		}
+	}
+	walk(&doc, "")
+	return lines
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Available configuration file formats
+const (
+	JSON = "json"
+	YAML = "yaml"
+)
+
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// Error - configuration problem, pointing to file line and field when known
+type Error struct {
+	Line  int
+	Field string
+	Msg   string
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Line > 0 && e.Field != "":
+		return fmt.Sprintf("line %d: %s: %s", e.Line, e.Field, e.Msg)
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	case e.Field != "":
+		return fmt.Sprintf("%s: %s", e.Field, e.Msg)
+	}
+	return e.Msg
+}
+
+// Errors - all configuration problems found
+type Errors []*Error
+
+func (errs Errors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Duration - time.Duration, written as "5s" or "1m30s"
+type Duration time.Duration
+
+// Duration - getter for time.Duration value
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// MarshalJSON - write duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON - parse duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("invalid duration %s, expected string like \"5s\"", data)
+	}
+	return d.parse(value)
+}
+
+// UnmarshalYAML - parse duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return d.parse(value)
+}
+
+func (d *Duration) parse(value string) error {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", value)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Load - read, parse and validate configuration file
+func Load(path string) (*Config, error) {
+	cfg, err := Read(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Read - read and parse configuration file without defaults and validation
+// Format is chosen by file extension, YAML is used for unknown ones
+func Read(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	format := YAML
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		format = JSON
+	}
+	return Parse(data, format)
+}
+
+// Parse - strictly decode configuration, unknown fields are errors
+func Parse(data []byte, format string) (*Config, error) {
+	cfg := &Config{}
+	switch format {
+	case JSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, Errors{jsonError(data, err)}
+		}
+		if decoder.More() {
+			return nil, Errors{{Msg: "unexpected data after configuration object"}}
+		}
+	case YAML:
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, yamlErrors(data, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown configuration format %q", format)
+	}
+	cfg.lines = parseLines(data)
+	return cfg, nil
+}
+
+// jsonError - convert decoding error offsets to lines
+func jsonError(data []byte, err error) *Error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return &Error{Line: lineAt(data, e.Offset), Msg: e.Error()}
+	case *json.UnmarshalTypeError:
+		return &Error{
+			Line: lineAt(data, e.Offset),
+			Msg:  fmt.Sprintf("cannot use %s as %s in field %s", e.Value, e.Type, e.Field),
+		}
+	}
+	msg := strings.TrimPrefix(err.Error(), "json: ")
+	// Unknown fields and invalid values are reported without offset
+	if strings.HasPrefix(msg, "unknown field ") {
+		return &Error{Line: lineOf(data, strings.TrimPrefix(msg, "unknown field ")), Msg: msg}
+	}
+	if start := strings.Index(msg, `"`); start >= 0 {
+		return &Error{Line: lineOf(data, msg[start:]), Msg: msg}
+	}
+	return &Error{Msg: msg}
+}
+
+// yamlErrors - split decoding error into per-line problems
+func yamlErrors(data []byte, err error) Errors {
+	var msgs []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+	errs := Errors{}
+	for _, msg := range msgs {
+		if match := yamlLineRe.FindStringSubmatch(msg); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			errs = append(errs, &Error{Line: line, Msg: match[2]})
+			continue
+		}
+		msg = strings.TrimPrefix(msg, "yaml: ")
+		line := 0
+		if start := strings.Index(msg, `"`); start >= 0 {
+			line = lineOf(data, strings.Trim(msg[start:], `"`))
+		}
+		errs = append(errs, &Error{Line: line, Msg: msg})
+	}
+	return errs
+}
+
+// lineAt - line number of byte offset
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// lineOf - line number of the first occurrence of text, 0 if not found
+func lineOf(data []byte, text string) int {
+	index := bytes.Index(data, []byte(text))
+	if index < 0 {
+		return 0
+	}
+	return lineAt(data, int64(index))
+}
@@ -0,0 +1,514 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validYAML = `
+listeners:
+  - name: public
+    address: ":8080"
+    pool: api
+pools:
+  - name: api
+    servers:
+      - http://api-1:9000
+      - http://api-2:9000
+    health_check:
+      period: 1s
+      jitter: 0s
+    retry:
+      max_retries: 0
+      delay: 50ms
+  - name: static
+    algorithm: round-robin
+    servers: [http://static:9000]
+    stale_timeout: 5m
+`
+
+const validJSON = `{
+  "listeners": [{"address": ":8080"}],
+  "pools": [{
+    "name": "api",
+    "servers": ["http://api-1:9000"],
+    "health_check": {"period": "1s"}
+  }]
+}`
+
+func TestParseYAML(t *testing.T) {
+	cfg, err := Parse([]byte(validYAML), YAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	api := cfg.Pools[0]
+	if api.HealthCheck.Period.Duration() != time.Second {
+		t.Error("Expected", time.Second, "got", api.HealthCheck.Period)
+	}
+	if api.HealthCheck.Timeout.Duration() != defaultHealthCheckTimeout {
+		t.Error("Expected", defaultHealthCheckTimeout, "got", api.HealthCheck.Timeout)
+	}
+	if *api.HealthCheck.Jitter != 0 {
+		t.Error("Expected", 0, "got", *api.HealthCheck.Jitter)
+	}
+	if *api.Retry.MaxRetries != 0 {
+		t.Error("Expected", 0, "got", *api.Retry.MaxRetries)
+	}
+	if api.Retry.MaxAttempts != defaultMaxAttempts {
+		t.Error("Expected", defaultMaxAttempts, "got", api.Retry.MaxAttempts)
+	}
+	if cfg.Pools[1].StaleTimeout.Duration() != 5*time.Minute {
+		t.Error("Expected", 5*time.Minute, "got", cfg.Pools[1].StaleTimeout)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	cfg, err := Parse([]byte(validJSON), JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// Single pool is used by listener without explicit one
+	if cfg.Listeners[0].Pool != "api" {
+		t.Error("Expected", "api", "got", cfg.Listeners[0].Pool)
+	}
+}
+
+func TestParseErrorLines(t *testing.T) {
+	cases := []struct {
+		name   string
+		format string
+		data   string
+		line   int
+	}{
+		{"yaml unknown field", YAML, "pools:\n  - name: api\n    server: []\n", 3},
+		{"yaml wrong type", YAML, "pools:\n  - name: api\n    servers: 5\n", 3},
+		{"yaml syntax", YAML, "pools:\n  - name: [api\n", 2},
+		{"yaml duration", YAML, "pools:\n  - name: api\n    stale_timeout: 5x\n", 3},
+		{"json unknown field", JSON, "{\n  \"pools\": [{\n    \"nme\": \"api\"\n  }]\n}", 3},
+		{"json wrong type", JSON, "{\n  \"pools\": [{\n    \"name\": 5\n  }]\n}", 3},
+		{"json syntax", JSON, "{\n  \"pools\": [{\n    \"name\" \"api\"\n  }]\n}", 3},
+		{"json duration", JSON, "{\n  \"pools\": [{\n    \"stale_timeout\": \"5x\"\n  }]\n}", 3},
+	}
+	for _, c := range cases {
+		_, err := Parse([]byte(c.data), c.format)
+		errs, ok := err.(Errors)
+		if !ok || len(errs) == 0 {
+			t.Error(c.name, "expected", "Errors", "got", err)
+			continue
+		}
+		if errs[0].Line != c.line {
+			t.Error(c.name, "expected line", c.line, "got", errs[0].Line, errs[0].Msg)
+		}
+	}
+}
+
+func TestParseUnknownFormat(t *testing.T) {
+	if _, err := Parse([]byte("{}"), "toml"); err == nil {
+		t.Error("Expected", "error", "got", nil)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg := &Config{
+		Listeners: []Listener{{Name: "a", Address: ":8000", Pool: "missing"}, {Name: "a"}},
+		Pools:     []Pool{{Name: "api"}, {Name: "api", Servers: []string{"http://api:9000"}}},
+	}
+	cfg.SetDefaults()
+	err := cfg.Validate()
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatal("Expected", "Errors", "got", err)
+	}
+	expected := []string{
+		"pools[0].servers: no addresses provided",
+		`pools[1].name: duplicate pool "api"`,
+		`listeners[0].pool: unknown pool "missing"`,
+		`listeners[1].name: duplicate listener "a"`,
+		"listeners[1].address: is required",
+		"listeners[1].pool: is required without routes",
+	}
+	if errs.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", expected, "got", errs.Error())
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lb.json")
+	ioutil.WriteFile(path, []byte(validJSON), 0644)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Pools[0].Algorithm != "round-robin" {
+		t.Error("Expected", "round-robin", "got", cfg.Pools[0].Algorithm)
+	}
+}
+
+func TestValidateServersAndListeners(t *testing.T) {
+	cfg := &Config{
+		Listeners: []Listener{
+			{Address: ":8000", Pool: "api"},
+			{Address: "127.0.0.1:8000", Pool: "api"},
+			{Address: "127.0.0.1:8001", Pool: "api", Forwarding: &Forwarding{TrustedProxies: []string{"10.0.0.0/8", "fd00::1", "10.0.0.0/33"}}},
+			{Address: "8002", Pool: "api", ProxyProtocol: &ProxyProtocol{TrustedSources: []string{"lb"}}},
+			{Address: "127.0.0.1:8003", Pool: "api", ProxyProtocol: &ProxyProtocol{}},
+		},
+		Pools: []Pool{{
+			Name:          "api",
+			Algorithm:     "random",
+			Servers:       []string{"http://api:9000", "api:9000", "http://api:9000"},
+			ProxyProtocol: "v3",
+			TLS:           &UpstreamTLS{CertFile: "client.crt"},
+			Protocol:      "h3",
+			WebSocket:     WebSocket{IdleTimeout: Duration(-time.Second)},
+		}},
+	}
+	cfg.SetDefaults()
+	errs, _ := cfg.Validate().(Errors)
+	expected := []string{
+		`pools[0].algorithm: invalid balancing algorithm chosen.: "random"`,
+		`pools[0].servers[1]: server address must have scheme and host: "api:9000"`,
+		`pools[0].servers[2]: duplicate server "http://api:9000", already listed as servers[0]`,
+		"pools[0].websocket.idle_timeout: must be positive",
+		"pools[0].tls: client certificate and key must be provided together",
+		`pools[0].protocol: protocol must be http1, h2 or h2c: "h3"`,
+		`pools[0].proxy_protocol: unknown version "v3", expected v1 or v2`,
+		`listeners[1].address: "127.0.0.1:8000" conflicts with listeners[0] ":8000"`,
+		`listeners[2].forwarding.trusted_proxies[2]: invalid CIDR or address "10.0.0.0/33"`,
+		"listeners[3].address: address 8002: missing port in address",
+		`listeners[3].proxy_protocol.trusted_sources[0]: invalid CIDR or address "lb"`,
+		"listeners[4].proxy_protocol.trusted_sources: required, any client could spoof its address otherwise",
+	}
+	if errs.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", errs.Error())
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	cfg := &Config{
+		Listeners: []Listener{{
+			Address:       ":8000",
+			RouteMatching: "random",
+			NotFound:      &Response{Status: 999},
+			Routes: []Route{
+				{Name: "api", Host: "api.*.com", PathPrefix: "api", Pool: "api"},
+				{Name: "api", PathRegex: "^/(users", Pool: "missing", Rewrite: &Rewrite{StripPrefix: "api", Replacement: "/$1"}},
+				{Host: "*.example.com"},
+			},
+		}},
+		Pools: []Pool{{Name: "api", Servers: []string{"http://api:9000"}}},
+	}
+	cfg.SetDefaults()
+	errs, _ := cfg.Validate().(Errors)
+	expected := []string{
+		`listeners[0].route_matching: unknown mode "random", expected longest-prefix or first`,
+		"listeners[0].not_found.status: invalid status 999",
+		`listeners[0].routes[0].host: wildcard is allowed only as the first label: "api.*.com"`,
+		"listeners[0].routes[0].path_prefix: must start with /",
+		`listeners[0].routes[1].name: duplicate route "api"`,
+		`listeners[0].routes[1].pool: unknown pool "missing"`,
+		"listeners[0].routes[1].path_regex: error parsing regexp: missing closing ): `^/(users`",
+		"listeners[0].routes[1].rewrite.strip_prefix: must start with /",
+		"listeners[0].routes[1].rewrite.replacement: requires regex",
+		"listeners[0].routes[2].pool: is required",
+	}
+	if errs.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", errs.Error())
+	}
+}
+
+func TestValidateTLS(t *testing.T) {
+	cfg := &Config{
+		Listeners: []Listener{
+			{
+				Address: ":8443",
+				Pool:    "api",
+				TLS: &TLS{
+					Certificates: []Certificate{{CertFile: "/missing.crt", KeyFile: "/missing.key"}, {CertFile: "/only.crt"}},
+					MinVersion:   "1.4",
+					CipherSuites: []string{"TLS_NULL"},
+					ClientAuth:   &ClientAuth{},
+				},
+				HTTPSRedirect: &HTTPSRedirect{},
+			},
+			{
+				Address:       ":8080",
+				HTTPSRedirect: &HTTPSRedirect{Port: 70000, Status: 200},
+				Routes:        []Route{{Pool: "api", RequireClientCert: true}},
+			},
+		},
+		Pools: []Pool{{Name: "api", Servers: []string{"http://api:9000"}}},
+	}
+	cfg.SetDefaults()
+	errs, _ := cfg.Validate().(Errors)
+	expected := []string{
+		"listeners[0].tls.certificates[0]: open /missing.crt: no such file or directory",
+		"listeners[0].tls.certificates[1]: cert_file and key_file are required",
+		`listeners[0].tls.min_version: unknown TLS version "1.4", expected 1.0, 1.1, 1.2 or 1.3`,
+		`listeners[0].tls.cipher_suites: unknown cipher suite "TLS_NULL"`,
+		"listeners[0].tls.client_auth.ca_file: is required",
+		"listeners[0].https_redirect: is allowed on plain listeners only",
+		"listeners[1].https_redirect.port: invalid port 70000",
+		"listeners[1].https_redirect.status: invalid redirect status 200",
+		"listeners[1].routes[0].require_client_cert: requires listener's tls.client_auth",
+	}
+	if errs.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", errs.Error())
+	}
+}
+
+func TestValidateProtocols(t *testing.T) {
+	cfg := &Config{
+		Listeners: []Listener{{
+			Address: ":8443",
+			Pool:    "grpc",
+			H2C:     true,
+			TLS:     &TLS{Certificates: []Certificate{{CertFile: "/missing.crt", KeyFile: "/missing.key"}}},
+		}},
+		Pools: []Pool{
+			{Name: "grpc", Protocol: "h2c", ProxyProtocol: "v2", Servers: []string{"http://grpc:9000", "https://grpc:9443"}},
+			{Name: "api", Protocol: "h2", Servers: []string{"http://api:9000"}},
+		},
+	}
+	cfg.SetDefaults()
+	errs, _ := cfg.Validate().(Errors)
+	expected := []string{
+		`pools[0].servers[1]: h2c protocol requires http scheme: "https://grpc:9443"`,
+		"pools[0].proxy_protocol: can't be used with h2c protocol, connections are shared",
+		`pools[1].servers[0]: h2 protocol requires https scheme: "http://api:9000"`,
+		"listeners[0].tls.certificates[0]: open /missing.crt: no such file or directory",
+		"listeners[0].h2c: is allowed on plain listeners only, TLS listeners negotiate HTTP/2",
+	}
+	if errs.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", errs.Error())
+	}
+}
+
+func TestValidateRawModes(t *testing.T) {
+	cfg := &Config{
+		Listeners: []Listener{
+			{Address: ":5432", Mode: "tcp", Pool: "db"},
+			{Address: ":8000", Pool: "db"},
+			{Address: ":8001", Mode: "tcp", Pool: "api", H2C: true},
+			{Address: ":8002", Mode: "sctp", Pool: "api"},
+			{Address: ":53", Mode: "udp", Pool: "dns"},
+			{Address: ":53", Mode: "tcp", Pool: "api", UDP: &UDP{Balance: "random", MaxSessions: -1}},
+		},
+		Pools: []Pool{
+			{Name: "db", Servers: []string{"tcp://db-1:5432", "tcp://db-2"}, TCP: TCP{IdleTimeout: Duration(-time.Second)}},
+			{Name: "api", Servers: []string{"http://api:9000", "tcp://api:9001"}},
+			{Name: "dns", Servers: []string{"udp://dns:53", "tcp://dns:53"}, ProxyProtocol: "v1"},
+		},
+	}
+	cfg.SetDefaults()
+	if cfg.Pools[0].TCP.ConnectTimeout != Duration(5*time.Second) || cfg.Listeners[1].Mode != ModeHTTP {
+		t.Error("Expected", "default connect timeout and http mode", "got", cfg.Pools[0].TCP.ConnectTimeout, cfg.Listeners[1].Mode)
+	}
+	if udp := cfg.Listeners[4].UDP; udp == nil || udp.IdleTimeout != Duration(30*time.Second) || udp.Balance != "flow" || udp.MaxSessions != 10000 {
+		t.Error("Expected", "default udp sessions settings", "got", udp)
+	}
+	errs, _ := cfg.Validate().(Errors)
+	expected := []string{
+		`pools[0].servers[1]: tcp server requires port: "tcp://db-2"`,
+		"pools[0].tcp.idle_timeout: must be positive",
+		"pools[1].servers: tcp servers can't be mixed with other ones",
+		"pools[2].servers: udp servers can't be mixed with other ones",
+		"pools[2].proxy_protocol: can't be used with udp servers",
+		`listeners[1].pool: pool "db" of tcp servers requires tcp mode`,
+		"listeners[2].mode: tcp listener can't have routes, tls, https_redirect, h2c or forwarding",
+		`listeners[3].mode: unknown mode "sctp", expected http, tcp or udp`,
+		"listeners[5].udp: is allowed in udp mode only",
+		"listeners[5].udp.max_sessions: must be positive",
+		`listeners[5].udp.balance: unknown mode "random", expected flow or packet`,
+	}
+	if errs.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", errs.Error())
+	}
+}
+
+func TestValidateUnixSockets(t *testing.T) {
+	cfg := &Config{
+		Listeners: []Listener{
+			{Address: "unix:///run/lb.sock", Pool: "app", Socket: &Socket{Mode: "0660"}},
+			{Address: "unix:///run/lb.sock", Mode: "tcp", Pool: "app"},
+			{Address: "unix://run/lb.sock", Pool: "app", Socket: &Socket{Mode: "rw"}},
+			{Address: ":8000", Pool: "app", Socket: &Socket{Mode: "0600"}},
+		},
+		Pools: []Pool{{Name: "app", Protocol: "h2c", Servers: []string{"unix:///run/app.sock", "unix://app/app.sock"}}},
+	}
+	cfg.SetDefaults()
+	errs, _ := cfg.Validate().(Errors)
+	expected := []string{
+		`pools[0].servers[1]: unix server address must have socket path and no host: "unix://app/app.sock"`,
+		`listeners[1].address: "unix:///run/lb.sock" conflicts with listeners[0] "unix:///run/lb.sock"`,
+		`listeners[1].pool: tcp mode requires pool of tcp servers, "app" has none`,
+		`listeners[2].address: unix socket address must have path and no host: "unix://run/lb.sock"`,
+		`listeners[2].socket.mode: invalid permissions "rw", expected octal like 0660`,
+		"listeners[3].socket: is allowed for unix socket addresses only",
+	}
+	if errs.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", errs.Error())
+	}
+	if mode, _ := cfg.Listeners[0].Socket.FileMode(); mode != 0660 {
+		t.Error("Expected", "0660", "got", mode)
+	}
+}
+
+func TestValidateShutdown(t *testing.T) {
+	cfg := Default()
+	cfg.Pools[0].Servers = []string{"http://localhost:8001"}
+	cfg.SetDefaults()
+	if cfg.Shutdown.Timeout != Duration(30*time.Second) || cfg.Shutdown.DrainDelay != 0 || cfg.Shutdown.WaitWebSockets {
+		t.Error("Expected", "default shutdown settings", "got", cfg.Shutdown)
+	}
+	cfg.Shutdown = Shutdown{Timeout: Duration(-time.Second), DrainDelay: Duration(-time.Second)}
+	errs, _ := cfg.Validate().(Errors)
+	expected := []string{
+		"shutdown.timeout: must be positive",
+		"shutdown.drain_delay: must be positive",
+	}
+	if errs.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", errs.Error())
+	}
+}
+
+func TestValidateHealthCheck(t *testing.T) {
+	minute, off := Duration(time.Minute), Duration(0)
+	cfg := &Config{
+		Listeners: []Listener{{Address: ":8000", Pool: "api"}},
+		Pools: []Pool{
+			{Name: "api", Servers: []string{"http://api:9000"}},
+			{Name: "web", Servers: []string{"http://web:9000"}, HealthCheck: HealthCheck{Jitter: &minute, Workers: -1}},
+			{Name: "static", Servers: []string{"http://static:9000"}, HealthCheck: HealthCheck{Jitter: &off}},
+		},
+	}
+	cfg.SetDefaults()
+	if hc := cfg.Pools[0].HealthCheck; *hc.Jitter != Duration(500*time.Millisecond) || hc.Workers != 10 {
+		t.Error("Expected", "default jitter and workers", "got", hc)
+	}
+	if jitter := *cfg.Pools[2].HealthCheck.Jitter; jitter != 0 {
+		t.Error("Expected", "jitter turned off", "got", jitter)
+	}
+	errs, _ := cfg.Validate().(Errors)
+	expected := []string{
+		"pools[1].health_check.jitter: must not be negative and less than period",
+		"pools[1].health_check.workers: must be positive",
+	}
+	if errs.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", errs.Error())
+	}
+}
+
+const invalidYAML = `
+listeners:
+  - address: ":8080"
+    pool: api
+pools:
+  - name: api
+    servers:
+      - http://api-1:9000
+      - api-2:9000
+    health_check:
+      period: 1s
+      # checks shifted up to a minute
+      jitter: 1m
+  - name: static
+    algorithm: random
+    servers: [http://static:9000]
+`
+
+const invalidJSON = `{
+  "listeners": [{"address": ":8080", "pool": "api"}],
+  "pools": [
+    {"name": "api", "servers": ["http://api-1:9000", "api-2:9000"]},
+    {
+      "name": "static",
+      "algorithm": "random",
+      "servers": ["http://static:9000"],
+      "health_check": {"period": "1s", "jitter": "1m"}
+    }
+  ]
+}`
+
+func TestValidateLines(t *testing.T) {
+	cfg, err := Parse([]byte(invalidYAML), YAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SetDefaults()
+	expected := []string{
+		`line 9: pools[0].servers[1]: server address must have scheme and host: "api-2:9000"`,
+		"line 13: pools[0].health_check.jitter: must not be negative and less than period",
+		`line 15: pools[1].algorithm: invalid balancing algorithm chosen.: "random"`,
+	}
+	if err := cfg.Validate(); err == nil || err.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", err)
+	}
+	cfg, err = Parse([]byte(invalidJSON), JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.SetDefaults()
+	expected = []string{
+		`line 4: pools[0].servers[1]: server address must have scheme and host: "api-2:9000"`,
+		`line 7: pools[1].algorithm: invalid balancing algorithm chosen.: "random"`,
+		"line 9: pools[1].health_check.jitter: must not be negative and less than period",
+	}
+	if err := cfg.Validate(); err == nil || err.Error() != strings.Join(expected, "\n") {
+		t.Error("Expected", strings.Join(expected, "\n"), "got", err)
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	lines := parseLines([]byte(`pools:
+- name: api
+  not_found:
+    body: |
+      name: not a field
+  servers:
+  - http://api:9000
+listeners:
+  - "address": ":8080"
+`))
+	expected := map[string]int{
+		"pools[0].name":           2,
+		"pools[0].not_found.body": 4,
+		"pools[0].servers[0]":     7,
+		"listeners[0].address":    9,
+		"listeners[0].pool":       9,
+		"pools[0].name.unknown":   2,
+	}
+	for field, line := range expected {
+		if observed := lines.line(field); observed != line {
+			t.Error("Expected", field, line, "got", observed)
+		}
+	}
+	if _, ok := lines["pools[0].not_found.name"]; ok {
+		t.Error("Expected", "multiline scalar skipped", "got", lines)
+	}
+	lines = parseLines([]byte("{\n\t\"pools\": [\n\t\t{\"name\": \"api\",\n\t\t\"servers\": [\"http://api:9000\"]}\n\t]\n}"))
+	expected = map[string]int{
+		"pools[0].name":       3,
+		"pools[0].servers":    4,
+		"pools[0].servers[0]": 4,
+	}
+	for field, line := range expected {
+		if observed := lines.line(field); observed != line {
+			t.Error("Expected", field, line, "got", observed)
+		}
+	}
+}
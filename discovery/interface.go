@@ -0,0 +1,13 @@
+package discovery
+
+import (
+	"context"
+
+	"github.com/freundallein/loadbalancer/bucket"
+)
+
+// Provider - common dynamic backend servers source interface
+// Run blocks, keeping bucket in sync with discovered servers, until ctx is done
+type Provider interface {
+	Run(ctx context.Context, bckt bucket.ServerBucket)
+}
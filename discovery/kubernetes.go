@@ -0,0 +1,442 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/freundallein/loadbalancer/bucket"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	serviceNameLabel  = "kubernetes.io/service-name"
+	watchTimeout      = 5 * time.Minute
+	minBackoff        = 1 * time.Second
+	maxBackoff        = 30 * time.Second
+	drainCheckPeriod  = 1 * time.Second
+)
+
+var (
+	ErrNotInCluster    = errors.New("not running inside kubernetes cluster")
+	ErrInvalidService  = errors.New("kubernetes service name is required")
+	ErrResourceExpired = errors.New("resource version expired")
+)
+
+// KubernetesConfig - EndpointSlice provider settings
+type KubernetesConfig struct {
+	APIServer string       // api server base url
+	Token     string       // service account bearer token
+	Client    *http.Client // client, trusting api server certificate
+	Namespace string       // service namespace
+	Service   string       // service name
+	PortName  string       // endpoint port name, first port is used if empty
+	Scheme    string       // backend url scheme, http if empty
+
+	ServerOptions []bucket.ServerOption // settings of discovered servers
+}
+
+// InClusterConfig - build provider settings from pod's service account
+// Namespace defaults to the pod's own namespace
+func InClusterConfig(namespace, service, portName string) (*KubernetesConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("invalid CA certificate in %s", serviceAccountDir)
+	}
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	return &KubernetesConfig{
+		APIServer: "https://" + net.JoinHostPort(host, port),
+		Token:     strings.TrimSpace(string(token)),
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+		Namespace: namespace,
+		Service:   service,
+		PortName:  portName,
+	}, nil
+}
+
+// KubernetesProvider - watches service's EndpointSlices for ready addresses
+type KubernetesProvider struct {
+	config          KubernetesConfig
+	slices          map[string]endpointSlice // known slices by name
+	servers         map[string]bool          // addresses, discovered by provider, bucket may have dropped them since
+	draining        map[string]bucket.Server // terminating servers, drained by provider
+	resourceVersion string                   // last seen list/watch version
+}
+
+// NewKubernetes - EndpointSlice provider constructor
+func NewKubernetes(config KubernetesConfig) (*KubernetesProvider, error) {
+	if config.Service == "" {
+		return nil, ErrInvalidService
+	}
+	if _, err := url.Parse(config.APIServer); err != nil {
+		return nil, err
+	}
+	if config.Namespace == "" {
+		config.Namespace = "default"
+	}
+	if config.Scheme == "" {
+		config.Scheme = "http"
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &KubernetesProvider{
+		config:   config,
+		slices:   map[string]endpointSlice{},
+		servers:  map[string]bool{},
+		draining: map[string]bucket.Server{},
+	}, nil
+}
+
+// Run - list and watch EndpointSlices, reconnecting with backoff on failures
+// Watch resumes from the last seen resourceVersion, expired version leads to relist
+func (kp *KubernetesProvider) Run(ctx context.Context, bckt bucket.ServerBucket) {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		listing := kp.resourceVersion == ""
+		var err error
+		if listing {
+			err = kp.list(ctx, bckt)
+		} else {
+			err = kp.watch(ctx, bckt)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == ErrResourceExpired {
+			log.Printf("[discovery] %s, relisting\n", err.Error())
+			kp.resourceVersion = ""
+			continue
+		}
+		if err == nil {
+			backoff = minBackoff
+			// Prevent hammering api server, which closes watches instantly
+			if listing || time.Since(started) >= minBackoff {
+				continue
+			}
+		} else {
+			log.Printf("[discovery] %s, reconnecting in %s\n", err.Error(), backoff)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if err != nil && backoff < maxBackoff {
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+// list - fetch all service's slices and replace known state
+func (kp *KubernetesProvider) list(ctx context.Context, bckt bucket.ServerBucket) error {
+	resp, err := kp.request(ctx, url.Values{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var list endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return err
+	}
+	kp.slices = map[string]endpointSlice{}
+	for _, slice := range list.Items {
+		kp.slices[slice.Metadata.Name] = slice
+	}
+	kp.resourceVersion = list.Metadata.ResourceVersion
+	kp.sync(ctx, bckt)
+	return nil
+}
+
+// watch - apply slice events until stream is closed
+func (kp *KubernetesProvider) watch(ctx context.Context, bckt bucket.ServerBucket) error {
+	query := url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {kp.resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(watchTimeout.Seconds()))},
+	}
+	resp, err := kp.request(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if event.Type == "ERROR" {
+			var status apiStatus
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return ErrResourceExpired
+			}
+			return fmt.Errorf("watch error: %s", status.Message)
+		}
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return err
+		}
+		kp.resourceVersion = slice.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			kp.slices[slice.Metadata.Name] = slice
+		case "DELETED":
+			delete(kp.slices, slice.Metadata.Name)
+		default:
+			continue
+		}
+		kp.sync(ctx, bckt)
+	}
+}
+
+// request - query service's EndpointSlices collection
+func (kp *KubernetesProvider) request(ctx context.Context, query url.Values) (*http.Response, error) {
+	query.Set("labelSelector", serviceNameLabel+"="+kp.config.Service)
+	endpoint := fmt.Sprintf(
+		"%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		strings.TrimRight(kp.config.APIServer, "/"), url.PathEscape(kp.config.Namespace), query.Encode(),
+	)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if kp.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+kp.config.Token)
+	}
+	resp, err := kp.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, ErrResourceExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("api server responded %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// sync - add ready endpoints missing from bucket, drain terminating ones and remove gone ones
+// Bucket is the source of truth, servers it removed on its own, like stale ones, are added again.
+// Servers, which weren't discovered, like configured ones, are left alone.
+// Draining server stops getting new requests and is removed, once in-flight ones are finished.
+func (kp *KubernetesProvider) sync(ctx context.Context, bckt bucket.ServerBucket) {
+	ready := map[string]bool{}
+	terminating := map[string]bool{}
+	for _, slice := range kp.slices {
+		port, ok := slice.port(kp.config.PortName)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			for _, ip := range endpoint.Addresses {
+				addr := fmt.Sprintf("%s://%s", kp.config.Scheme, net.JoinHostPort(ip, strconv.Itoa(port)))
+				switch {
+				case endpoint.Conditions.isTerminating():
+					terminating[addr] = true
+				case endpoint.Conditions.isReady():
+					ready[addr] = true
+				}
+			}
+		}
+	}
+	present := map[string]bucket.Server{}
+	for _, srv := range bckt.Servers() {
+		present[srv.Address().String()] = srv
+	}
+	for addr, srv := range kp.draining {
+		if present[addr] != srv {
+			delete(kp.draining, addr)
+		}
+	}
+	for addr := range ready {
+		if srv, ok := kp.draining[addr]; ok {
+			delete(kp.draining, addr)
+			srv.SetState(bucket.StateActive)
+			log.Printf("[discovery] server %s is ready again\n", addr)
+			continue
+		}
+		if _, ok := present[addr]; ok {
+			continue
+		}
+		srv, err := bucket.NewServer(addr, kp.config.ServerOptions...)
+		if err != nil {
+			log.Printf("[discovery] %s\n", err.Error())
+			continue
+		}
+		if err := bckt.AddServer(srv); err != nil {
+			log.Printf("[discovery] %s\n", err.Error())
+			continue
+		}
+		kp.servers[addr] = true
+		log.Printf("[discovery] server %s added\n", addr)
+	}
+	for addr := range kp.servers {
+		if ready[addr] {
+			continue
+		}
+		srv, ok := present[addr]
+		if !ok {
+			delete(kp.servers, addr)
+			continue
+		}
+		if terminating[addr] {
+			if _, ok := kp.draining[addr]; !ok {
+				kp.draining[addr] = srv
+				srv.SetState(bucket.StateDraining)
+				log.Printf("[discovery] server %s is terminating, draining\n", addr)
+				go drain(ctx, bckt, srv)
+			}
+			continue
+		}
+		delete(kp.servers, addr)
+		delete(kp.draining, addr)
+		bckt.RemoveServer(addr)
+		log.Printf("[discovery] server %s removed\n", addr)
+	}
+}
+
+// drain - remove draining server from bucket, once its in-flight requests are finished
+// Gives up, if server becomes active again or is removed by anyone else.
+func drain(ctx context.Context, bckt bucket.ServerBucket, srv bucket.Server) {
+	ticker := time.NewTicker(drainCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if srv.State() != bucket.StateDraining || !contains(bckt, srv) {
+			return
+		}
+		if srv.Drained() {
+			bckt.RemoveServer(srv.Address().String())
+			log.Printf("[discovery] server %s drained and removed\n", srv.Address())
+			return
+		}
+	}
+}
+
+// contains - whether bucket still has exactly this server
+func contains(bckt bucket.ServerBucket, srv bucket.Server) bool {
+	for _, current := range bckt.Servers() {
+		if current == srv {
+			return true
+		}
+	}
+	return false
+}
+
+type objectMeta struct {
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type endpointConditions struct {
+	Ready       *bool `json:"ready"`
+	Terminating *bool `json:"terminating"`
+}
+
+// isReady - unknown readiness should be interpreted as ready
+func (ec endpointConditions) isReady() bool {
+	return ec.Ready == nil || *ec.Ready
+}
+
+func (ec endpointConditions) isTerminating() bool {
+	return ec.Terminating != nil && *ec.Terminating
+}
+
+type endpoint struct {
+	Addresses  []string           `json:"addresses"`
+	Conditions endpointConditions `json:"conditions"`
+}
+
+type endpointPort struct {
+	Name string `json:"name"`
+	Port *int   `json:"port"`
+}
+
+type endpointSlice struct {
+	Metadata  objectMeta     `json:"metadata"`
+	Endpoints []endpoint     `json:"endpoints"`
+	Ports     []endpointPort `json:"ports"`
+}
+
+// port - find port number by name, first one is used if name is empty
+func (es endpointSlice) port(name string) (int, bool) {
+	for _, p := range es.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if name == "" || p.Name == name {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
+
+type endpointSliceList struct {
+	Metadata objectMeta      `json:"metadata"`
+	Items    []endpointSlice `json:"items"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type apiStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
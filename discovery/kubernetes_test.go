@@ -0,0 +1,302 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/freundallein/loadbalancer/bucket"
+)
+
+type MockBucket struct {
+	lock    sync.Mutex
+	servers map[string]bucket.Server
+}
+
+func (mb *MockBucket) AddServer(srv bucket.Server) error {
+	mb.lock.Lock()
+	mb.servers[srv.Address().String()] = srv
+	mb.lock.Unlock()
+	return nil
+}
+
+func (mb *MockBucket) RemoveServer(addr string) error {
+	mb.lock.Lock()
+	delete(mb.servers, addr)
+	mb.lock.Unlock()
+	return nil
+}
+
+func (mb *MockBucket) addresses() []string {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	addrs := []string{}
+	for addr := range mb.servers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (mb *MockBucket) Servers() []bucket.Server {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	servers := []bucket.Server{}
+	for _, srv := range mb.servers {
+		servers = append(servers, srv)
+	}
+	return servers
+}
+
+func (mb *MockBucket) Size() int                                      { return len(mb.addresses()) }
+func (mb *MockBucket) InFlight() int64                                { return 0 }
+func (mb *MockBucket) Serve(http.ResponseWriter, *http.Request) error { return nil }
+func (mb *MockBucket) ServeConn(net.Conn) error                       { return nil }
+func (mb *MockBucket) Next() (bucket.Server, error)                   { return nil, nil }
+func (mb *MockBucket) Healthcheck()                                   {}
+func (mb *MockBucket) RemoveStale(time.Duration)                      {}
+func (mb *MockBucket) RunServices(context.Context, time.Duration)     {}
+func (mb *MockBucket) Stop()                                          {}
+func (mb *MockBucket) CloseUpgraded(...bucket.Server)                 {}
+func (mb *MockBucket) CountDatagram(bucket.Server, string, int)       {}
+func (mb *MockBucket) Eject(bucket.Server, string)                    {}
+
+const sliceList = `{
+  "metadata": {"resourceVersion": "100"},
+  "items": [{
+    "metadata": {"name": "web-abc", "resourceVersion": "99"},
+    "endpoints": [
+      {"addresses": ["10.0.0.1"], "conditions": {"ready": true}},
+      {"addresses": ["10.0.0.2"], "conditions": {"ready": true}},
+      {"addresses": ["10.0.0.3"], "conditions": {"ready": false}}
+    ],
+    "ports": [{"name": "metrics", "port": 9090}, {"name": "http", "port": 8080}]
+  }]
+}`
+
+const sliceModified = `{"type": "MODIFIED", "object": {
+  "metadata": {"name": "web-abc", "resourceVersion": "101"},
+  "endpoints": [
+    {"addresses": ["10.0.0.1"], "conditions": {"ready": true}},
+    {"addresses": ["10.0.0.2"], "conditions": {"ready": false, "terminating": true}},
+    {"addresses": ["10.0.0.3"], "conditions": {"ready": true}}
+  ],
+  "ports": [{"name": "metrics", "port": 9090}, {"name": "http", "port": 8080}]
+}}`
+
+const watchExpired = `{"type": "ERROR", "object": {"kind": "Status", "code": 410, "message": "too old resource version"}}`
+
+type fakeAPIServer struct {
+	lock    sync.Mutex
+	lists   int
+	watches []string
+	events  []string
+}
+
+func (fs *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if r.URL.Query().Get("watch") != "true" {
+		fs.lists++
+		fmt.Fprint(w, sliceList)
+		return
+	}
+	fs.watches = append(fs.watches, r.URL.Query().Get("resourceVersion"))
+	if len(fs.events) == 0 {
+		return
+	}
+	fmt.Fprintln(w, fs.events[0])
+	fs.events = fs.events[1:]
+}
+
+func (fs *fakeAPIServer) stats() (int, []string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.lists, append([]string{}, fs.watches...)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition was not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func equal(a, b []string) bool {
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
+
+func newTestProvider(t *testing.T, apiServer string) *KubernetesProvider {
+	provider, err := NewKubernetes(KubernetesConfig{
+		APIServer: apiServer,
+		Token:     "secret",
+		Namespace: "prod",
+		Service:   "web",
+		PortName:  "http",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestNewKubernetesInvalidService(t *testing.T) {
+	_, err := NewKubernetes(KubernetesConfig{APIServer: "http://127.0.0.1"})
+	if err != ErrInvalidService {
+		t.Error("Expected", ErrInvalidService, "got", err)
+	}
+}
+
+func TestInClusterConfigOutside(t *testing.T) {
+	host := os.Getenv("KUBERNETES_SERVICE_HOST")
+	os.Setenv("KUBERNETES_SERVICE_HOST", "")
+	defer os.Setenv("KUBERNETES_SERVICE_HOST", host)
+	_, err := InClusterConfig("", "web", "")
+	if err != ErrNotInCluster {
+		t.Error("Expected", ErrNotInCluster, "got", err)
+	}
+}
+
+func TestKubernetesWatch(t *testing.T) {
+	api := &fakeAPIServer{events: []string{sliceModified}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	bckt := &MockBucket{servers: map[string]bucket.Server{}}
+	provider := newTestProvider(t, server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		provider.Run(ctx, bckt)
+		close(done)
+	}()
+	expected := []string{"http://10.0.0.1:8080", "http://10.0.0.3:8080"}
+	waitFor(t, func() bool { return equal(bckt.addresses(), expected) })
+	_, watches := api.stats()
+	if watches[0] != "100" {
+		t.Error("Expected", "100", "got", watches[0])
+	}
+	// Reconnection resumes from the last seen version
+	waitFor(t, func() bool { _, watches := api.stats(); return len(watches) > 1 })
+	_, watches = api.stats()
+	if watches[1] != "101" {
+		t.Error("Expected", "101", "got", watches[1])
+	}
+	cancel()
+	<-done
+}
+
+func TestKubernetesWatchExpired(t *testing.T) {
+	api := &fakeAPIServer{events: []string{watchExpired}}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	bckt := &MockBucket{servers: map[string]bucket.Server{}}
+	provider := newTestProvider(t, server.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		provider.Run(ctx, bckt)
+		close(done)
+	}()
+	waitFor(t, func() bool { lists, _ := api.stats(); return lists > 1 })
+	expected := []string{"http://10.0.0.1:8080", "http://10.0.0.2:8080"}
+	if observed := bckt.addresses(); !equal(observed, expected) {
+		t.Error("Expected", expected, "got", observed)
+	}
+	cancel()
+	<-done
+}
+
+func TestKubernetesSyncFirstPort(t *testing.T) {
+	port := 9090
+	provider, _ := NewKubernetes(KubernetesConfig{Service: "web", Scheme: "https"})
+	provider.slices["web-ipv6"] = endpointSlice{
+		Endpoints: []endpoint{{Addresses: []string{"fd00::1"}}},
+		Ports:     []endpointPort{{Name: "metrics", Port: &port}},
+	}
+	bckt := &MockBucket{servers: map[string]bucket.Server{}}
+	provider.sync(context.Background(), bckt)
+	expected := []string{"https://[fd00::1]:9090"}
+	if observed := bckt.addresses(); !equal(observed, expected) {
+		t.Error("Expected", expected, "got", observed)
+	}
+}
+
+func TestKubernetesSyncReaddsDropped(t *testing.T) {
+	port := 8080
+	provider, _ := NewKubernetes(KubernetesConfig{Service: "web"})
+	provider.slices["web-abc"] = endpointSlice{
+		Endpoints: []endpoint{{Addresses: []string{"10.0.0.1"}}},
+		Ports:     []endpointPort{{Port: &port}},
+	}
+	static, _ := bucket.NewServer("http://10.0.0.9:8080")
+	bckt := &MockBucket{servers: map[string]bucket.Server{"http://10.0.0.9:8080": static}}
+	provider.sync(context.Background(), bckt)
+	// Bucket drops the server on its own, like a stale one
+	bckt.RemoveServer("http://10.0.0.1:8080")
+	provider.sync(context.Background(), bckt)
+	expected := []string{"http://10.0.0.1:8080", "http://10.0.0.9:8080"}
+	if observed := bckt.addresses(); !equal(observed, expected) {
+		t.Error("Expected", expected, "got", observed)
+	}
+	provider.slices = map[string]endpointSlice{}
+	provider.sync(context.Background(), bckt)
+	expected = []string{"http://10.0.0.9:8080"}
+	if observed := bckt.addresses(); !equal(observed, expected) {
+		t.Error("Expected", "configured server kept", "got", observed)
+	}
+}
+
+func TestKubernetesSyncDrainsTerminating(t *testing.T) {
+	port := 8080
+	yes, no := true, false
+	slice := func(conditions endpointConditions) endpointSlice {
+		return endpointSlice{
+			Endpoints: []endpoint{{Addresses: []string{"10.0.0.1"}, Conditions: conditions}},
+			Ports:     []endpointPort{{Port: &port}},
+		}
+	}
+	provider, _ := NewKubernetes(KubernetesConfig{Service: "web"})
+	bckt := &MockBucket{servers: map[string]bucket.Server{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	provider.slices["web-abc"] = slice(endpointConditions{})
+	provider.sync(ctx, bckt)
+	srv := bckt.Servers()[0]
+	srv.AddInFlight(1)
+	provider.slices["web-abc"] = slice(endpointConditions{Ready: &no, Terminating: &yes})
+	provider.sync(ctx, bckt)
+	if srv.State() != bucket.StateDraining || bckt.Size() != 1 {
+		t.Error("Expected", "draining server kept in bucket", "got", srv.State(), bckt.Size())
+	}
+	provider.slices["web-abc"] = slice(endpointConditions{})
+	provider.sync(ctx, bckt)
+	if srv.State() != bucket.StateActive {
+		t.Error("Expected", bucket.StateActive, "got", srv.State())
+	}
+	provider.slices["web-abc"] = slice(endpointConditions{Ready: &no, Terminating: &yes})
+	provider.sync(ctx, bckt)
+	time.Sleep(drainCheckPeriod + 100*time.Millisecond)
+	if bckt.Size() != 1 {
+		t.Error("Expected", "server with in-flight requests kept", "got", bckt.Size())
+	}
+	srv.AddInFlight(-1)
+	waitFor(t, func() bool { return bckt.Size() == 0 })
+}
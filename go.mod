@@ -2,4 +2,9 @@ module github.com/freundallein/loadbalancer
 
 go 1.13
 
-require github.com/prometheus/client_golang v1.3.0
+require (
+	github.com/prometheus/client_golang v1.3.0
+	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553
+	gopkg.in/yaml.v2 v2.2.7
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,88 @@
+package httpserv
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ClientAuth - client certificates verification results forwarding
+// Client-supplied copies of headers are always removed, empty header name disables it.
+type ClientAuth struct {
+	Required          bool // every route requires verified certificate
+	SubjectHeader     string
+	SANHeader         string
+	FingerprintHeader string
+}
+
+// ClientCAs - certificate pool to verify client certificates with
+func ClientCAs(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", caFile)
+	}
+	return pool, nil
+}
+
+// VerifiedCert - client certificate, verified against client CAs, nil if there is none
+func VerifiedCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// Allows - check if request may be served by route
+func (ca *ClientAuth) Allows(route *Route, r *http.Request) bool {
+	if !ca.Required && !route.RequireClientCert {
+		return true
+	}
+	return VerifiedCert(r) != nil
+}
+
+// Apply - replace certificate headers of outgoing request with verified values
+func (ca *ClientAuth) Apply(out *http.Request, in *http.Request) {
+	headers := []string{ca.SubjectHeader, ca.SANHeader, ca.FingerprintHeader}
+	for _, name := range headers {
+		if name != "" {
+			out.Header.Del(name)
+		}
+	}
+	cert := VerifiedCert(in)
+	if cert == nil {
+		return
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	values := []string{cert.Subject.String(), strings.Join(subjectAltNames(cert), ","), hex.EncodeToString(fingerprint[:])}
+	for i, name := range headers {
+		if name != "" && values[i] != "" {
+			out.Header.Set(name, values[i])
+		}
+	}
+}
+
+// subjectAltNames - certificate SANs prefixed with their types, like "DNS:api.internal"
+func subjectAltNames(cert *x509.Certificate) []string {
+	names := []string{}
+	for _, name := range cert.DNSNames {
+		names = append(names, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		names = append(names, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, "URI:"+uri.String())
+	}
+	return names
+}
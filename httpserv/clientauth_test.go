@@ -0,0 +1,106 @@
+package httpserv
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func withClientCert(r *http.Request) *http.Request {
+	cert := &x509.Certificate{
+		Raw:            []byte("certificate"),
+		Subject:        pkix.Name{CommonName: "billing", Organization: []string{"Example"}},
+		DNSNames:       []string{"billing.internal"},
+		EmailAddresses: []string{"ops@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.7")},
+	}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	return r
+}
+
+func TestClientAuthApply(t *testing.T) {
+	auth := &ClientAuth{SubjectHeader: "X-Subject", SANHeader: "X-San", FingerprintHeader: "X-Fingerprint"}
+	in, _ := http.NewRequest(http.MethodGet, "/", nil)
+	in.Header.Set("X-Subject", "CN=admin")
+	out := in.Clone(in.Context())
+	auth.Apply(out, in)
+	if out.Header.Get("X-Subject") != "" {
+		t.Error("Expected", "stripped subject", "got", out.Header.Get("X-Subject"))
+	}
+
+	withClientCert(in)
+	out = in.Clone(in.Context())
+	auth.Apply(out, in)
+	fingerprint := sha256.Sum256([]byte("certificate"))
+	expected := map[string]string{
+		"X-Subject":     "CN=billing,O=Example",
+		"X-San":         "DNS:billing.internal,email:ops@example.com,IP:10.0.0.7",
+		"X-Fingerprint": hex.EncodeToString(fingerprint[:]),
+	}
+	for name, value := range expected {
+		if observed := out.Header.Get(name); observed != value {
+			t.Error("Expected", value, "got", observed)
+		}
+	}
+}
+
+func TestRouterRequiresClientCert(t *testing.T) {
+	buck := &MockBucket{response: GoodResponse, size: 1}
+	routes := []*Route{
+		{Name: "admin", PathPrefix: "/admin", Bucket: buck, RequireClientCert: true},
+		{Name: "public", Bucket: buck},
+	}
+	router := NewRouter(routes, nil, LongestPrefix, Response{})
+	cases := []struct {
+		path     string
+		cert     bool
+		expected int
+	}{
+		{"/admin", false, http.StatusForbidden},
+		{"/admin", true, http.StatusOK},
+		{"/", false, http.StatusOK},
+	}
+	for _, c := range cases {
+		buck.request = nil
+		req, _ := http.NewRequest(http.MethodGet, c.path, nil)
+		if c.cert {
+			withClientCert(req)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if c.expected == http.StatusForbidden && (rec.Code != c.expected || buck.request != nil) {
+			t.Error("Expected", "rejected request", "got", rec.Code, "without client authentication")
+		}
+	}
+
+	router.SetClientAuth(&ClientAuth{})
+	for _, c := range cases {
+		buck.request = nil
+		req, _ := http.NewRequest(http.MethodGet, c.path, nil)
+		if c.cert {
+			withClientCert(req)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		if rec.Code != c.expected {
+			t.Error("Expected", c.expected, "got", rec.Code, "for", c.path)
+		}
+		if (c.expected == http.StatusForbidden) != (buck.request == nil) {
+			t.Error("Expected", "backend chosen only for allowed requests", "got", buck.request)
+		}
+	}
+
+	router.SetClientAuth(&ClientAuth{Required: true})
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Error("Expected", http.StatusForbidden, "got", rec.Code)
+	}
+}
@@ -0,0 +1,161 @@
+package httpserv
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Forwarding - trusted proxies aware client address derivation and forwarding headers
+type Forwarding struct {
+	trusted        []*net.IPNet
+	stripUntrusted bool // drop forwarding headers, received from untrusted peers
+}
+
+// NewForwarding - forwarding constructor, accepts CIDRs and plain IP addresses
+func NewForwarding(trustedProxies []string, stripUntrusted bool) (*Forwarding, error) {
+	fw := &Forwarding{stripUntrusted: stripUntrusted}
+	for _, proxy := range trustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		fw.trusted = append(fw.trusted, network)
+	}
+	return fw, nil
+}
+
+// IsTrusted - check if address belongs to trusted proxies
+func (fw *Forwarding) IsTrusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range fw.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP - real client address
+// Forwarded (or X-Forwarded-For) chain is walked from the right, skipping trusted proxies
+func (fw *Forwarding) ClientIP(r *http.Request) string {
+	remote := clientIP(r)
+	if !fw.IsTrusted(remote) {
+		return remote
+	}
+	chain := forwardedFor(r.Header)
+	if len(chain) == 0 {
+		chain = forwardedForLegacy(r.Header)
+	}
+	client := remote
+	for i := len(chain) - 1; i >= 0; i-- {
+		if net.ParseIP(chain[i]) == nil {
+			// Obfuscated or unknown node, nothing to trust beyond it
+			break
+		}
+		client = chain[i]
+		if !fw.IsTrusted(client) {
+			break
+		}
+	}
+	return client
+}
+
+// Apply - set forwarding headers of outgoing request
+// Trusted peer's X-Forwarded-Proto/Host/Port are kept, otherwise they describe this hop.
+// ReverseProxy appends peer address to X-Forwarded-For afterwards.
+func (fw *Forwarding) Apply(out *http.Request, in *http.Request) {
+	trusted := fw.IsTrusted(clientIP(in))
+	if !trusted && fw.stripUntrusted {
+		for _, name := range []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Port"} {
+			out.Header.Del(name)
+		}
+	}
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	host := in.Host
+	port := ""
+	if _, p, err := net.SplitHostPort(in.Host); err == nil {
+		port = p
+	} else if local, ok := in.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		_, port, _ = net.SplitHostPort(local.String())
+	}
+	values := map[string]string{"X-Forwarded-Proto": proto, "X-Forwarded-Host": host, "X-Forwarded-Port": port}
+	for name, value := range values {
+		if trusted && out.Header.Get(name) != "" || value == "" {
+			continue
+		}
+		out.Header.Set(name, value)
+	}
+	element := "for=" + forwardedNode(clientIP(in)) + ";host=" + quoteForwarded(host) + ";proto=" + proto
+	if prior := out.Header.Get("Forwarded"); prior != "" {
+		element = strings.Join(out.Header["Forwarded"], ", ") + ", " + element
+	}
+	out.Header.Set("Forwarded", element)
+}
+
+// forwardedFor - for= nodes of RFC 7239 Forwarded header
+func forwardedFor(header http.Header) []string {
+	nodes := []string{}
+	for _, value := range header["Forwarded"] {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) < 4 || !strings.EqualFold(pair[:4], "for=") {
+					continue
+				}
+				nodes = append(nodes, parseNode(strings.Trim(pair[4:], `"`)))
+			}
+		}
+	}
+	return nodes
+}
+
+// forwardedForLegacy - nodes of X-Forwarded-For header
+func forwardedForLegacy(header http.Header) []string {
+	nodes := []string{}
+	for _, value := range header["X-Forwarded-For"] {
+		for _, node := range strings.Split(value, ",") {
+			if node = strings.TrimSpace(node); node != "" {
+				nodes = append(nodes, parseNode(node))
+			}
+		}
+	}
+	return nodes
+}
+
+// parseNode - strip port and brackets from node like "[2001:db8::1]:4711"
+func parseNode(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+// forwardedNode - RFC 7239 node, IPv6 addresses are bracketed and quoted
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// quoteForwarded - quote value, if it is not a plain token
+func quoteForwarded(value string) string {
+	if strings.ContainsAny(value, ":[]\" ") {
+		return `"` + strings.Replace(value, `"`, `\"`, -1) + `"`
+	}
+	return value
+}
@@ -0,0 +1,120 @@
+package httpserv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/freundallein/loadbalancer/bucket"
+)
+
+func TestNewForwarding(t *testing.T) {
+	fw, err := NewForwarding([]string{"10.0.0.0/8", "192.168.1.1", "fd00::1"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, expected := range map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.1": true,
+		"192.168.1.2": false,
+		"fd00::1":     true,
+		"fd00::2":     false,
+		"unknown":     false,
+	} {
+		if observed := fw.IsTrusted(addr); observed != expected {
+			t.Error("Expected", expected, "got", observed, "for", addr)
+		}
+	}
+	if _, err := NewForwarding([]string{"10.0.0.0/33"}, false); err == nil {
+		t.Error("Expected", "invalid CIDR error", "got", nil)
+	}
+}
+
+func TestForwardingClientIP(t *testing.T) {
+	fw, _ := NewForwarding([]string{"10.0.0.0/8"}, false)
+	cases := []struct {
+		remote   string
+		header   http.Header
+		expected string
+	}{
+		{"203.0.113.7:1234", http.Header{"X-Forwarded-For": {"1.1.1.1"}}, "203.0.113.7"},
+		{"10.0.0.1:1234", http.Header{}, "10.0.0.1"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.1.1.1, 2.2.2.2, 10.0.0.2"}}, "2.2.2.2"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3", "10.0.0.2"}}, "10.0.0.3"},
+		{"10.0.0.1:1234", http.Header{"X-Forwarded-For": {"1.1.1.1, unknown, 10.0.0.2"}}, "10.0.0.2"},
+		{
+			"10.0.0.1:1234",
+			http.Header{"Forwarded": {`for=1.1.1.1, for="[2001:db8::1]:4711";proto=https`}, "X-Forwarded-For": {"3.3.3.3"}},
+			"2001:db8::1",
+		},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = c.remote
+		req.Header = c.header
+		if observed := fw.ClientIP(req); observed != c.expected {
+			t.Error("Expected", c.expected, "got", observed, "for", c.header)
+		}
+	}
+}
+
+func TestForwardingApply(t *testing.T) {
+	fw, _ := NewForwarding([]string{"10.0.0.0/8"}, true)
+	in, _ := http.NewRequest(http.MethodGet, "http://example.com:8080/", nil)
+	in.RemoteAddr = "203.0.113.7:1234"
+	in.Header.Set("X-Forwarded-For", "1.1.1.1")
+	in.Header.Set("X-Forwarded-Proto", "https")
+	in.Header.Set("Forwarded", "for=1.1.1.1")
+	out := in.Clone(in.Context())
+	fw.Apply(out, in)
+	if out.Header.Get("X-Forwarded-For") != "" {
+		t.Error("Expected", "stripped X-Forwarded-For", "got", out.Header.Get("X-Forwarded-For"))
+	}
+	if out.Header.Get("X-Forwarded-Proto") != "http" || out.Header.Get("X-Forwarded-Port") != "8080" {
+		t.Error("Expected", "http 8080", "got", out.Header)
+	}
+	expected := `for=203.0.113.7;host="example.com:8080";proto=http`
+	if observed := out.Header.Get("Forwarded"); observed != expected {
+		t.Error("Expected", expected, "got", observed)
+	}
+
+	in.RemoteAddr = "10.0.0.1:1234"
+	out = in.Clone(in.Context())
+	fw.Apply(out, in)
+	if out.Header.Get("X-Forwarded-Proto") != "https" {
+		t.Error("Expected", "trusted https", "got", out.Header.Get("X-Forwarded-Proto"))
+	}
+	expected = `for=1.1.1.1, for=10.0.0.1;host="example.com:8080";proto=http`
+	if observed := out.Header.Get("Forwarded"); observed != expected {
+		t.Error("Expected", expected, "got", observed)
+	}
+}
+
+func TestRouterForwarding(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+	}))
+	defer backend.Close()
+	buck, _ := bucket.New(bucket.RoundRobin)
+	srv, _ := bucket.NewServer(backend.URL)
+	buck.AddServer(srv)
+	route := &Route{
+		Name:     "api",
+		Bucket:   buck,
+		Policies: []*HeaderPolicy{{Request: HeaderRules{Set: map[string]string{"X-Real-Ip": "{client_ip}"}}}},
+	}
+	router := NewRouter([]*Route{route}, nil, LongestPrefix, Response{})
+	fw, _ := NewForwarding([]string{"10.0.0.0/8"}, false)
+	router.SetForwarding(fw)
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "1.1.1.1")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if received.Get("X-Real-Ip") != "1.1.1.1" {
+		t.Error("Expected", "1.1.1.1", "got", received.Get("X-Real-Ip"))
+	}
+	if received.Get("X-Forwarded-For") != "1.1.1.1, 10.0.0.1" {
+		t.Error("Expected", "1.1.1.1, 10.0.0.1", "got", received.Get("X-Forwarded-For"))
+	}
+}
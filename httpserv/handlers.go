@@ -1,7 +1,11 @@
 package httpserv
 
 import (
+	"crypto/subtle"
+	"encoding/json"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/freundallein/loadbalancer/bucket"
 )
@@ -11,13 +15,18 @@ func LoadBalance(buck bucket.ServerBucket) func(w http.ResponseWriter, r *http.R
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := buck.Serve(w, r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			bucket.WriteError(w, r, err, http.StatusServiceUnavailable)
 		}
 	}
 }
 
+// sizer - anything, that knows amount of servers behind it
+type sizer interface {
+	Size() int
+}
+
 // Healthz - service healthcheck handler
-func Healthz(buck bucket.ServerBucket) func(w http.ResponseWriter, r *http.Request) {
+func Healthz(buck sizer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if buck.Size() > 0 {
 			w.WriteHeader(200)
@@ -28,3 +37,98 @@ func Healthz(buck bucket.ServerBucket) func(w http.ResponseWriter, r *http.Reque
 		}
 	}
 }
+
+// Reload - authenticated configuration reload handler
+// Expects POST with "Authorization: Bearer <token>", responds with reload error on failure
+func Reload(token string, reload func() error) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(token, r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := reload(); err != nil {
+			http.Error(w, "reload failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}
+}
+
+// authorized - check "Authorization: Bearer <token>", nothing is authorized with empty token
+func authorized(token string, r *http.Request) bool {
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(provided), []byte(token)) == 1
+}
+
+// serverStatus - server's entry of servers endpoint
+type serverStatus struct {
+	Pool      string `json:"pool"`
+	Address   string `json:"address"`
+	State     string `json:"state"`
+	Available bool   `json:"available"`
+	InFlight  int64  `json:"in_flight"`
+	Drained   bool   `json:"drained"`
+}
+
+// Servers - authenticated servers administration handler, with the same token as Reload
+// GET lists servers of all pools, POST with "pool", "server" and "state" values changes server's state
+func Servers(token string, pools func() map[string]bucket.ServerBucket) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(token, r) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			current := pools()
+			names := make([]string, 0, len(current))
+			for name := range current {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			statuses := []serverStatus{}
+			for _, name := range names {
+				for _, srv := range current[name].Servers() {
+					statuses = append(statuses, serverStatus{
+						Pool:      name,
+						Address:   srv.Address().String(),
+						State:     srv.State(),
+						Available: srv.IsAvailable(),
+						InFlight:  srv.InFlight(),
+						Drained:   srv.Drained(),
+					})
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(statuses)
+		case http.MethodPost:
+			buck, ok := pools()[r.FormValue("pool")]
+			if !ok {
+				http.Error(w, "pool not found", http.StatusNotFound)
+				return
+			}
+			for _, srv := range buck.Servers() {
+				if srv.Address().String() != r.FormValue("server") {
+					continue
+				}
+				if err := srv.SetState(r.FormValue("state")); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				w.Write([]byte("ok"))
+				return
+			}
+			http.Error(w, bucket.ErrServerNotFound.Error(), http.StatusNotFound)
+		default:
+			w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package httpserv
 
 import (
+	"context"
 	"errors"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
@@ -21,11 +23,23 @@ const (
 type MockBucket struct {
 	response string
 	size int
+	request  *http.Request
 }
 
 func (mb *MockBucket) AddServer(bucket.Server) error { return nil }
 
+func (mb *MockBucket) RemoveServer(string) error { return nil }
+
+func (mb *MockBucket) Servers() []bucket.Server { return nil }
+
+func (mb *MockBucket) InFlight() int64 { return 0 }
+
+func (mb *MockBucket) ServeConn(net.Conn) error { return nil }
+
+func (mb *MockBucket) Next() (bucket.Server, error) { return nil, nil }
+
 func (mb *MockBucket) Serve(w http.ResponseWriter, r *http.Request) error {
+	mb.request = r
 	switch mb.response {
 	case GoodResponse:
 		w.WriteHeader(http.StatusOK)
@@ -44,7 +58,12 @@ func (mb *MockBucket) Healthcheck() {}
 
 func (mb *MockBucket) RemoveStale(time.Duration) {}
 
-func (mb *MockBucket) RunServices(int) {}
+func (mb *MockBucket) RunServices(context.Context, time.Duration) {}
+
+func (mb *MockBucket) Stop() {}
+func (mb *MockBucket) CloseUpgraded(...bucket.Server) {}
+func (mb *MockBucket) CountDatagram(bucket.Server, string, int) {}
+func (mb *MockBucket) Eject(bucket.Server, string) {}
 
 func TestBalanceGoodResponse(t *testing.T) {
 	handlerFunc := LoadBalance(&MockBucket{response: GoodResponse})
@@ -150,4 +169,79 @@ func TestHealthzBadResponse(t *testing.T) {
 			status, http.StatusInternalServerError)
 	}
 
-}
\ No newline at end of file
+}
+func TestReload(t *testing.T) {
+	reloadErr := errors.New("invalid config")
+	cases := []struct {
+		method string
+		auth   string
+		err    error
+		code   int
+	}{
+		{http.MethodGet, "Bearer secret", nil, http.StatusMethodNotAllowed},
+		{http.MethodPost, "", nil, http.StatusUnauthorized},
+		{http.MethodPost, "Bearer wrong", nil, http.StatusUnauthorized},
+		{http.MethodPost, "Bearer secret", nil, http.StatusOK},
+		{http.MethodPost, "Bearer secret", reloadErr, http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		reloaded := false
+		handler := http.HandlerFunc(Reload("secret", func() error {
+			reloaded = true
+			return c.err
+		}))
+		req, _ := http.NewRequest(c.method, "/-/reload", nil)
+		req.Header.Set("Authorization", c.auth)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Error("Expected", c.code, "got", rec.Code)
+		}
+		if reloaded != (c.code == http.StatusOK || c.err != nil) {
+			t.Error("Unexpected reload call for", c.method, c.auth)
+		}
+	}
+}
+
+func TestServers(t *testing.T) {
+	buck, _ := bucket.New(bucket.RoundRobin)
+	srv, _ := bucket.NewServer("http://127.0.0.1:1", bucket.WithAvailable(false))
+	buck.AddServer(srv)
+	pools := func() map[string]bucket.ServerBucket {
+		return map[string]bucket.ServerBucket{"api": buck}
+	}
+	cases := []struct {
+		method string
+		auth   string
+		query  string
+		code   int
+		state  string
+	}{
+		{http.MethodPost, "Bearer wrong", "pool=api&server=http://127.0.0.1:1&state=draining", http.StatusUnauthorized, bucket.StateActive},
+		{http.MethodPost, "Bearer secret", "pool=web&server=http://127.0.0.1:1&state=draining", http.StatusNotFound, bucket.StateActive},
+		{http.MethodPost, "Bearer secret", "pool=api&server=http://127.0.0.1:2&state=draining", http.StatusNotFound, bucket.StateActive},
+		{http.MethodPost, "Bearer secret", "pool=api&server=http://127.0.0.1:1&state=paused", http.StatusBadRequest, bucket.StateActive},
+		{http.MethodPost, "Bearer secret", "pool=api&server=http://127.0.0.1:1&state=draining", http.StatusOK, bucket.StateDraining},
+		{http.MethodDelete, "Bearer secret", "", http.StatusMethodNotAllowed, bucket.StateDraining},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(c.method, "/-/servers?"+c.query, nil)
+		req.Header.Set("Authorization", c.auth)
+		rec := httptest.NewRecorder()
+		http.HandlerFunc(Servers("secret", pools)).ServeHTTP(rec, req)
+		if rec.Code != c.code {
+			t.Error("Expected", c.code, "got", rec.Code, c.query)
+		}
+		if srv.State() != c.state {
+			t.Error("Expected", c.state, "got", srv.State())
+		}
+	}
+	req, _ := http.NewRequest(http.MethodGet, "/-/servers", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	http.HandlerFunc(Servers("secret", pools)).ServeHTTP(rec, req)
+	expected := `[{"pool":"api","address":"http://127.0.0.1:1","state":"draining","available":false,"in_flight":0,"drained":true}]` + "\n"
+	if rec.Body.String() != expected {
+		t.Error("Expected", expected, "got", rec.Body.String())
+	}
+}
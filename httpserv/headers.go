@@ -0,0 +1,89 @@
+package httpserv
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// Vars - per-request values for header templates
+// Available as {client_ip}, {request_id}, {backend}, {route} and {host}
+type Vars struct {
+	ClientIP  string
+	RequestID string
+	Backend   string // chosen server address, empty until proxying starts
+	Route     string
+	Host      string
+}
+
+// Expand - substitute variables in template, unknown placeholders are kept as is
+func (v *Vars) Expand(template string) string {
+	if !strings.Contains(template, "{") {
+		return template
+	}
+	return strings.NewReplacer(
+		"{client_ip}", v.ClientIP,
+		"{request_id}", v.RequestID,
+		"{backend}", v.Backend,
+		"{route}", v.Route,
+		"{host}", v.Host,
+	).Replace(template)
+}
+
+// HeaderRules - header changes, applied in order: rename, remove, set, add
+type HeaderRules struct {
+	Rename map[string]string // old name to new name, values are moved
+	Remove []string
+	Set    map[string]string // replace values
+	Add    map[string]string // append values
+}
+
+// Apply - change headers in place, expanding templates with vars
+func (hr *HeaderRules) Apply(header http.Header, vars *Vars) {
+	for from, to := range hr.Rename {
+		if values, ok := header[http.CanonicalHeaderKey(from)]; ok {
+			header.Del(from)
+			for _, value := range values {
+				header.Add(to, value)
+			}
+		}
+	}
+	for _, name := range hr.Remove {
+		header.Del(name)
+	}
+	for name, value := range hr.Set {
+		header.Set(name, vars.Expand(value))
+	}
+	for name, value := range hr.Add {
+		header.Add(name, vars.Expand(value))
+	}
+}
+
+// HeaderPolicy - request headers toward backends and response headers toward clients
+type HeaderPolicy struct {
+	Request  HeaderRules
+	Response HeaderRules
+}
+
+// clientIP - address of the connected client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestID - incoming request id or a new random one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,94 @@
+package httpserv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/freundallein/loadbalancer/bucket"
+)
+
+func TestVarsExpand(t *testing.T) {
+	vars := &Vars{ClientIP: "10.0.0.1", RequestID: "abc", Backend: "api:9000", Route: "api", Host: "example.com"}
+	observed := vars.Expand("{client_ip} {request_id} {backend} {route} {host} {unknown}")
+	expected := "10.0.0.1 abc api:9000 api example.com {unknown}"
+	if observed != expected {
+		t.Error("Expected", expected, "got", observed)
+	}
+}
+
+func TestHeaderRulesApply(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer token")
+	header.Set("X-Old", "value")
+	header.Set("X-Env", "dev")
+	rules := &HeaderRules{
+		Rename: map[string]string{"x-old": "X-New"},
+		Remove: []string{"authorization"},
+		Set:    map[string]string{"X-Env": "prod", "X-Client": "{client_ip}"},
+		Add:    map[string]string{"X-Env": "{route}"},
+	}
+	rules.Apply(header, &Vars{ClientIP: "10.0.0.1", Route: "api"})
+	expected := http.Header{
+		"X-New":    {"value"},
+		"X-Env":    {"prod", "api"},
+		"X-Client": {"10.0.0.1"},
+	}
+	if !reflect.DeepEqual(header, expected) {
+		t.Error("Expected", expected, "got", header)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	generated := requestID(req)
+	if len(generated) != 32 || generated == requestID(req) {
+		t.Error("Expected", "random 32 hex chars", "got", generated)
+	}
+	req.Header.Set(requestIDHeader, "incoming")
+	if observed := requestID(req); observed != "incoming" {
+		t.Error("Expected", "incoming", "got", observed)
+	}
+}
+
+func TestRouterHeaderPolicies(t *testing.T) {
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Header().Set("Server", "nginx")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	buck, _ := bucket.New(bucket.RoundRobin)
+	srv, _ := bucket.NewServer(backend.URL)
+	buck.AddServer(srv)
+	route := &Route{
+		Name:   "api",
+		Bucket: buck,
+		Policies: []*HeaderPolicy{
+			{
+				Request:  HeaderRules{Set: map[string]string{"X-Backend": "{backend}"}, Remove: []string{"Authorization"}},
+				Response: HeaderRules{Remove: []string{"Server"}},
+			},
+			{
+				Request:  HeaderRules{Set: map[string]string{"X-Route": "{route}"}},
+				Response: HeaderRules{Set: map[string]string{"Strict-Transport-Security": "max-age=63072000"}},
+			},
+		},
+	}
+	router := NewRouter([]*Route{route}, nil, LongestPrefix, Response{})
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if received.Get("X-Backend") != srv.Address().Host || received.Get("X-Route") != "api" {
+		t.Error("Expected", srv.Address().Host, "api", "got", received)
+	}
+	if received.Get("Authorization") != "" {
+		t.Error("Expected", "no authorization", "got", received.Get("Authorization"))
+	}
+	if rec.Header().Get("Server") != "" || rec.Header().Get("Strict-Transport-Security") == "" {
+		t.Error("Expected", "rewritten response headers", "got", rec.Header())
+	}
+}
@@ -0,0 +1,59 @@
+package httpserv
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Rewrite - request URL rewriting rules, applied before proxying
+// Order: strip prefix, regex replace, add prefix, query changes
+type Rewrite struct {
+	StripPrefix string
+	AddPrefix   string
+	Regex       *regexp.Regexp    // path pattern
+	Replacement string            // may refer capture groups like $1 or ${name}
+	QueryAdd    map[string]string // query parameters to set
+	QueryRemove []string          // query parameters to delete
+}
+
+// Apply - rewrite request's URL in place
+func (rw *Rewrite) Apply(r *http.Request) {
+	path := stripPrefix(r.URL.Path, rw.StripPrefix)
+	if rw.Regex != nil {
+		path = rw.Regex.ReplaceAllString(path, rw.Replacement)
+	}
+	if rw.AddPrefix != "" {
+		path = strings.TrimRight(rw.AddPrefix, "/") + path
+	}
+	if path != r.URL.Path {
+		r.URL.Path = path
+		r.URL.RawPath = ""
+	}
+	if len(rw.QueryAdd) == 0 && len(rw.QueryRemove) == 0 {
+		return
+	}
+	query := r.URL.Query()
+	for _, name := range rw.QueryRemove {
+		query.Del(name)
+	}
+	for name, value := range rw.QueryAdd {
+		query.Set(name, value)
+	}
+	r.URL.RawQuery = query.Encode()
+}
+
+// stripPrefix - cut prefix from path on segment boundary, so /api strips /api/users but not /apiv2
+func stripPrefix(path, prefix string) string {
+	prefix = strings.TrimRight(prefix, "/")
+	if prefix == "" {
+		return path
+	}
+	if path == prefix {
+		return "/"
+	}
+	if strings.HasPrefix(path, prefix+"/") {
+		return path[len(prefix):]
+	}
+	return path
+}
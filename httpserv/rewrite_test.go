@@ -0,0 +1,68 @@
+package httpserv
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+func TestRewriteApply(t *testing.T) {
+	cases := []struct {
+		rewrite  Rewrite
+		url      string
+		expected string
+	}{
+		{Rewrite{}, "/api/users?id=1", "/api/users?id=1"},
+		{Rewrite{StripPrefix: "/api"}, "/api/users", "/users"},
+		{Rewrite{StripPrefix: "/api"}, "/api", "/"},
+		{Rewrite{StripPrefix: "/api"}, "/static/api", "/static/api"},
+		{Rewrite{StripPrefix: "/api"}, "/apiv2", "/apiv2"},
+		{Rewrite{StripPrefix: "/api"}, "/apiv2/users", "/apiv2/users"},
+		{Rewrite{StripPrefix: "/api/"}, "/api/users", "/users"},
+		{Rewrite{StripPrefix: "/api/"}, "/api", "/"},
+		{Rewrite{AddPrefix: "/v2/"}, "/users", "/v2/users"},
+		{Rewrite{StripPrefix: "/api", AddPrefix: "/internal"}, "/api/users", "/internal/users"},
+		{
+			Rewrite{Regex: regexp.MustCompile(`^/users/(\d+)/(?P<item>\w+)$`), Replacement: "/items/${item}?owner=$1"},
+			"/users/42/books",
+			"/items/books%3Fowner=42",
+		},
+		{
+			Rewrite{Regex: regexp.MustCompile(`^/old/(.*)$`), Replacement: "/new/$1"},
+			"/old/path/x",
+			"/new/path/x",
+		},
+		{
+			Rewrite{QueryAdd: map[string]string{"env": "prod"}, QueryRemove: []string{"debug"}},
+			"/users?debug=1&id=7",
+			"/users?env=prod&id=7",
+		},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest(http.MethodGet, c.url, nil)
+		c.rewrite.Apply(req)
+		if observed := req.URL.RequestURI(); observed != c.expected {
+			t.Error("Case", i, "expected", c.expected, "got", observed)
+		}
+	}
+}
+
+func TestRouterRewrite(t *testing.T) {
+	buck := &MockBucket{response: GoodResponse}
+	route := &Route{Name: "api", PathPrefix: "/api", Rewrite: &Rewrite{StripPrefix: "/api"}, Bucket: buck}
+	router := NewRouter([]*Route{route}, nil, LongestPrefix, Response{})
+	req, _ := http.NewRequest(http.MethodGet, "/api/users", nil)
+	router.ServeHTTP(&statusWriter{ResponseWriter: nopWriter{}}, req)
+	if buck.request.URL.Path != "/users" {
+		t.Error("Expected", "/users", "got", buck.request.URL.Path)
+	}
+	if req.URL.Path != "/api/users" {
+		t.Error("Expected", "original request untouched", "got", req.URL.Path)
+	}
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Header() http.Header         { return http.Header{} }
+func (nopWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (nopWriter) WriteHeader(int)             {}
@@ -0,0 +1,290 @@
+package httpserv
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/freundallein/loadbalancer/bucket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Available route matching modes
+const (
+	LongestPrefix = "longest-prefix"
+	FirstMatch    = "first"
+)
+
+// noRoute - route label of unmatched requests
+const noRoute = "-"
+
+var (
+	routeRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_route_requests_total",
+		Help: "The total requests by matched route and response status class, unmatched ones have route \"-\"",
+	}, []string{"route", "code"})
+	routeRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "lb_route_request_duration_seconds",
+		Help:    "The time to serve request matched by route, including retries, upgraded connections excluded",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"route"})
+)
+
+type (
+	routeKey struct{}
+	varsKey  struct{}
+)
+
+// Route - request matching rules and servers bucket to serve matched requests
+// Empty rule matches any request
+type Route struct {
+	Name       string
+	Host       string            // exact host or wildcard like "*.example.com"
+	PathPrefix string            // request path prefix
+	PathRegex  *regexp.Regexp    // request path pattern
+	Methods    []string          // allowed methods
+	Headers    map[string]string // required header values, "*" requires presence only
+	Rewrite    *Rewrite          // URL rewriting rules, optional
+	Policies   []*HeaderPolicy   // header rules, applied in order
+	Bucket     bucket.ServerBucket
+
+	RequireClientCert bool // reject requests without verified client certificate
+}
+
+// Matches - check if request satisfies all route rules
+func (rt *Route) Matches(r *http.Request) bool {
+	if rt.Host != "" && !matchHost(rt.Host, r.Host) {
+		return false
+	}
+	if rt.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if rt.PathRegex != nil && !rt.PathRegex.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(rt.Methods) > 0 {
+		allowed := false
+		for _, method := range rt.Methods {
+			if strings.EqualFold(method, r.Method) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for name, value := range rt.Headers {
+		actual, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (value != "*" && actual[0] != value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchHost - compare host without port, case-insensitive
+// Wildcard matches any subdomain, but not the domain itself
+func matchHost(pattern, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	pattern, host = strings.ToLower(pattern), strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// Response - static response for unmatched requests
+type Response struct {
+	Status int
+	Body   string
+}
+
+// Router - dispatches requests to servers buckets by routes
+type Router struct {
+	routes     []*Route
+	fallback   *Route      // default route, used when nothing matches
+	matching   string      // LongestPrefix or FirstMatch
+	notFound   Response    // response when nothing matches and there is no default route
+	forwarding *Forwarding // client address derivation and forwarding headers
+	clientAuth *ClientAuth // client certificates requirements, nil if not verified
+}
+
+// NewRouter - router constructor, fallback route may be nil
+// Fallback route rules are ignored, it is used for any unmatched request
+func NewRouter(routes []*Route, fallback *Route, matching string, notFound Response) *Router {
+	router := &Router{
+		routes:     routes,
+		fallback:   fallback,
+		matching:   matching,
+		notFound:   notFound,
+		forwarding: &Forwarding{},
+	}
+	if router.notFound.Status == 0 {
+		router.notFound.Status = http.StatusNotFound
+	}
+	if router.notFound.Body == "" {
+		router.notFound.Body = http.StatusText(router.notFound.Status)
+	}
+	return router
+}
+
+// SetForwarding - trust forwarding headers of provided proxies
+func (rtr *Router) SetForwarding(forwarding *Forwarding) {
+	rtr.forwarding = forwarding
+}
+
+// SetClientAuth - require and forward verified client certificates
+func (rtr *Router) SetClientAuth(clientAuth *ClientAuth) {
+	rtr.clientAuth = clientAuth
+}
+
+// Match - choose route for request
+// Longest path prefix wins, routes with equal prefixes are taken in order.
+// In first match mode the first matching route wins.
+func (rtr *Router) Match(r *http.Request) *Route {
+	var matched *Route
+	for _, route := range rtr.routes {
+		if !route.Matches(r) {
+			continue
+		}
+		if rtr.matching == FirstMatch {
+			return route
+		}
+		if matched == nil || len(route.PathPrefix) > len(matched.PathPrefix) {
+			matched = route
+		}
+	}
+	if matched == nil {
+		return rtr.fallback
+	}
+	return matched
+}
+
+// Size - total number of servers in routed buckets
+func (rtr *Router) Size() int {
+	size := 0
+	for _, buck := range rtr.Buckets() {
+		size += buck.Size()
+	}
+	return size
+}
+
+// Buckets - distinct buckets of all routes
+func (rtr *Router) Buckets() []bucket.ServerBucket {
+	seen := map[bucket.ServerBucket]bool{}
+	buckets := []bucket.ServerBucket{}
+	routes := rtr.routes
+	if rtr.fallback != nil {
+		routes = append(routes[:len(routes):len(routes)], rtr.fallback)
+	}
+	for _, route := range routes {
+		if route.Bucket == nil || seen[route.Bucket] {
+			continue
+		}
+		seen[route.Bucket] = true
+		buckets = append(buckets, route.Bucket)
+	}
+	return buckets
+}
+
+// ServeHTTP - serve request with matched route's bucket
+// Access log contains both original and rewritten URLs
+func (rtr *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	original := r.URL.RequestURI()
+	client := rtr.forwarding.ClientIP(r)
+	sw := &statusWriter{ResponseWriter: w}
+	name := noRoute
+	defer func() {
+		observeRoute(name, sw.status, time.Since(started))
+	}()
+	route := rtr.Match(r)
+	if route == nil {
+		http.Error(sw, rtr.notFound.Body, rtr.notFound.Status)
+		log.Printf("[access] %s %s %s -> - (no route) %d %s\n", client, r.Method, original, sw.status, time.Since(started))
+		return
+	}
+	name = route.Name
+	if !rtr.allows(route, r) {
+		http.Error(sw, "client certificate required", http.StatusForbidden)
+		log.Printf("[access] %s %s %s -> - (%s) %d %s\n", client, r.Method, original, route.Name, sw.status, time.Since(started))
+		return
+	}
+	vars := &Vars{ClientIP: client, Route: route.Name, Host: r.Host}
+	if len(route.Policies) > 0 {
+		vars.RequestID = requestID(r)
+		sw.onHeader = func(header http.Header) {
+			for _, policy := range route.Policies {
+				policy.Response.Apply(header, vars)
+			}
+		}
+	}
+	director := func(out *http.Request, srv bucket.Server) {
+		vars.Backend = srv.Address().Host
+		rtr.forwarding.Apply(out, r)
+		if rtr.clientAuth != nil {
+			rtr.clientAuth.Apply(out, r)
+		}
+		for _, policy := range route.Policies {
+			policy.Request.Apply(out.Header, vars)
+		}
+	}
+	ctx := context.WithValue(r.Context(), routeKey{}, route)
+	ctx = context.WithValue(ctx, varsKey{}, vars)
+	ctx = context.WithValue(ctx, bucket.DirectorKey, director)
+	req := r.WithContext(ctx)
+	if route.Rewrite != nil {
+		u := *r.URL
+		req.URL = &u
+		route.Rewrite.Apply(req)
+	}
+	LoadBalance(route.Bucket)(sw, req)
+	log.Printf(
+		"[access] %s %s %s -> %s (%s) %d %s\n",
+		client, r.Method, original, req.URL.RequestURI(), route.Name, sw.status, time.Since(started),
+	)
+}
+
+// observeRoute - count request served by route, requests nothing was written for got 200
+func observeRoute(route string, status int, duration time.Duration) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	routeRequests.WithLabelValues(route, bucket.StatusClass(status)).Inc()
+	if status != http.StatusSwitchingProtocols {
+		routeRequestDuration.WithLabelValues(route).Observe(duration.Seconds())
+	}
+}
+
+// allows - check client certificate requirements of route
+// Without client authentication no certificate can be verified, so requiring routes reject everything
+func (rtr *Router) allows(route *Route, r *http.Request) bool {
+	if rtr.clientAuth == nil {
+		return !route.RequireClientCert
+	}
+	return rtr.clientAuth.Allows(route, r)
+}
+
+// RouteFromContext - extract matched route of request
+func RouteFromContext(r *http.Request) *Route {
+	if route, ok := r.Context().Value(routeKey{}).(*Route); ok {
+		return route
+	}
+	return nil
+}
+
+// VarsFromContext - extract request variables, like real client address
+func VarsFromContext(r *http.Request) *Vars {
+	if vars, ok := r.Context().Value(varsKey{}).(*Vars); ok {
+		return vars
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package httpserv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRouteMatches(t *testing.T) {
+	cases := []struct {
+		route   Route
+		method  string
+		url     string
+		headers map[string]string
+		matches bool
+	}{
+		{Route{}, "GET", "http://any.host/any", nil, true},
+		{Route{Host: "example.com"}, "GET", "http://EXAMPLE.com:8000/", nil, true},
+		{Route{Host: "example.com"}, "GET", "http://api.example.com/", nil, false},
+		{Route{Host: "*.example.com"}, "GET", "http://api.example.com/", nil, true},
+		{Route{Host: "*.example.com"}, "GET", "http://a.b.example.com/", nil, true},
+		{Route{Host: "*.example.com"}, "GET", "http://example.com/", nil, false},
+		{Route{PathPrefix: "/api"}, "GET", "http://host/api/users", nil, true},
+		{Route{PathPrefix: "/api"}, "GET", "http://host/static", nil, false},
+		{Route{PathRegex: regexp.MustCompile(`^/users/\d+$`)}, "GET", "http://host/users/42", nil, true},
+		{Route{PathRegex: regexp.MustCompile(`^/users/\d+$`)}, "GET", "http://host/users/me", nil, false},
+		{Route{Methods: []string{"get", "POST"}}, "GET", "http://host/", nil, true},
+		{Route{Methods: []string{"POST"}}, "GET", "http://host/", nil, false},
+		{Route{Headers: map[string]string{"x-env": "prod"}}, "GET", "http://host/", map[string]string{"X-Env": "prod"}, true},
+		{Route{Headers: map[string]string{"X-Env": "prod"}}, "GET", "http://host/", map[string]string{"X-Env": "dev"}, false},
+		{Route{Headers: map[string]string{"X-Env": "*"}}, "GET", "http://host/", map[string]string{"X-Env": "dev"}, true},
+		{Route{Headers: map[string]string{"X-Env": "*"}}, "GET", "http://host/", nil, false},
+	}
+	for i, c := range cases {
+		req, _ := http.NewRequest(c.method, c.url, nil)
+		for name, value := range c.headers {
+			req.Header.Set(name, value)
+		}
+		if observed := c.route.Matches(req); observed != c.matches {
+			t.Error("Case", i, "expected", c.matches, "got", observed)
+		}
+	}
+}
+
+func newRoutes() []*Route {
+	return []*Route{
+		{Name: "api", PathPrefix: "/api", Bucket: &MockBucket{response: GoodResponse, size: 1}},
+		{Name: "users", PathPrefix: "/api/users", Bucket: &MockBucket{response: GoodResponse}},
+		{Name: "regex", PathRegex: regexp.MustCompile("^/api"), Bucket: &MockBucket{response: GoodResponse}},
+	}
+}
+
+func TestRouterLongestPrefix(t *testing.T) {
+	router := NewRouter(newRoutes(), nil, LongestPrefix, Response{})
+	req, _ := http.NewRequest("GET", "/api/users/1", nil)
+	if route := router.Match(req); route.Name != "users" {
+		t.Error("Expected", "users", "got", route.Name)
+	}
+}
+
+func TestRouterFirstMatch(t *testing.T) {
+	router := NewRouter(newRoutes(), nil, FirstMatch, Response{})
+	req, _ := http.NewRequest("GET", "/api/users/1", nil)
+	if route := router.Match(req); route.Name != "api" {
+		t.Error("Expected", "api", "got", route.Name)
+	}
+}
+
+func TestRouterNotFound(t *testing.T) {
+	router := NewRouter(newRoutes(), nil, LongestPrefix, Response{Status: http.StatusTeapot, Body: "no route"})
+	req, _ := http.NewRequest("GET", "/static", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTeapot {
+		t.Error("Expected", http.StatusTeapot, "got", rec.Code)
+	}
+	if rec.Body.String() != "no route\n" {
+		t.Error("Expected", "no route", "got", rec.Body.String())
+	}
+	router = NewRouter(nil, nil, LongestPrefix, Response{})
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Error("Expected", http.StatusNotFound, "got", rec.Code)
+	}
+}
+
+func TestRouterFallback(t *testing.T) {
+	fallback := &MockBucket{response: GoodResponse, size: 2}
+	routes := newRoutes()
+	router := NewRouter(routes, &Route{Name: "default", Bucket: fallback}, LongestPrefix, Response{})
+	req, _ := http.NewRequest("GET", "/static", nil)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Error("Expected", http.StatusOK, "got", rec.Code)
+	}
+	if route := RouteFromContext(fallback.request); route == nil || route.Name != "default" {
+		t.Error("Expected", "default", "got", route)
+	}
+	if router.Size() != 3 {
+		t.Error("Expected", 3, "got", router.Size())
+	}
+	if len(router.Buckets()) != 4 || len(routes) != 3 {
+		t.Error("Expected", 4, "got", len(router.Buckets()))
+	}
+}
+
+func TestRouterMetrics(t *testing.T) {
+	router := NewRouter(nil, &Route{Name: "metrics", Bucket: &MockBucket{response: GoodResponse, size: 1}}, LongestPrefix, Response{})
+	req, _ := http.NewRequest("GET", "/static", nil)
+	matched := testutil.ToFloat64(routeRequests.WithLabelValues("metrics", "2xx"))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	if observed := testutil.ToFloat64(routeRequests.WithLabelValues("metrics", "2xx")); observed != matched+1 {
+		t.Error("Expected", matched+1, "got", observed)
+	}
+	unmatched := testutil.ToFloat64(routeRequests.WithLabelValues(noRoute, "4xx"))
+	NewRouter(nil, nil, LongestPrefix, Response{}).ServeHTTP(httptest.NewRecorder(), req)
+	if observed := testutil.ToFloat64(routeRequests.WithLabelValues(noRoute, "4xx")); observed != unmatched+1 {
+		t.Error("Expected", unmatched+1, "got", observed)
+	}
+}
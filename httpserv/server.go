@@ -1,40 +1,93 @@
 package httpserv
 
 import (
-	"fmt"
 	"net/http"
+	"sync/atomic"
 	"time"
 
 	"github.com/freundallein/loadbalancer/bucket"
+	"github.com/freundallein/loadbalancer/proxyproto"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
-	bucketSize = promauto.NewGauge(prometheus.GaugeOpts{
+	bucketSize = promauto.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "lb_bucket_size",
 		Help: "The total number of servers in bucket",
-	})
+	}, []string{"pool"})
 )
 
-func collectCustomMetrics(buck bucket.ServerBucket) {
+// CollectMetrics - periodically report sizes of current pools
+// Pools, which are gone after reload, are not reported anymore
+func CollectMetrics(pools func() map[string]bucket.ServerBucket) {
+	reported := map[string]bool{}
 	for {
 		select {
 		case <-time.After(5 * time.Second):
-			bucketSize.Set(float64(buck.Size()))
+			current := pools()
+			for name, buck := range current {
+				bucketSize.WithLabelValues(name).Set(float64(buck.Size()))
+				reported[name] = true
+			}
+			for name := range reported {
+				if _, ok := current[name]; !ok {
+					bucketSize.DeleteLabelValues(name)
+					delete(reported, name)
+				}
+			}
 		}
 	}
 }
 
-// New - http server constructor
-func New(port int, bckt bucket.ServerBucket) *http.Server {
-	go collectCustomMetrics(bckt)
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/healthz", Healthz(bckt))
-	http.HandleFunc("/", LoadBalance(bckt))
+// SwapHandler - handler, which can be atomically replaced at runtime
+type SwapHandler struct {
+	handler atomic.Value
+}
+
+// NewSwapHandler - swappable handler constructor
+func NewSwapHandler(handler http.Handler) *SwapHandler {
+	sh := &SwapHandler{}
+	sh.Swap(handler)
+	return sh
+}
+
+// Swap - replace handler for new requests, in-flight ones are not affected
+func (sh *SwapHandler) Swap(handler http.Handler) {
+	sh.handler.Store(&handler)
+}
+
+func (sh *SwapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler := *sh.handler.Load().(*http.Handler)
+	handler.ServeHTTP(w, r)
+}
+
+// Handler - serve requests and healthchecks with router's buckets
+func Handler(router *Router) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", Healthz(router))
+	mux.Handle("/", router)
+	return mux
+}
+
+// H2C - serve HTTP/2 over cleartext along with HTTP/1
+// Both prior knowledge and upgrade from HTTP/1.1 are supported
+func H2C(handler http.Handler) http.Handler {
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// New - http server constructor, exposing metrics along with handler
+func New(addr string, handler http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", handler)
 	server := &http.Server{
-		Addr: fmt.Sprintf(":%d", port),
+		Addr:        addr,
+		Handler:     mux,
+		ConnContext: proxyproto.WithConn,
 	}
 	return server
 }
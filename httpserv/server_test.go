@@ -1,16 +1,78 @@
 package httpserv
 
 import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+
+	"golang.org/x/net/http2"
 )
 
 func TestNew(t *testing.T) {
-	srv := New(9000, nil)
+	router := NewRouter(nil, &Route{Bucket: &MockBucket{response: GoodResponse, size: 1}}, LongestPrefix, Response{})
+	srv := New(":9000", Handler(router))
 	observedType := reflect.TypeOf(srv)
 	expectedType := reflect.TypeOf(&http.Server{})
 	if observedType != expectedType {
 		t.Error("Expected", expectedType, "got", observedType)
 	}
+	if srv.Addr != ":9000" {
+		t.Error("Expected", ":9000", "got", srv.Addr)
+	}
+	for path, expected := range map[string]int{"/metrics": http.StatusOK, "/healthz": http.StatusOK, "/any": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		srv.Handler.ServeHTTP(rec, req)
+		if rec.Code != expected {
+			t.Error(path, "expected", expected, "got", rec.Code)
+		}
+	}
+}
+
+func TestSwapHandler(t *testing.T) {
+	handler := func(body string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, body)
+		})
+	}
+	swap := NewSwapHandler(handler("old"))
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	swap.ServeHTTP(rec, req)
+	if rec.Body.String() != "old" {
+		t.Error("Expected", "old", "got", rec.Body.String())
+	}
+	swap.Swap(handler("new"))
+	rec = httptest.NewRecorder()
+	swap.ServeHTTP(rec, req)
+	if rec.Body.String() != "new" {
+		t.Error("Expected", "new", "got", rec.Body.String())
+	}
+}
+
+func TestH2C(t *testing.T) {
+	server := httptest.NewServer(H2C(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})))
+	defer server.Close()
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	res, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "HTTP/2.0" {
+		t.Error("Expected", "HTTP/2.0", "got", string(body))
+	}
 }
@@ -0,0 +1,237 @@
+package httpserv
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	certExpiry = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_tls_certificate_expiry_timestamp_seconds",
+		Help: "The unixtime when listener's certificate expires",
+	}, []string{"listener", "cert"})
+
+	ErrNoCertificates = errors.New("at least one certificate is required")
+
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+	cipherSuites = map[string]uint16{
+		"TLS_RSA_WITH_AES_128_CBC_SHA":                  tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_RSA_WITH_AES_256_CBC_SHA":                  tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_RSA_WITH_AES_128_GCM_SHA256":               tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_RSA_WITH_AES_256_GCM_SHA384":               tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	}
+)
+
+// ParseTLSVersion - protocol version by name like "1.2"
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+// ParseCipherSuites - cipher suites by IANA names
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := []uint16{}
+	for _, name := range names {
+		suite, ok := cipherSuites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		suites = append(suites, suite)
+	}
+	return suites, nil
+}
+
+// CertFiles - certificate and private key PEM files
+type CertFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// loadedCert - certificate along with its files state
+type loadedCert struct {
+	cert     *tls.Certificate
+	names    []string // DNS names certificate is valid for
+	modified time.Time
+}
+
+// CertStore - listener's certificates, chosen by SNI and reloaded when files change
+type CertStore struct {
+	listener string // metrics label
+	files    []CertFiles
+	lock     sync.RWMutex
+	certs    []*loadedCert // in files order, the first one is the default
+}
+
+// NewCertStore - load certificates, fails if any of them can't be loaded
+func NewCertStore(listener string, files []CertFiles) (*CertStore, error) {
+	if len(files) == 0 {
+		return nil, ErrNoCertificates
+	}
+	cs := &CertStore{listener: listener, files: files, certs: make([]*loadedCert, len(files))}
+	for i, f := range files {
+		loaded, err := cs.load(f)
+		if err != nil {
+			return nil, err
+		}
+		cs.certs[i] = loaded
+	}
+	return cs, nil
+}
+
+// load - read and parse certificate files, report expiry
+func (cs *CertStore) load(f CertFiles) (*loadedCert, error) {
+	modified := lastModified(f)
+	cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", f.CertFile, err.Error())
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", f.CertFile, err.Error())
+	}
+	cert.Leaf = leaf
+	names := leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	certExpiry.WithLabelValues(cs.listener, f.CertFile).Set(float64(leaf.NotAfter.Unix()))
+	return &loadedCert{cert: &cert, names: names, modified: modified}, nil
+}
+
+// lastModified - the latest modification time of certificate files
+func lastModified(f CertFiles) time.Time {
+	modified := time.Time{}
+	for _, path := range []string{f.CertFile, f.KeyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified
+}
+
+// Reload - load certificates, whose files were changed
+// Certificate, which fails to load, stays the same
+func (cs *CertStore) Reload() {
+	for i, f := range cs.files {
+		cs.lock.RLock()
+		current := cs.certs[i]
+		cs.lock.RUnlock()
+		if !lastModified(f).After(current.modified) {
+			continue
+		}
+		loaded, err := cs.load(f)
+		if err != nil {
+			log.Printf("[tls] %s reload failed: %s\n", f.CertFile, err.Error())
+			continue
+		}
+		cs.lock.Lock()
+		cs.certs[i] = loaded
+		cs.lock.Unlock()
+		log.Printf("[tls] %s reloaded, expires %s\n", f.CertFile, loaded.cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// Watch - periodically check certificate files for changes until context is done
+func (cs *CertStore) Watch(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cs.Reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// GetCertificate - choose certificate by server name, the first one is used if nothing matches
+// Exact names are preferred over wildcards
+func (cs *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	wildcard := ""
+	if i := strings.Index(name, "."); i > 0 {
+		wildcard = "*" + name[i:]
+	}
+	var matched *tls.Certificate
+	for _, loaded := range cs.certs {
+		for _, certName := range loaded.names {
+			certName = strings.ToLower(certName)
+			if certName == name {
+				return loaded.cert, nil
+			}
+			if matched == nil && wildcard != "" && certName == wildcard {
+				matched = loaded.cert
+			}
+		}
+	}
+	if matched != nil {
+		return matched, nil
+	}
+	return cs.certs[0].cert, nil
+}
+
+// TLSConfig - server TLS settings, using store's certificates
+// Cipher suites apply to TLS 1.2 and lower, defaults are used if empty
+func (cs *CertStore) TLSConfig(minVersion uint16, suites []uint16) *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: cs.GetCertificate,
+		MinVersion:     minVersion,
+	}
+	if len(suites) > 0 {
+		cfg.CipherSuites = suites
+	}
+	return cfg
+}
+
+// RedirectHTTPS - redirect requests to the same host and URL over HTTPS
+// Port is omitted from location, if it is the default one
+func RedirectHTTPS(port int, status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != 443 {
+			host += ":" + strconv.Itoa(port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+	})
+}
@@ -0,0 +1,146 @@
+package httpserv
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert - write self-signed certificate for names into dir
+func writeCert(t *testing.T, dir, name string, notAfter time.Time, names ...string) CertFiles {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	files := CertFiles{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+	ioutil.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return files
+}
+
+func leafName(t *testing.T, cs *CertStore, serverName string) string {
+	cert, err := cs.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "certs")
+	defer os.RemoveAll(dir)
+	expires := time.Now().Add(24 * time.Hour)
+	store, err := NewCertStore("test", []CertFiles{
+		writeCert(t, dir, "default", expires, "example.com"),
+		writeCert(t, dir, "wildcard", expires, "*.example.com"),
+		writeCert(t, dir, "api", expires, "api.example.com"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]string{
+		"api.example.com": "api.example.com",
+		"API.example.com": "api.example.com",
+		"www.example.com": "*.example.com",
+		"example.com":     "example.com",
+		"other.org":       "example.com",
+		"":                "example.com",
+	}
+	for serverName, expected := range cases {
+		if observed := leafName(t, store, serverName); observed != expected {
+			t.Error("Expected", expected, "got", observed, "for", serverName)
+		}
+	}
+	if _, err := NewCertStore("test", nil); err != ErrNoCertificates {
+		t.Error("Expected", ErrNoCertificates, "got", err)
+	}
+	if _, err := NewCertStore("test", []CertFiles{{CertFile: filepath.Join(dir, "missing.crt")}}); err == nil {
+		t.Error("Expected", "load error", "got", nil)
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "certs")
+	defer os.RemoveAll(dir)
+	files := writeCert(t, dir, "site", time.Now().Add(time.Hour), "old.example.com")
+	store, err := NewCertStore("test", []CertFiles{files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCert(t, dir, "site", time.Now().Add(time.Hour), "new.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(files.CertFile, future, future)
+	store.Reload()
+	if observed := leafName(t, store, ""); observed != "new.example.com" {
+		t.Error("Expected", "new.example.com", "got", observed)
+	}
+
+	ioutil.WriteFile(files.CertFile, []byte("broken"), 0600)
+	later := future.Add(time.Minute)
+	os.Chtimes(files.CertFile, later, later)
+	store.Reload()
+	if observed := leafName(t, store, ""); observed != "new.example.com" {
+		t.Error("Expected", "kept certificate", "got", observed)
+	}
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	if version, err := ParseTLSVersion("1.3"); err != nil || version != tls.VersionTLS13 {
+		t.Error("Expected", tls.VersionTLS13, "got", version, err)
+	}
+	if _, err := ParseTLSVersion("1.4"); err == nil {
+		t.Error("Expected", "unknown version error", "got", nil)
+	}
+	suites, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil || len(suites) != 1 || suites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Error("Expected", "one suite", "got", suites, err)
+	}
+	if _, err := ParseCipherSuites([]string{"TLS_NULL"}); err == nil {
+		t.Error("Expected", "unknown suite error", "got", nil)
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	cases := []struct {
+		port     int
+		host     string
+		expected string
+	}{
+		{443, "example.com:8080", "https://example.com/path?q=1"},
+		{8443, "example.com", "https://example.com:8443/path?q=1"},
+		{443, "[::1]:80", "https://[::1]/path?q=1"},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest(http.MethodPost, "/path?q=1", nil)
+		req.Host = c.host
+		rec := httptest.NewRecorder()
+		RedirectHTTPS(c.port, http.StatusPermanentRedirect).ServeHTTP(rec, req)
+		if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != c.expected {
+			t.Error("Expected", c.expected, "got", rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package httpserv
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// statusWriter - response writer, remembering status code and body size
+// Keeps flushing and hijacking available for streaming and upgraded connections
+type statusWriter struct {
+	http.ResponseWriter
+	status   int
+	size     int64
+	onHeader func(http.Header) // called once, right before headers are sent
+}
+
+// WriteHeader - remember the final status, informational ones, like 103 Early Hints, are passed as is
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		sw.status = status
+		if sw.onHeader != nil {
+			sw.onHeader(sw.Header())
+		}
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(data []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	n, err := sw.ResponseWriter.Write(data)
+	sw.size += int64(n)
+	return n, err
+}
+
+// Flush - flush buffered data to client if supported
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack - take over client connection, used by protocol upgrades
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	if sw.status == 0 {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
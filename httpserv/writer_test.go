@@ -0,0 +1,44 @@
+package httpserv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sw := &statusWriter{ResponseWriter: rec}
+	sw.Write([]byte("hello"))
+	sw.WriteHeader(500)
+	sw.Flush()
+	if sw.status != 200 {
+		t.Error("Expected", 200, "got", sw.status)
+	}
+	if sw.size != 5 {
+		t.Error("Expected", 5, "got", sw.size)
+	}
+	if !rec.Flushed {
+		t.Error("Expected", "flushed recorder")
+	}
+	if _, _, err := sw.Hijack(); err == nil {
+		t.Error("Expected", "hijack error", "got", nil)
+	}
+}
+
+func TestStatusWriterInformational(t *testing.T) {
+	rec := httptest.NewRecorder()
+	calls := 0
+	sw := &statusWriter{ResponseWriter: rec, onHeader: func(header http.Header) {
+		calls++
+		header.Set("X-Final", "yes")
+	}}
+	sw.WriteHeader(http.StatusEarlyHints)
+	sw.WriteHeader(http.StatusCreated)
+	if sw.status != http.StatusCreated || calls != 1 {
+		t.Error("Expected", http.StatusCreated, 1, "got", sw.status, calls)
+	}
+	if rec.Header().Get("X-Final") != "yes" {
+		t.Error("Expected", "header rules applied to final response", "got", rec.Header())
+	}
+}
@@ -1,22 +1,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/freundallein/loadbalancer/bucket"
-	"github.com/freundallein/loadbalancer/httpserv"
+	"github.com/freundallein/loadbalancer/app"
+	"github.com/freundallein/loadbalancer/config"
+	"github.com/freundallein/loadbalancer/upgrade"
 )
 
 const (
-	timeFormat      = "02.01.2006 15:04:05"
-	serversEnvKey   = "ADDRS"
-	portKey         = "PORT"
-	staleTimeoutKey = "STALE_TIMEOUT"
+	timeFormat = "02.01.2006 15:04:05"
 )
 
 type logWriter struct {
@@ -28,65 +27,76 @@ func (writer logWriter) Write(bytes []byte) (int, error) {
 	return fmt.Print(msg)
 }
 
-func getEnv(key string, fallback string) (string, error) {
-	if value := os.Getenv(key); value != "" {
-		return value, nil
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(app.CheckConfig(os.Args[2:], os.Stdout))
 	}
-	return fallback, nil
-}
 
-func getIntEnv(key string, fallback int) (int, error) {
-	if v := os.Getenv(key); v != "" {
-		i, err := strconv.ParseInt(v, 10, 64)
-		if err != nil {
-			return fallback, err
-		}
-		return int(i), nil
-	}
-	return fallback, nil
-}
-
-func main() {
 	log.SetFlags(0)
 	log.SetOutput(new(logWriter))
 
-	addresses, err := getEnv(serversEnvKey, "")
-	if err != nil {
-		log.Fatalf("[config] %s", err.Error())
-	}
-	port, err := getIntEnv(portKey, 8000)
-	if err != nil {
-		log.Fatalf("[config] %s", err.Error())
-	}
-	staleTimeout, err := getIntEnv(staleTimeoutKey, 60)
+	cfg, err := config.FromEnv()
 	if err != nil {
 		log.Fatalf("[config] %s", err.Error())
 	}
 
-	if len(addresses) == 0 {
-		log.Fatal("[config] No addresses provided")
+	inherited, err := upgrade.Inherit()
+	if err != nil {
+		log.Fatalf("[upgrade] %s", err.Error())
 	}
 
 	log.Println("[config] starting loadbalancer...")
-	buckt, err := bucket.New(bucket.RoundRobin)
+	application, err := app.New(cfg, config.FromEnv)
 	if err != nil {
 		log.Fatalf("[config] %s", err.Error())
 	}
-	items := strings.Split(addresses, ",")
-	for _, addr := range items {
-		srv, err := bucket.NewServer(addr)
-		if err != nil {
+	application.Inherit(inherited)
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			log.Println("[reload] SIGHUP received")
+			application.Reload()
+		}
+	}()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- application.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	upgrades := make(chan os.Signal, 1)
+	signal.Notify(upgrades, syscall.SIGUSR2)
+	for running := true; running; {
+		select {
+		case err := <-errs:
 			log.Fatal(err)
+		case <-upgrades:
+			log.Println("[upgrade] SIGUSR2 received, starting new process")
+			if err := application.Upgrade(); err != nil {
+				log.Printf("[upgrade] failed, keep serving: %s\n", err.Error())
+				continue
+			}
+			log.Println("[upgrade] handed over listeners, draining connections")
+			running = false
+		case sig := <-stop:
+			log.Printf("[shutdown] %s received, draining connections\n", sig)
+			upgrade.Notify("STOPPING=1")
+			running = false
 		}
-		buckt.AddServer(srv)
-		log.Printf("[config] server %s added\n", addr)
 	}
-	buckt.RunServices(staleTimeout)
-	log.Println("[config] servers bucket started")
-	server := httpserv.New(port, buckt)
 
-	log.Printf("[config] httpserv started at :%d\n", port)
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		sig := <-stop
+		log.Printf("[shutdown] %s received again, closing connections\n", sig)
+		cancel()
+	}()
+	if err := application.Shutdown(ctx); err != nil {
+		log.Printf("[shutdown] %s\n", err.Error())
 	}
+	log.Println("[shutdown] loadbalancer stopped")
 }
@@ -0,0 +1,50 @@
+package proxyproto
+
+import (
+	"context"
+	"net"
+)
+
+type connKey struct{}
+
+// DialFunc - dialing function, like net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// WithConn - remember client connection, its addresses are sent to backends
+// Use as http.Server.ConnContext, addresses are resolved lazily on dial.
+func WithConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// ConnFromContext - client connection of request, nil if unknown
+func ConnFromContext(ctx context.Context) net.Conn {
+	if conn, ok := ctx.Value(connKey{}).(net.Conn); ok {
+		return conn
+	}
+	return nil
+}
+
+// Dialer - wrap dial function to send PROXY protocol header after connecting
+// Client connection is taken from context, header without addresses is sent if there is none.
+// Connections carry a single client, so transport must not reuse them for others.
+func Dialer(version int, dial DialFunc) (DialFunc, error) {
+	if version != V1 && version != V2 {
+		return nil, ErrInvalidVersion
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		var source, destination net.Addr
+		if client := ConnFromContext(ctx); client != nil {
+			source, destination = client.RemoteAddr(), client.LocalAddr()
+		}
+		header, _ := NewHeader(version, source, destination)
+		if _, err := conn.Write(header.Bytes()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}, nil
+}
@@ -0,0 +1,212 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Protocol versions
+const (
+	V1 = 1
+	V2 = 2
+)
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107 // including CRLF
+	v2HeaderLen = 16
+
+	v2CommandLocal = 0x20
+	v2CommandProxy = 0x21
+	v2FamilyTCP4   = 0x11
+	v2FamilyTCP6   = 0x21
+	v2FamilyUnspec = 0x00
+)
+
+var (
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	ErrInvalidHeader  = errors.New("invalid PROXY protocol header")
+	ErrInvalidVersion = errors.New("PROXY protocol version must be 1 or 2")
+)
+
+// Header - PROXY protocol header
+// Nil addresses mean the connection was made by the proxy itself (UNKNOWN or LOCAL)
+type Header struct {
+	Version     int
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// NewHeader - header for connection between source and destination
+// Addresses of other types produce UNKNOWN (v1) or LOCAL (v2) header
+func NewHeader(version int, source, destination net.Addr) (*Header, error) {
+	if version != V1 && version != V2 {
+		return nil, ErrInvalidVersion
+	}
+	header := &Header{Version: version}
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+	if srcOk && dstOk && (src.IP.To4() == nil) == (dst.IP.To4() == nil) {
+		header.Source, header.Destination = src, dst
+	}
+	return header, nil
+}
+
+// Bytes - header in wire format
+func (h *Header) Bytes() []byte {
+	if h.Version == V1 {
+		return h.v1()
+	}
+	return h.v2()
+}
+
+func (h *Header) v1() []byte {
+	if h.Source == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if h.Source.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf(
+		"PROXY %s %s %s %d %d\r\n",
+		family, h.Source.IP.String(), h.Destination.IP.String(), h.Source.Port, h.Destination.Port,
+	))
+}
+
+func (h *Header) v2() []byte {
+	buf := bytes.NewBuffer(append([]byte{}, v2Signature...))
+	if h.Source == nil {
+		buf.Write([]byte{v2CommandLocal, v2FamilyUnspec, 0, 0})
+		return buf.Bytes()
+	}
+	src, dst, family := h.Source.IP.To4(), h.Destination.IP.To4(), byte(v2FamilyTCP4)
+	if src == nil {
+		src, dst, family = h.Source.IP.To16(), h.Destination.IP.To16(), v2FamilyTCP6
+	}
+	buf.Write([]byte{v2CommandProxy, family})
+	binary.Write(buf, binary.BigEndian, uint16(2*len(src)+4))
+	buf.Write(src)
+	buf.Write(dst)
+	binary.Write(buf, binary.BigEndian, uint16(h.Source.Port))
+	binary.Write(buf, binary.BigEndian, uint16(h.Destination.Port))
+	return buf.Bytes()
+}
+
+// Read - parse header from reader, if there is one
+// Returns nil header without consuming anything, when data doesn't start with a header
+func Read(reader *bufio.Reader) (*Header, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		prefix, err := reader.Peek(len(v1Prefix))
+		if err != nil || string(prefix) != v1Prefix {
+			return nil, nil
+		}
+		return readV1(reader)
+	case v2Signature[0]:
+		prefix, err := reader.Peek(len(v2Signature))
+		if err != nil || !bytes.Equal(prefix, v2Signature) {
+			return nil, nil
+		}
+		return readV2(reader)
+	}
+	return nil, nil
+}
+
+func readV1(reader *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, v1MaxLength)
+	for len(line) < v1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	header := &Header{Version: V1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	src, srcErr := parseAddr(fields[2], fields[4])
+	dst, dstErr := parseAddr(fields[3], fields[5])
+	if srcErr != nil || dstErr != nil || (src.IP.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, ErrInvalidHeader
+	}
+	header.Source, header.Destination = src, dst
+	return header, nil
+}
+
+func readV2(reader *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, v2HeaderLen)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, err
+	}
+	command, family := fixed[12], fixed[13]
+	payload := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	header := &Header{Version: V2}
+	switch {
+	case command == v2CommandLocal:
+		return header, nil
+	case command != v2CommandProxy:
+		return nil, ErrInvalidHeader
+	}
+	size := 0
+	switch family {
+	case v2FamilyTCP4:
+		size = net.IPv4len
+	case v2FamilyTCP6:
+		size = net.IPv6len
+	default:
+		// UDP and unix sockets are not proxied, treat as unknown source
+		return header, nil
+	}
+	if len(payload) < 2*size+4 {
+		return nil, ErrInvalidHeader
+	}
+	ports := payload[2*size:]
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, payload[:size]...)),
+		Port: int(binary.BigEndian.Uint16(ports)),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(append([]byte{}, payload[size:2*size]...)),
+		Port: int(binary.BigEndian.Uint16(ports[2:])),
+	}
+	return header, nil
+}
+
+func parseAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, ErrInvalidHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
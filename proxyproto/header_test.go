@@ -0,0 +1,91 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func tcpAddr(addr string) *net.TCPAddr {
+	resolved, _ := net.ResolveTCPAddr("tcp", addr)
+	return resolved
+}
+
+func TestHeaderV1Bytes(t *testing.T) {
+	cases := map[string]*Header{
+		"PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n":   {Version: V1, Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("192.0.2.2:443")},
+		"PROXY TCP6 2001:db8::1 2001:db8::2 4711 80\r\n": {Version: V1, Source: tcpAddr("[2001:db8::1]:4711"), Destination: tcpAddr("[2001:db8::2]:80")},
+		"PROXY UNKNOWN\r\n":                              {Version: V1},
+	}
+	for expected, header := range cases {
+		if observed := string(header.Bytes()); observed != expected {
+			t.Error("Expected", expected, "got", observed)
+		}
+	}
+}
+
+func TestNewHeaderMixedFamilies(t *testing.T) {
+	header, _ := NewHeader(V2, tcpAddr("192.0.2.1:1"), tcpAddr("[2001:db8::2]:80"))
+	if header.Source != nil {
+		t.Error("Expected", "local header", "got", header.Source)
+	}
+	if _, err := NewHeader(3, nil, nil); err != ErrInvalidVersion {
+		t.Error("Expected", ErrInvalidVersion, "got", err)
+	}
+}
+
+func TestReadRoundTrip(t *testing.T) {
+	headers := []*Header{
+		{Version: V1, Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("192.0.2.2:443")},
+		{Version: V1, Source: tcpAddr("[2001:db8::1]:4711"), Destination: tcpAddr("[2001:db8::2]:80")},
+		{Version: V2, Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("192.0.2.2:443")},
+		{Version: V2, Source: tcpAddr("[2001:db8::1]:4711"), Destination: tcpAddr("[2001:db8::2]:80")},
+		{Version: V1},
+		{Version: V2},
+	}
+	for _, header := range headers {
+		reader := bufio.NewReader(bytes.NewReader(append(header.Bytes(), "GET / HTTP/1.1\r\n"...)))
+		observed, err := Read(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if observed.Version != header.Version ||
+			!reflect.DeepEqual(observed.Source.String(), header.Source.String()) ||
+			!reflect.DeepEqual(observed.Destination.String(), header.Destination.String()) {
+			t.Error("Expected", header, "got", observed)
+		}
+		rest, _ := reader.ReadString('\n')
+		if rest != "GET / HTTP/1.1\r\n" {
+			t.Error("Expected", "request line", "got", rest)
+		}
+	}
+}
+
+func TestReadWithoutHeader(t *testing.T) {
+	for _, data := range []string{"GET / HTTP/1.1\r\n", "POST / HTTP/1.1\r\n", "\r\n\r\nnot a signature"} {
+		reader := bufio.NewReader(strings.NewReader(data))
+		header, err := Read(reader)
+		if header != nil || err != nil {
+			t.Error("Expected", nil, "got", header, err)
+		}
+		if rest, _ := reader.ReadString(0); rest != data {
+			t.Error("Expected", data, "got", rest)
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	for _, data := range []string{
+		"PROXY TCP4 192.0.2.1\r\n",
+		"PROXY TCP4 2001:db8::1 192.0.2.2 1 2\r\n",
+		"PROXY TCP4 192.0.2.1 192.0.2.2 1 99999\r\n",
+		"PROXY " + strings.Repeat("x", 200),
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(data))); err == nil {
+			t.Error("Expected", "error", "got", nil, "for", data)
+		}
+	}
+}
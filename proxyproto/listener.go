@@ -0,0 +1,133 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTimeout = 5 * time.Second
+
+// Listener - accepts connections, prefixed with PROXY protocol header
+// Headers are honoured only from trusted sources, connections without header are served as is.
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet  // no source is trusted if empty
+	timeout time.Duration // header read deadline
+}
+
+// NewListener - wrap listener, trusted sources are CIDRs or plain IP addresses
+func NewListener(inner net.Listener, trustedSources []string, timeout time.Duration) (*Listener, error) {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ln := &Listener{Listener: inner, timeout: timeout}
+	for _, source := range trustedSources {
+		if !strings.Contains(source, "/") {
+			if ip := net.ParseIP(source); ip != nil && ip.To4() != nil {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, err
+		}
+		ln.trusted = append(ln.trusted, network)
+	}
+	return ln, nil
+}
+
+// Accept - wait for the next connection
+// Header is read lazily, so slow clients don't block accepting loop
+func (ln *Listener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !ln.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, reader: bufio.NewReader(conn), timeout: ln.timeout}, nil
+}
+
+func (ln *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range ln.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn - connection with addresses taken from PROXY protocol header
+type Conn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	once    sync.Once
+	header  *Header
+	err     error
+}
+
+// readHeader - read header within timeout once
+// Clients sending nothing until then, like ones of server-first protocols, are served without header.
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+		if _, err := c.reader.Peek(1); err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return
+			}
+		}
+		c.header, c.err = Read(c.reader)
+	})
+}
+
+// Header - parsed PROXY protocol header, nil if connection had none
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+	return c.header, c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr - client address from header, or peer address
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr - address client connected to from header, or local address
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite - shut down writing side, if underlying connection supports it
+func (c *Conn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return closer.CloseWrite()
+	}
+	return c.Conn.Close()
+}
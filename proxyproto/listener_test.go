@@ -0,0 +1,143 @@
+package proxyproto
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func accept(t *testing.T, ln net.Listener, send string) (net.Conn, net.Conn) {
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte(send))
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, conn
+}
+
+func TestListener(t *testing.T) {
+	inner, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln, err := NewListener(inner, []string{"127.0.0.1"}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, conn := accept(t, ln, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\nping\n")
+	defer client.Close()
+	defer conn.Close()
+	if addr := conn.RemoteAddr().String(); addr != "192.0.2.1:56324" {
+		t.Error("Expected", "192.0.2.1:56324", "got", addr)
+	}
+	if addr := conn.LocalAddr().String(); addr != "192.0.2.2:443" {
+		t.Error("Expected", "192.0.2.2:443", "got", addr)
+	}
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "ping\n" {
+		t.Error("Expected", "ping", "got", line)
+	}
+
+	plainClient, conn := accept(t, ln, "ping\n")
+	defer plainClient.Close()
+	defer conn.Close()
+	if addr := conn.RemoteAddr().(*net.TCPAddr).IP.String(); addr != "127.0.0.1" {
+		t.Error("Expected", "peer address", "got", addr)
+	}
+}
+
+func TestListenerUntrustedSource(t *testing.T) {
+	inner, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln, _ := NewListener(inner, []string{"10.0.0.0/8"}, time.Second)
+	defer ln.Close()
+	client, conn := accept(t, ln, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+	defer client.Close()
+	defer conn.Close()
+	if _, ok := conn.(*Conn); ok {
+		t.Error("Expected", "plain connection", "got", conn)
+	}
+	nobody, _ := NewListener(inner, nil, time.Second)
+	client, conn = accept(t, nobody, "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+	defer client.Close()
+	defer conn.Close()
+	if _, ok := conn.(*Conn); ok {
+		t.Error("Expected", "plain connection without trusted sources", "got", conn)
+	}
+	if _, err := NewListener(inner, []string{"10.0.0.0/33"}, 0); err == nil {
+		t.Error("Expected", "invalid CIDR error", "got", nil)
+	}
+}
+
+func TestListenerTimeout(t *testing.T) {
+	inner, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln, _ := NewListener(inner, []string{"127.0.0.1"}, 50*time.Millisecond)
+	defer ln.Close()
+	client, conn := accept(t, ln, "PROXY TCP4")
+	defer client.Close()
+	defer conn.Close()
+	started := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected", "timeout error", "got", nil)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Error("Expected", "header timeout", "got", elapsed)
+	}
+}
+
+func TestListenerSilentClient(t *testing.T) {
+	inner, _ := net.Listen("tcp", "127.0.0.1:0")
+	ln, _ := NewListener(inner, []string{"127.0.0.1"}, 50*time.Millisecond)
+	defer ln.Close()
+	client, conn := accept(t, ln, "")
+	defer client.Close()
+	defer conn.Close()
+	header, err := conn.(*Conn).Header()
+	if header != nil || err != nil {
+		t.Error("Expected", "no header", "got", header, err)
+	}
+	if addr := conn.RemoteAddr().(*net.TCPAddr).IP.String(); addr != "127.0.0.1" {
+		t.Error("Expected", "peer address", "got", addr)
+	}
+	time.Sleep(100 * time.Millisecond)
+	client.Write([]byte("QUIT\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); line != "QUIT\n" {
+		t.Error("Expected", "QUIT", "got", line, err)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	backend, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer backend.Close()
+	received := make(chan *Header, 1)
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header, _ := Read(bufio.NewReader(conn))
+		received <- header
+	}()
+	dial, err := Dialer(V2, (&net.Dialer{}).DialContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Conn{header: &Header{Source: tcpAddr("192.0.2.1:56324"), Destination: tcpAddr("192.0.2.2:443")}}
+	client.once.Do(func() {})
+	conn, err := dial(WithConn(context.Background(), client), "tcp", backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header := <-received
+	if header.Version != V2 || header.Source.String() != "192.0.2.1:56324" || header.Destination.String() != "192.0.2.2:443" {
+		t.Error("Expected", "client addresses", "got", header)
+	}
+	if _, err := Dialer(0, nil); err != ErrInvalidVersion {
+		t.Error("Expected", ErrInvalidVersion, "got", err)
+	}
+}
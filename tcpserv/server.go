@@ -0,0 +1,185 @@
+package tcpserv
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const shutdownPollInterval = 100 * time.Millisecond
+
+var (
+	ErrServerClosed = errors.New("tcpserv: Server closed")
+)
+
+// Handler - serves raw connection and closes it when done, like servers bucket
+type Handler interface {
+	ServeConn(net.Conn) error
+}
+
+// Server - raw TCP connections server, handler can be atomically replaced at runtime
+type Server struct {
+	Addr    string
+	handler atomic.Value // current *Handler
+
+	lock      sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+// New - tcp server constructor
+func New(addr string, handler Handler) *Server {
+	srv := &Server{
+		Addr:      addr,
+		listeners: map[net.Listener]bool{},
+		conns:     map[net.Conn]bool{},
+	}
+	srv.Swap(handler)
+	return srv
+}
+
+// Swap - replace handler for new connections, open ones are not affected
+func (srv *Server) Swap(handler Handler) {
+	srv.handler.Store(&handler)
+}
+
+// Serve - accept connections on listener and serve each one in its own goroutine
+// Always returns non-nil error, ErrServerClosed after Close.
+func (srv *Server) Serve(ln net.Listener) error {
+	if !srv.track(ln, true) {
+		return ErrServerClosed
+	}
+	defer srv.track(ln, false)
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = backoff(delay)
+				log.Printf("[tcp] accept error: %s; retrying in %s\n", err.Error(), delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go srv.serve(conn)
+	}
+}
+
+func (srv *Server) serve(conn net.Conn) {
+	if !srv.trackConn(conn, true) {
+		conn.Close()
+		return
+	}
+	defer srv.trackConn(conn, false)
+	handler := *srv.handler.Load().(*Handler)
+	if err := handler.ServeConn(conn); err != nil {
+		log.Printf("[tcp] %s %s\n", conn.RemoteAddr(), err.Error())
+	}
+}
+
+// Close - stop listeners and close open connections
+func (srv *Server) Close() error {
+	err := srv.closeListeners()
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// Shutdown - stop listeners and wait for open connections to finish
+// When ctx is done first, remaining connections are closed and ctx error is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	err := srv.closeListeners()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if srv.open() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			srv.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (srv *Server) closeListeners() error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.closed = true
+	var err error
+	for ln := range srv.listeners {
+		if cerr := ln.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// open - amount of connections being served
+func (srv *Server) open() int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return len(srv.conns)
+}
+
+func (srv *Server) isClosed() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.closed
+}
+
+// track - register or forget listener, false if server is closed
+func (srv *Server) track(ln net.Listener, add bool) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if !add {
+		delete(srv.listeners, ln)
+		return true
+	}
+	if srv.closed {
+		return false
+	}
+	srv.listeners[ln] = true
+	return true
+}
+
+// trackConn - register or forget connection, false if server is closed
+func (srv *Server) trackConn(conn net.Conn, add bool) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if !add {
+		delete(srv.conns, conn)
+		return true
+	}
+	if srv.closed {
+		return false
+	}
+	srv.conns[conn] = true
+	return true
+}
+
+// backoff - pause after temporary accept error, doubled up to a second
+func backoff(delay time.Duration) time.Duration {
+	if delay == 0 {
+		return 5 * time.Millisecond
+	}
+	if delay *= 2; delay > time.Second {
+		return time.Second
+	}
+	return delay
+}
@@ -0,0 +1,131 @@
+package tcpserv
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// greeter - handler writing its name to every connection
+type greeter string
+
+func (g greeter) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	_, err := conn.Write([]byte(g))
+	return err
+}
+
+// blocker - handler holding connections until they are closed
+type blocker struct{}
+
+func (blocker) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	_, err := ioutil.ReadAll(conn)
+	return err
+}
+
+func start(t *testing.T, srv *Server) (net.Listener, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+	return ln, errs
+}
+
+func greeting(t *testing.T, address string) string {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data, _ := ioutil.ReadAll(conn)
+	return string(data)
+}
+
+func TestServeAndSwap(t *testing.T) {
+	srv := New("127.0.0.1:0", greeter("one"))
+	ln, _ := start(t, srv)
+	defer srv.Close()
+	if observed := greeting(t, ln.Addr().String()); observed != "one" {
+		t.Error("Expected", "one", "got", observed)
+	}
+	srv.Swap(greeter("two"))
+	if observed := greeting(t, ln.Addr().String()); observed != "two" {
+		t.Error("Expected", "two", "got", observed)
+	}
+}
+
+func TestClose(t *testing.T) {
+	srv := New("127.0.0.1:0", blocker{})
+	ln, errs := start(t, srv)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 100 && srv.open() == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	srv.Close()
+	select {
+	case err := <-errs:
+		if err != ErrServerClosed {
+			t.Error("Expected", ErrServerClosed, "got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected", "Serve returned", "got", "timeout")
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected", "open connection closed", "got", nil)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("Expected", "open connection closed", "got", err)
+	}
+	if err := srv.Serve(ln); err != ErrServerClosed {
+		t.Error("Expected", ErrServerClosed, "got", err)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	srv := New("127.0.0.1:0", blocker{})
+	ln, errs := start(t, srv)
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && srv.open() == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Shutdown(context.Background())
+	}()
+	if err := <-errs; err != ErrServerClosed {
+		t.Error("Expected", ErrServerClosed, "got", err)
+	}
+	select {
+	case err := <-done:
+		t.Error("Expected", "open connection waited for", "got", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error("Expected", nil, "got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected", "shutdown after connection closed", "got", "timeout")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := New("127.0.0.1:0", blocker{}).Shutdown(ctx); err != nil {
+		t.Error("Expected", "idle server shut down", "got", err)
+	}
+}
@@ -0,0 +1,306 @@
+package udpserv
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/freundallein/loadbalancer/bucket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	DefaultIdleTimeout = 30 * time.Second
+	DefaultMaxSessions = 10000
+
+	maxDatagram = 65535
+)
+
+var (
+	udpSessions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "lb_udp_sessions",
+		Help: "The number of client sessions in UDP listener's table",
+	}, []string{"listener"})
+	udpDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "lb_udp_dropped_total",
+		Help: "The total datagrams of new clients dropped, because UDP listener's session table is full",
+	}, []string{"listener"})
+
+	ErrServerClosed  = errors.New("udpserv: Server closed")
+	ErrSessionClosed = errors.New("session expired")
+)
+
+// Balancer - chooses server for a client flow or a single datagram, counts datagrams and ejects
+// refusing servers, like servers bucket
+type Balancer interface {
+	Next() (bucket.Server, error)
+	CountDatagram(bucket.Server, string, int)
+	Eject(bucket.Server, string)
+}
+
+// Server - UDP proxy, mapping client addresses to servers with a session table
+// Sessions without datagrams in either direction for IdleTimeout are expired.
+// Datagrams of new clients are dropped, while the table has MaxSessions sessions.
+type Server struct {
+	Addr        string
+	IdleTimeout time.Duration // DefaultIdleTimeout if zero
+	MaxSessions int           // DefaultMaxSessions if zero
+	PerPacket   bool          // choose server for every datagram, not once per client flow
+	balancer    atomic.Value  // current *Balancer
+
+	lock     sync.Mutex
+	conn     net.PacketConn
+	sessions map[string]*session // by client address
+	closed   bool
+}
+
+// session - client flow with its connected sockets toward servers
+type session struct {
+	lastSeen int64 // unixnano of the last datagram, first for atomic alignment
+	client   net.Addr
+
+	lock      sync.Mutex
+	upstreams map[bucket.Server]net.Conn
+	flow      bucket.Server // server of per-flow session
+	closed    bool          // expired, no new sockets
+}
+
+// New - udp server constructor
+func New(addr string, balancer Balancer) *Server {
+	srv := &Server{Addr: addr, sessions: map[string]*session{}}
+	srv.Swap(balancer)
+	return srv
+}
+
+// Swap - replace balancer for new flows, existing sessions keep their servers while they are available
+func (srv *Server) Swap(balancer Balancer) {
+	srv.balancer.Store(&balancer)
+}
+
+// current - balancer of new flows, servers removed from it aren't counted and ejected in its metrics
+func (srv *Server) current() Balancer {
+	return *srv.balancer.Load().(*Balancer)
+}
+
+// Serve - read client datagrams from conn and forward them to servers, server has a single conn
+// Always returns non-nil error, ErrServerClosed after Close.
+func (srv *Server) Serve(conn net.PacketConn) error {
+	srv.lock.Lock()
+	if srv.closed {
+		srv.lock.Unlock()
+		return ErrServerClosed
+	}
+	srv.conn = conn
+	srv.lock.Unlock()
+	go srv.expire()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			if srv.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if sess := srv.session(client); sess != nil {
+			srv.forward(sess, buf[:n])
+		}
+	}
+}
+
+// Close - stop reading datagrams and expire all sessions
+func (srv *Server) Close() error {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.closed = true
+	for key, sess := range srv.sessions {
+		sess.close()
+		delete(srv.sessions, key)
+	}
+	udpSessions.WithLabelValues(srv.Addr).Set(0)
+	if srv.conn == nil {
+		return nil
+	}
+	return srv.conn.Close()
+}
+
+func (srv *Server) isClosed() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.closed
+}
+
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout > 0 {
+		return srv.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (srv *Server) maxSessions() int {
+	if srv.MaxSessions > 0 {
+		return srv.MaxSessions
+	}
+	return DefaultMaxSessions
+}
+
+// session - client's session, created on the first datagram, nil if the table is full
+func (srv *Server) session(client net.Addr) *session {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	key := client.String()
+	sess, ok := srv.sessions[key]
+	if !ok {
+		if len(srv.sessions) >= srv.maxSessions() {
+			udpDropped.WithLabelValues(srv.Addr).Inc()
+			return nil
+		}
+		sess = &session{client: client, upstreams: map[bucket.Server]net.Conn{}}
+		srv.sessions[key] = sess
+		udpSessions.WithLabelValues(srv.Addr).Set(float64(len(srv.sessions)))
+	}
+	sess.touch()
+	return sess
+}
+
+// forward - send datagram to session's server
+// Server refusing datagram is marked unavailable and datagram goes to the next one.
+func (srv *Server) forward(sess *session, data []byte) {
+	for attempt := 0; attempt < 2; attempt++ {
+		target, conn, err := srv.upstream(sess)
+		if err != nil {
+			log.Printf("[udp] %s %s\n", sess.client, err.Error())
+			return
+		}
+		if _, err := conn.Write(data); err != nil {
+			log.Printf("[%s] %s\n", target.Address(), err.Error())
+			srv.current().Eject(target, bucket.EjectConnectError)
+			sess.drop(target, conn)
+			continue
+		}
+		srv.current().CountDatagram(target, bucket.DatagramIn, len(data))
+		return
+	}
+}
+
+// upstream - socket toward the session's server, chosen by balancer for a new flow or every datagram
+// Per-flow session moves to another server, when its one becomes unavailable or disabled.
+// Draining server keeps its flows.
+func (srv *Server) upstream(sess *session) (bucket.Server, net.Conn, error) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if sess.closed {
+		return nil, nil, ErrSessionClosed
+	}
+	if !srv.PerPacket && sess.flow != nil && sess.flow.IsAvailable() && sess.flow.State() != bucket.StateDisabled {
+		return sess.flow, sess.upstreams[sess.flow], nil
+	}
+	target, err := srv.current().Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, ok := sess.upstreams[target]
+	if !ok {
+		conn, err = target.Dial(context.Background())
+		if err != nil {
+			return nil, nil, err
+		}
+		sess.upstreams[target] = conn
+		target.AddInFlight(1)
+		go srv.relay(sess, target, conn)
+	}
+	if !srv.PerPacket {
+		if previous, ok := sess.upstreams[sess.flow]; ok && sess.flow != target {
+			previous.Close()
+		}
+		sess.flow = target
+	}
+	return target, conn, nil
+}
+
+// relay - pass server's datagrams back to client until socket is closed
+func (srv *Server) relay(sess *session, target bucket.Server, conn net.Conn) {
+	defer sess.drop(target, conn)
+	address := target.Address().String()
+	buf := make([]byte, maxDatagram)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				log.Printf("[%s] %s\n", address, err.Error())
+				srv.current().Eject(target, bucket.EjectConnectError)
+			}
+			return
+		}
+		sess.touch()
+		if _, err := srv.conn.WriteTo(buf[:n], sess.client); err != nil {
+			log.Printf("[udp] %s %s\n", sess.client, err.Error())
+			continue
+		}
+		srv.current().CountDatagram(target, bucket.DatagramOut, n)
+	}
+}
+
+// expire - periodically remove idle sessions until server is closed
+func (srv *Server) expire() {
+	idle := srv.idleTimeout()
+	period := idle / 2
+	if period < 10*time.Millisecond {
+		period = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for range ticker.C {
+		srv.lock.Lock()
+		if srv.closed {
+			srv.lock.Unlock()
+			return
+		}
+		for key, sess := range srv.sessions {
+			if sess.idle() > idle {
+				sess.close()
+				delete(srv.sessions, key)
+			}
+		}
+		udpSessions.WithLabelValues(srv.Addr).Set(float64(len(srv.sessions)))
+		srv.lock.Unlock()
+	}
+}
+
+func (sess *session) touch() {
+	atomic.StoreInt64(&sess.lastSeen, time.Now().UnixNano())
+}
+
+func (sess *session) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&sess.lastSeen))
+}
+
+// drop - forget server's socket, if it is still the current one, and close it
+func (sess *session) drop(target bucket.Server, conn net.Conn) {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if sess.upstreams[target] == conn {
+		delete(sess.upstreams, target)
+		target.AddInFlight(-1)
+		if sess.flow == target {
+			sess.flow = nil
+		}
+	}
+	conn.Close()
+}
+
+// close - close all sockets, relays forget them
+func (sess *session) close() {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	sess.closed = true
+	for _, conn := range sess.upstreams {
+		conn.Close()
+	}
+}
@@ -0,0 +1,216 @@
+package udpserv
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/freundallein/loadbalancer/bucket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// echoBackend - udp server answering with its name and the datagram
+func echoBackend(t *testing.T, name string) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(append([]byte(name+":"), buf[:n]...), addr)
+		}
+	}()
+	return conn
+}
+
+// closedAddress - address nobody listens on
+func closedAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func newBucket(addresses ...string) bucket.ServerBucket {
+	bckt, _ := bucket.New(bucket.RoundRobin)
+	for _, addr := range addresses {
+		srv, _ := bucket.NewServer("udp://" + addr)
+		bckt.AddServer(srv)
+		srv.SetAvailable(true)
+	}
+	return bckt
+}
+
+func start(t *testing.T, srv *Server) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+func dial(t *testing.T, address string) net.Conn {
+	client, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func exchange(t *testing.T, client net.Conn, msg string) string {
+	client.Write([]byte(msg))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, maxDatagram)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Error("Expected", "answer", "got", err)
+	}
+	return string(buf[:n])
+}
+
+func sessions(srv *Server) int {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return len(srv.sessions)
+}
+
+func TestPerFlow(t *testing.T) {
+	one, two := echoBackend(t, "one"), echoBackend(t, "two")
+	defer one.Close()
+	defer two.Close()
+	srv := New("127.0.0.1:0", newBucket(one.LocalAddr().String(), two.LocalAddr().String()))
+	defer srv.Close()
+	address := start(t, srv)
+	first, second := dial(t, address), dial(t, address)
+	defer first.Close()
+	defer second.Close()
+	a, b := exchange(t, first, "a"), exchange(t, second, "b")
+	if a[:4] == b[:4] {
+		t.Error("Expected", "flows on different servers", "got", a, b)
+	}
+	for i := 0; i < 3; i++ {
+		if observed := exchange(t, first, "a"); observed != a {
+			t.Error("Expected", a, "got", observed)
+		}
+	}
+	if observed := sessions(srv); observed != 2 {
+		t.Error("Expected", 2, "got", observed)
+	}
+}
+
+func TestPerPacket(t *testing.T) {
+	one, two := echoBackend(t, "one"), echoBackend(t, "two")
+	defer one.Close()
+	defer two.Close()
+	srv := New("127.0.0.1:0", newBucket(one.LocalAddr().String(), two.LocalAddr().String()))
+	srv.PerPacket = true
+	defer srv.Close()
+	client := dial(t, start(t, srv))
+	defer client.Close()
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[exchange(t, client, "a")] = true
+	}
+	if !seen["one:a"] || !seen["two:a"] {
+		t.Error("Expected", "datagrams spread over servers", "got", seen)
+	}
+}
+
+func TestIdleExpiry(t *testing.T) {
+	one := echoBackend(t, "one")
+	defer one.Close()
+	bckt := newBucket(one.LocalAddr().String())
+	srv := New("127.0.0.1:0", bckt)
+	srv.IdleTimeout = 50 * time.Millisecond
+	defer srv.Close()
+	client := dial(t, start(t, srv))
+	defer client.Close()
+	exchange(t, client, "a")
+	if bckt.Servers()[0].InFlight() != 1 {
+		t.Error("Expected", "flow in flight", "got", bckt.Servers()[0].InFlight())
+	}
+	for i := 0; i < 100 && (sessions(srv) > 0 || bckt.Servers()[0].InFlight() > 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sessions(srv) != 0 || bckt.Servers()[0].InFlight() != 0 {
+		t.Error("Expected", "session expired", "got", sessions(srv), bckt.Servers()[0].InFlight())
+	}
+}
+
+func TestMaxSessions(t *testing.T) {
+	one := echoBackend(t, "one")
+	defer one.Close()
+	srv := New("127.0.0.1:0", newBucket(one.LocalAddr().String()))
+	srv.MaxSessions = 1
+	defer srv.Close()
+	address := start(t, srv)
+	first, second := dial(t, address), dial(t, address)
+	defer first.Close()
+	defer second.Close()
+	exchange(t, first, "a")
+	second.Write([]byte("b"))
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := second.Read(make([]byte, maxDatagram)); err == nil {
+		t.Error("Expected", "datagram of new client dropped", "got", "answer")
+	}
+	if observed := exchange(t, first, "a"); observed != "one:a" {
+		t.Error("Expected", "one:a", "got", observed)
+	}
+	if observed := sessions(srv); observed != 1 {
+		t.Error("Expected", 1, "got", observed)
+	}
+}
+
+// ejections - server's ejections by reason, counted by its bucket
+func ejections(t *testing.T, srv bucket.Server, reason string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "lb_server_ejections_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["server"] == srv.Address().String() && labels["reason"] == reason {
+				return metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestRefusedServerAvoided(t *testing.T) {
+	healthy := echoBackend(t, "healthy")
+	defer healthy.Close()
+	bckt := newBucket(closedAddress(t), healthy.LocalAddr().String())
+	srv := New("127.0.0.1:0", bckt)
+	defer srv.Close()
+	client := dial(t, start(t, srv))
+	defer client.Close()
+	client.Write([]byte("lost"))
+	for i := 0; i < 100 && bckt.Servers()[0].IsAvailable(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if bckt.Servers()[0].IsAvailable() {
+		t.Error("Expected", "refusing server unavailable", "got", "available")
+	}
+	if observed := ejections(t, bckt.Servers()[0], bucket.EjectConnectError); observed != 1 {
+		t.Error("Expected", "refusal counted as ejection", "got", observed)
+	}
+	if observed := exchange(t, client, "a"); observed != "healthy:a" {
+		t.Error("Expected", "healthy:a", "got", observed)
+	}
+}
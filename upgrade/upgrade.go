@@ -0,0 +1,181 @@
+package upgrade
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	envFiles = "LB_UPGRADE_FDS"   // json list of listening sockets names, passed by parent process
+	envReady = "LB_UPGRADE_READY" // descriptor of pipe to report readiness to parent process
+
+	envListenPID   = "LISTEN_PID" // systemd socket activation
+	envListenFDs   = "LISTEN_FDS"
+	envListenNames = "LISTEN_FDNAMES"
+	envNotify      = "NOTIFY_SOCKET"
+
+	firstFD = 3 // inherited descriptors follow stdin, stdout and stderr
+)
+
+var (
+	ErrNotReady     = errors.New("new process exited before it was ready")
+	ErrReadyTimeout = errors.New("new process wasn't ready in time")
+)
+
+// Filer - listening socket, which can be passed to another process, like *net.TCPListener
+type Filer interface {
+	File() (*os.File, error)
+}
+
+// Inherit - listening sockets passed by parent process on upgrade or by systemd socket activation, by name
+// Parent's sockets are named by it, systemd ones by FileDescriptorName of socket units.
+// Environment is cleared, so that further child processes don't inherit sockets by accident.
+func Inherit() (map[string]*os.File, error) {
+	files := map[string]*os.File{}
+	var names []string
+	if encoded, ok := os.LookupEnv(envFiles); ok {
+		os.Unsetenv(envFiles)
+		if err := json.Unmarshal([]byte(encoded), &names); err != nil {
+			return nil, fmt.Errorf("%s: %s", envFiles, err.Error())
+		}
+	} else if os.Getenv(envListenPID) == strconv.Itoa(os.Getpid()) {
+		count, err := strconv.Atoi(os.Getenv(envListenFDs))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", envListenFDs, err.Error())
+		}
+		names = systemdNames(count, os.Getenv(envListenNames))
+	}
+	os.Unsetenv(envListenPID)
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenNames)
+	for i, name := range names {
+		fd := firstFD + i
+		syscall.CloseOnExec(fd)
+		files[name] = os.NewFile(uintptr(fd), name)
+	}
+	return files, nil
+}
+
+// systemdNames - names of activated sockets, missing ones are named by their descriptors
+func systemdNames(count int, names string) []string {
+	parsed := strings.Split(names, ":")
+	result := make([]string, count)
+	for i := range result {
+		if i < len(parsed) && parsed[i] != "" {
+			result[i] = parsed[i]
+			continue
+		}
+		result[i] = strconv.Itoa(firstFD + i)
+	}
+	return result
+}
+
+// Ready - report readiness to parent process, if started by upgrade, and to systemd
+func Ready(status string) error {
+	if fd, ok := os.LookupEnv(envReady); ok {
+		os.Unsetenv(envReady)
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return fmt.Errorf("%s: %s", envReady, err.Error())
+		}
+		pipe := os.NewFile(uintptr(n), "ready")
+		_, err = pipe.Write([]byte{1})
+		pipe.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return Notify("READY=1\nSTATUS=" + status)
+}
+
+// Notify - send state to systemd service manager, does nothing if not started by it
+// States are described in sd_notify(3), like "READY=1" or "STOPPING=1".
+func Notify(state string) error {
+	path := os.Getenv(envNotify)
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:] // abstract namespace
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Start - run a new process of the same binary with listening sockets and wait until it is ready
+// Process, which exits or isn't ready before ctx is done, is killed and error is returned.
+func Start(ctx context.Context, sockets map[string]Filer) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	files := []*os.File{}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for name, socket := range sockets {
+		file, err := socket.File()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		names = append(names, name)
+		files = append(files, file)
+	}
+	encoded, err := json.Marshal(names)
+	if err != nil {
+		return nil, err
+	}
+	ready, notify, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer ready.Close()
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, notify)
+	cmd.Env = append(os.Environ(),
+		envFiles+"="+string(encoded),
+		envReady+"="+strconv.Itoa(firstFD+len(files)),
+	)
+	err = cmd.Start()
+	notify.Close()
+	if err != nil {
+		return nil, err
+	}
+	go cmd.Wait()
+	done := make(chan error, 1)
+	go func() {
+		// the pipe is closed without a byte, when process exits
+		if _, err := ready.Read(make([]byte, 1)); err != nil {
+			done <- ErrNotReady
+			return
+		}
+		done <- nil
+	}()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ErrReadyTimeout
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	return cmd.Process, nil
+}
@@ -0,0 +1,120 @@
+package upgrade
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const envChild = "UPGRADE_TEST_CHILD"
+
+// TestMain - test binary plays the new process, when started by Start
+func TestMain(m *testing.M) {
+	switch os.Getenv(envChild) {
+	case "":
+		os.Exit(m.Run())
+	case "fail":
+		os.Exit(1)
+	default:
+		os.Exit(child())
+	}
+}
+
+// child - greet one connection on inherited socket
+func child() int {
+	files, err := Inherit()
+	if err != nil {
+		return 2
+	}
+	ln, err := net.FileListener(files["web"])
+	if err != nil {
+		return 3
+	}
+	if err := Ready("serving"); err != nil {
+		return 4
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		return 5
+	}
+	defer conn.Close()
+	conn.Write([]byte("child"))
+	return 0
+}
+
+func start(t *testing.T, mode string, sockets map[string]Filer) (*os.Process, error) {
+	os.Setenv(envChild, mode)
+	defer os.Unsetenv(envChild)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return Start(ctx, sockets)
+}
+
+func TestStartHandsOverSockets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	process, err := start(t, "serve", map[string]Filer{"web": ln.(*net.TCPListener)})
+	if err != nil {
+		t.Fatal("Expected", "ready process", "got", err)
+	}
+	defer process.Kill()
+	ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal("Expected", "socket kept open by new process", "got", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, _ := ioutil.ReadAll(conn); string(data) != "child" {
+		t.Error("Expected", "child", "got", string(data))
+	}
+}
+
+func TestStartNotReady(t *testing.T) {
+	if _, err := start(t, "fail", map[string]Filer{}); err != ErrNotReady {
+		t.Error("Expected", ErrNotReady, "got", err)
+	}
+}
+
+func TestSystemdNames(t *testing.T) {
+	observed := systemdNames(3, "public:admin")
+	expected := []string{"public", "admin", "5"}
+	if !reflect.DeepEqual(observed, expected) {
+		t.Error("Expected", expected, "got", observed)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	if err := Notify("READY=1"); err != nil {
+		t.Error("Expected", "no-op without systemd", "got", err)
+	}
+	dir, err := ioutil.TempDir("", "notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv(envNotify, path)
+	defer os.Unsetenv(envNotify)
+	if err := Notify("STOPPING=1"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if string(buf[:n]) != "STOPPING=1" || err != nil {
+		t.Error("Expected", "STOPPING=1", "got", string(buf[:n]), err)
+	}
+}